@@ -0,0 +1,208 @@
+package datastore
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+type SegmentStats struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type DbStats struct {
+	Keys     int            `json:"keys"`
+	Segments []SegmentStats `json:"segments"`
+	// Bytes of the entries the index points to
+	LiveBytes int64 `json:"liveBytes"`
+	// Bytes of the overwritten and deleted entries, which the merge removes
+	GarbageBytes int64 `json:"garbageBytes"`
+	// Time of the last merge since the db was opened, zero if there was none
+	LastMerge time.Time `json:"lastMerge"`
+	// Duration of the last merge in nanoseconds
+	LastMergeDuration time.Duration `json:"lastMergeDuration"`
+	// Writes sent to the writing thread, including the one being applied
+	QueueDepth int `json:"queueDepth"`
+	// Lookups of absent keys rejected by the bloom filters of the segments
+	FilterNegatives uint64 `json:"filterNegatives"`
+	// Lookups passed by the bloom filters, but not found, e.g. of the deleted
+	// keys
+	FalsePositives uint64 `json:"falsePositives"`
+	// Share of the absent keys which were not rejected by the bloom filters
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+}
+
+func (db *Db) Stats() (DbStats, error) {
+	db.indexMutex.Lock()
+	stats := DbStats{
+		Keys:              len(db.index),
+		LastMerge:         db.lastMerge,
+		LastMergeDuration: db.lastMergeDuration,
+		QueueDepth:        int(atomic.LoadInt32(&db.pending)),
+		FilterNegatives:   atomic.LoadUint64(&db.filterNegatives),
+		FalsePositives:    atomic.LoadUint64(&db.falsePositives),
+	}
+	if total := stats.FilterNegatives + stats.FalsePositives; total > 0 {
+		stats.FalsePositiveRate = float64(stats.FalsePositives) / float64(total)
+	}
+	if db.opts.MVCC {
+		// all the kept versions are live
+		for _, positions := range db.history {
+			for _, position := range positions {
+				stats.LiveBytes += position.size
+			}
+		}
+	} else {
+		for _, position := range db.index {
+			stats.LiveBytes += position.size
+		}
+	}
+	segments := append([]string(nil), db.segments...)
+	db.indexMutex.Unlock()
+
+	var total int64
+	for _, path := range segments {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// merged meanwhile
+			continue
+		} else if err != nil {
+			return DbStats{}, err
+		}
+		stats.Segments = append(stats.Segments, SegmentStats{
+			Name: filepath.Base(path),
+			Size: info.Size(),
+		})
+		total += info.Size()
+	}
+	if total > stats.LiveBytes {
+		stats.GarbageBytes = total - stats.LiveBytes
+	}
+	return stats, nil
+}
+
+// Merges all the segments, including the current one, so the garbage is
+// removed.
+func (db *Db) Compact() error {
+	atomic.AddInt32(&db.pending, 1)
+	defer atomic.AddInt32(&db.pending, -1)
+	callback := make(chan error)
+	db.writeChan <- writeRequest{
+		compact:  true,
+		callback: callback,
+	}
+	return <-callback
+}
+
+// Called by the writing thread only.
+func (db *Db) compact() error {
+	if db.offset > 0 {
+		if err := db.sealSegment(); err != nil {
+			return err
+		}
+	}
+	if len(db.segments) > 1 {
+		return db.mergeSegments()
+	}
+	return nil
+}
+
+// Result of checking the entries of a segment.
+type SegmentCheck struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+	// Offsets of the entries with bad checksums
+	Corrupt []int64 `json:"corrupt,omitempty"`
+	// Error which stopped the check before the end of the segment, e.g. a
+	// truncated entry, found at ErrorOffset
+	Error       string `json:"error,omitempty"`
+	ErrorOffset int64  `json:"errorOffset,omitempty"`
+}
+
+func (c *SegmentCheck) OK() bool {
+	return len(c.Corrupt) == 0 && c.Error == ""
+}
+
+// Reads the first size bytes of the segment checking every entry.
+func checkSegment(path string, size int64) (SegmentCheck, error) {
+	return scanSegment(path, size, nil)
+}
+
+// Checks the entries of the segment like checkSegment and passes the intact
+// ones to fn, if it is not nil.
+func scanSegment(path string, size int64, fn func(e *entry) error) (SegmentCheck, error) {
+	check := SegmentCheck{Name: filepath.Base(path)}
+	file, err := os.Open(path)
+	if err != nil {
+		return check, err
+	}
+	defer file.Close()
+
+	in := bufio.NewReaderSize(io.LimitReader(file, size), bufSize)
+	var offset int64
+	for offset < size {
+		e, err := readEntryMax(in, size-offset)
+		if err == ErrHashSumDontMatch {
+			// sizes were fine, so the next entry is found
+			check.Corrupt = append(check.Corrupt, offset)
+			check.Entries++
+			offset += e.serializedSize()
+			continue
+		} else if err == io.ErrUnexpectedEOF {
+			err = ErrBadEntrySize
+		}
+		if err != nil {
+			check.Error = err.Error()
+			check.ErrorOffset = offset
+			break
+		}
+		check.Entries++
+		offset += e.serializedSize()
+		if fn != nil {
+			if err := fn(e); err != nil {
+				return check, err
+			}
+		}
+	}
+	return check, nil
+}
+
+// Checks the checksums of all the entries in every segment.
+func (db *Db) Verify() ([]SegmentCheck, error) {
+	checks, err := db.verifyOnce()
+	if os.IsNotExist(err) {
+		// segment was merged meanwhile
+		checks, err = db.verifyOnce()
+	}
+	return checks, err
+}
+
+func (db *Db) verifyOnce() ([]SegmentCheck, error) {
+	db.indexMutex.Lock()
+	segments := append([]string(nil), db.segments...)
+	// the current segment is checked up to the last applied write
+	current := db.offset
+	db.indexMutex.Unlock()
+
+	checks := make([]SegmentCheck, 0, len(segments))
+	for i, path := range segments {
+		size := current
+		if i < len(segments)-1 {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			size = info.Size()
+		}
+		check, err := checkSegment(path, size)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDb_Admin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%5), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Keys != 5 || len(stats.Segments) != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+		if stats.LiveBytes != stats.GarbageBytes || stats.LiveBytes != stats.Segments[0].Size/2 {
+			t.Errorf("Half of the data should be garbage, got %+v", stats)
+		}
+		if !stats.LastMerge.IsZero() {
+			t.Errorf("Unexpected merge at %s", stats.LastMerge)
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.GarbageBytes != 0 || stats.LastMerge.IsZero() {
+			t.Errorf("Unexpected stats after compaction %+v", stats)
+		}
+		if value, err := db.Get("key3"); err != nil || value != "value" {
+			t.Errorf("Cannot get key3 after compaction: %s %v", value, err)
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		checks, err := db.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(checks) != 2 || !checks[0].OK() || checks[0].Entries != 5 {
+			t.Fatalf("Unexpected checks %+v", checks)
+		}
+
+		// flip a byte in the value of the second entry of the merged segment
+		path := filepath.Join(dir, checks[0].Name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := len(data) / 5
+		data[size+size-sha1Len-1] ^= 0xff
+		if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		checks, err = db.Verify()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checks[0].OK() || len(checks[0].Corrupt) != 1 || checks[0].Corrupt[0] != int64(size) {
+			t.Errorf("Corrupt entry is not found %+v", checks[0])
+		}
+		if checks[0].Entries != 5 || checks[0].Error != "" {
+			t.Errorf("Check did not continue after the corrupt entry %+v", checks[0])
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync/atomic"
+)
+
+var ErrBadFilter = fmt.Errorf("bad bloom filter")
+
+// Bloom filter answers whether a key may be present in a set. False positives
+// are possible, false negatives are not. Bits are set and read atomically, so
+// the filter may be read while the keys are added.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint32
+}
+
+// Creates a filter sized for n keys with the desired false positive rate.
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := int(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (m+63)/64),
+		hashes: uint32(k),
+	}
+}
+
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	// hashing can't fall, so we don't need to check for errors
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (f *bloomFilter) addHash(h uint64) {
+	// double hashing: i-th probe is h1 + i*h2
+	h1, h2 := uint32(h), uint32(h>>32)
+	m := uint32(len(f.bits) * 64)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		word, mask := &f.bits[bit/64], uint64(1)<<(bit%64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+}
+
+func (f *bloomFilter) add(key string) {
+	f.addHash(bloomHash(key))
+}
+
+func (f *bloomFilter) mayContain(key string) bool {
+	h := bloomHash(key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	m := uint32(len(f.bits) * 64)
+	for i := uint32(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % m
+		if atomic.LoadUint64(&f.bits[bit/64])&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter is stored as an entry with the number of hash functions as a key and
+// the bit array as a value, so the file is protected by the checksum as well.
+func (f *bloomFilter) encode() []byte {
+	bits := make([]byte, len(f.bits)*8)
+	for i, word := range f.bits {
+		binary.LittleEndian.PutUint64(bits[i*8:], word)
+	}
+	e := entry{
+		key:   encodeUint64(uint64(f.hashes)),
+		value: string(bits),
+	}
+	return e.Encode()
+}
+
+func writeBloomFilter(path string, f *bloomFilter) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, f.encode(), 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readBloomFilter(path string) (*bloomFilter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	e, err := readEntry(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := decodeUint64(e.key)
+	if err != nil {
+		return nil, err
+	}
+	if hashes == 0 || len(e.value) == 0 || len(e.value)%8 != 0 {
+		return nil, ErrBadFilter
+	}
+	f := &bloomFilter{
+		bits:   make([]uint64, len(e.value)/8),
+		hashes: uint32(hashes),
+	}
+	bits := []byte(e.value)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(bits[i*8:])
+	}
+	return f, nil
+}
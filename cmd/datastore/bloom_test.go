@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 1000
+	f := newBloomFilter(n, 0.01)
+	for i := 0; i < n; i++ {
+		f.add(fmt.Sprintf("key%d", i))
+	}
+	for i := 0; i < n; i++ {
+		if !f.mayContain(fmt.Sprintf("key%d", i)) {
+			t.Fatalf("False negative for key%d", i)
+		}
+	}
+
+	positives := 0
+	for i := 0; i < n; i++ {
+		if f.mayContain(fmt.Sprintf("missing%d", i)) {
+			positives++
+		}
+	}
+	// expected rate is 1%, leave some room for the randomness
+	if positives > n/20 {
+		t.Errorf("Too many false positives: %d of %d", positives, n)
+	}
+}
@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrBadRecord = fmt.Errorf("bad record")
+
+// Reads JSON lines of writes, e.g. {"key": "a", "value": "b"}, and applies
+// them in batches of batchSize. Returns the number of the applied writes.
+func Import(store Store, in io.Reader, batchSize int) (int, error) {
+	decoder := json.NewDecoder(bufio.NewReaderSize(in, bufSize))
+	applied := 0
+	batch := make([]Write, 0, batchSize)
+	flush := func() error {
+		if err := store.Apply(nil, batch); err != nil {
+			return err
+		}
+		applied += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		var w Write
+		err := decoder.Decode(&w)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return applied, fmt.Errorf("%w %d: %s", ErrBadRecord, applied+len(batch)+1, err)
+		}
+		if w.Key == "" {
+			return applied, fmt.Errorf("%w %d: empty key", ErrBadRecord, applied+len(batch)+1)
+		}
+		batch = append(batch, w)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return applied, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return applied, flush()
+	}
+	return applied, nil
+}
+
+// Versions the keys had when an export started, recorded for the keys which
+// are written while it runs; 0 for the absent ones.
+type exportSnapshot struct {
+	versions map[string]uint64
+}
+
+// Passes every live key with its value to fn as they were at the moment of
+// the call, writes made meanwhile are not seen. The keys are unordered, they
+// come in the order of their entries in the segments, which are read
+// sequentially. Apart from the buffers, the export keeps only the versions of
+// the keys written while it runs.
+func (db *Db) Export(fn func(key, value string) error) error {
+	snapshot := &exportSnapshot{versions: make(map[string]uint64)}
+	db.indexMutex.Lock()
+	// open files stay readable even if the segments are merged meanwhile
+	files := make([]*os.File, 0, len(db.segments))
+	for _, path := range db.segments {
+		file, err := os.Open(path)
+		if err != nil {
+			db.indexMutex.Unlock()
+			for _, file := range files {
+				file.Close()
+			}
+			return err
+		}
+		files = append(files, file)
+	}
+	// the entries after it are written later
+	end := db.offset
+	db.exports[snapshot] = struct{}{}
+	db.indexMutex.Unlock()
+	defer func() {
+		db.indexMutex.Lock()
+		delete(db.exports, snapshot)
+		db.indexMutex.Unlock()
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for i, file := range files {
+		var input io.Reader = file
+		if i == len(files)-1 {
+			input = io.LimitReader(file, end)
+		}
+		in := bufio.NewReaderSize(input, bufSize)
+		for {
+			e, err := readEntry(in)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", file.Name(), err)
+			}
+			if e.kind == kindTombstone || db.snapshotVersion(snapshot, e.key) != e.seq {
+				// superseded
+				continue
+			}
+			if err := fn(e.key, e.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the version the key had when the export started.
+func (db *Db) snapshotVersion(snapshot *exportSnapshot, key string) uint64 {
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+	if version, ok := snapshot.versions[key]; ok {
+		return version
+	}
+	return db.index[key].version
+}
+
+// Remembers the versions of the keys before they are written for the running
+// exports, called with indexMutex locked.
+func (db *Db) recordExports(key string) {
+	for snapshot := range db.exports {
+		if _, ok := snapshot.versions[key]; !ok {
+			snapshot.versions[key] = db.index[key].version
+		}
+	}
+}
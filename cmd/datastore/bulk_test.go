@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDb_ImportExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SegmentSize(512)
+	db.Start()
+	defer db.Close()
+
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf(`{"key": "key%d", "value": "value%d"}`, i, i))
+	}
+	lines = append(lines, `{"key": "key0", "delete": true}`)
+
+	n, err := Import(db, strings.NewReader(strings.Join(lines, "\n")), 7)
+	if err != nil || n != 101 {
+		t.Fatalf("Imported %d records, error %v", n, err)
+	}
+	_, err = Import(db, strings.NewReader(`{"key": "a"} {"value": "b"}`), 7)
+	if !errors.Is(err, ErrBadRecord) {
+		t.Errorf("Expected ErrBadRecord, got %v", err)
+	}
+
+	exported := make(map[string]string)
+	err = db.Export(func(key, value string) error {
+		if len(exported) == 0 {
+			// segments are merged during the export
+			for i := 0; i < 100; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), "changed"); err != nil {
+					return err
+				}
+			}
+			if err := db.Delete("key1"); err != nil {
+				return err
+			}
+			if err := db.Put("extra", "value"); err != nil {
+				return err
+			}
+		}
+		exported[key] = value
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := exported["key1"]; !ok || len(exported) != 99 {
+		t.Errorf("Expected 99 keys, got %d", len(exported))
+	}
+	for key, value := range exported {
+		if value != strings.Replace(key, "key", "value", 1) {
+			t.Errorf("Bad value %s of %s, changes after the start are exported", value, key)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,6 +19,10 @@ const KB = 1024
 const MB = 1024 * KB
 const defaultSegmentSize = 10 * MB
 
+// The filter of the current segment is sized for the most entries it may get,
+// but not for more than this
+const maxSegmentFilterKeys = 1 << 20
+
 // value for db.started flag
 const STARTED = 0xbeef
 const CLOSED = 0xdead
@@ -27,51 +32,123 @@ var ErrNotFound = fmt.Errorf("record does not exist")
 type hashIndexEntry struct {
 	segmentIdx int // index into db.segments array
 	offset     int64
+	size       int64  // size of the encoded entry
+	version    uint64 // sequence number of the latest write of the key
 }
 
 type hashIndex map[string]hashIndexEntry
 
+// Options of the db which have to be known when it is opened.
+type Options struct {
+	// Max size of the segment, defaultSegmentSize if zero
+	SegmentSize int64
+
+	// Keep previous versions of the keys, see GetAt and History
+	MVCC bool
+	// Number of the latest versions of a key kept by the merge, unlimited if zero
+	KeepVersions int
+	// How long a version is kept by the merge after it was overwritten,
+	// unlimited if zero
+	KeepFor time.Duration
+
+	Limits Limits
+	// Total size limit shared with other stores, if not nil
+	Quota *DiskQuota
+}
+
 type Db struct {
+	diskSize int64 // size of the data directory, updated atomically
+	pending  int32 // number of the writes sent to the writing thread, updated atomically
+
+	// bloom filter statistics, updated atomically
+	filterNegatives uint64 // misses answered by the filters
+	falsePositives  uint64 // keys passed by the filters, but absent
+
 	dir     string
 	out     *os.File
 	offset  int64
 	maxSize int64
+	opts    Options
+	now     func() time.Time
 
 	segments []string
+	// bloom filters of the segments, []*bloomFilter in the order of
+	// db.segments. It's replaced as a whole with indexMutex locked, so the
+	// lookups read it without the lock. The filter of the current segment
+	// gets the keys as they are written.
+	filters atomic.Value
+	// hashes of the keys written to the current segment, so that its filter
+	// is sized exactly when it's sealed; used by the writing thread only
+	segmentHashes []uint64
 
 	indexMutex sync.Mutex
 	index      hashIndex
+	history    map[string][]hashIndexEntry  // all versions of the keys in MVCC mode, oldest first
+	exports    map[*exportSnapshot]struct{} // running exports
+
+	lastMerge         time.Time // guarded by indexMutex
+	lastMergeDuration time.Duration
+
+	secondaryMutex sync.RWMutex
+	secondary      map[string]*secondaryIndex
+
+	watchMutex sync.Mutex
+	watchers   map[*Watcher]struct{}
+	changes    []ChangeEvent // recent changes, oldest first
+	// sequence number of the last write, changed by the writing thread with
+	// watchMutex locked
+	seq uint64
 
 	started   uint32 // flag whether the writing thread has started
 	closed    uint32 // flag whether the db is closed to prevent double closing of the channel
 	writeChan chan writeRequest
 }
 
-type writeRequest struct {
-	key, value string
-	callback   chan error
+func NewDb(dir string) (*Db, error) {
+	return NewDbWithOptions(dir, Options{})
 }
 
-func NewDb(dir string) (*Db, error) {
+func NewDbWithOptions(dir string, opts Options) (*Db, error) {
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
 	db := &Db{
 		dir:        dir,
 		out:        nil,
 		offset:     0,
-		maxSize:    defaultSegmentSize,
+		maxSize:    opts.SegmentSize,
+		opts:       opts,
+		now:        time.Now,
 		segments:   []string{},
 		index:      make(hashIndex),
+		history:    make(map[string][]hashIndexEntry),
+		exports:    make(map[*exportSnapshot]struct{}),
 		indexMutex: sync.Mutex{},
+		secondary:  make(map[string]*secondaryIndex),
+		watchers:   make(map[*Watcher]struct{}),
 		started:    0,
 		writeChan:  make(chan writeRequest),
 	}
+	if err := initFormat(dir); err != nil {
+		return nil, err
+	}
+	if err := writeMode(dir, opts.MVCC); err != nil {
+		return nil, err
+	}
 	err := db.recover()
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	if err := db.saveFilters(); err != nil {
+		return nil, err
+	}
 	err = db.pushNewSegment()
 	if err != nil {
 		return nil, err
 	}
+	if err := db.updateDiskSize(); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -84,7 +161,12 @@ func (db *Db) SegmentSize(max int64) *Db {
 const bufSize = 8192
 
 func (db *Db) recover() error {
-	files, err := ioutil.ReadDir(db.dir)
+	// definitions go first, so indexes are rebuilt while segments are read
+	if err := db.loadIndexDefs(); err != nil {
+		return err
+	}
+
+	files, err := segmentFiles(db.dir)
 	if err != nil {
 		return err
 	}
@@ -92,23 +174,40 @@ func (db *Db) recover() error {
 		return files[i].ModTime().Before(files[j].ModTime())
 	})
 
+	// versions of the deleted keys, so older writes read later don't restore them
+	deleted := make(map[string]uint64)
+	var filters []*bloomFilter
 	for _, file := range files {
 		path := filepath.Join(db.dir, file.Name())
 
-		err = db.recoverSegment(path)
+		hashes, err := db.recoverSegment(path, deleted)
 		if err != nil {
 			return err
 		}
+		filter, err := readBloomFilter(segmentFilterPath(path))
+		if err != nil {
+			// lost or damaged, saveFilters writes it again
+			filter = filterOf(hashes)
+		}
+		filters = append(filters, filter)
 	}
+	db.filters.Store(filters)
 
+	for _, positions := range db.history {
+		positions := positions
+		sort.Slice(positions, func(i, j int) bool {
+			return positions[i].version < positions[j].version
+		})
+	}
 	return nil
 }
 
-// Recovers segment, by reading the file and updating the index.
-func (db *Db) recoverSegment(path string) error {
+// Recovers segment, by reading the file and updating the index. Returns the
+// hashes of its keys for the bloom filter.
+func (db *Db) recoverSegment(path string, deleted map[string]uint64) ([]uint64, error) {
 	input, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer input.Close()
 
@@ -117,19 +216,43 @@ func (db *Db) recoverSegment(path string) error {
 
 	in := bufio.NewReaderSize(input, bufSize)
 	var offset int64 = 0
+	var hashes []uint64
 	for {
 
 		e, err := readEntry(in)
 		if err == io.EOF {
-			return nil
+			return hashes, nil
 		} else if err != nil {
-			return err
+			return nil, err
 		}
+		hashes = append(hashes, bloomHash(e.key))
 		indexEntry := hashIndexEntry{
 			segmentIdx: currentIdx,
 			offset:     offset,
+			size:       e.serializedSize(),
+			version:    e.seq,
+		}
+		// segments may be read in any order, the latest write wins
+		latest := deleted[e.key]
+		if old, ok := db.index[e.key]; ok && old.version > latest {
+			latest = old.version
+		}
+		if e.seq >= latest {
+			if e.kind == kindTombstone {
+				delete(db.index, e.key)
+				deleted[e.key] = e.seq
+				db.removeFromSecondaryIndexes(e.key)
+			} else {
+				db.index[e.key] = indexEntry
+				db.updateSecondaryIndexes(e.key, e.value)
+			}
+		}
+		if db.opts.MVCC {
+			db.history[e.key] = append(db.history[e.key], indexEntry)
+		}
+		if e.seq > db.seq {
+			db.seq = e.seq
 		}
-		db.index[e.key] = indexEntry
 		offset += e.serializedSize()
 
 	}
@@ -140,54 +263,178 @@ func (db *Db) Close() error {
 		return nil
 	}
 	close(db.writeChan)
+	db.closeWatchers()
+	db.opts.Quota.add(-atomic.LoadInt64(&db.diskSize))
 	return db.out.Close()
 }
 
 func (db *Db) Get(key string) (string, error) {
+	value, _, err := db.GetVersion(key)
+	return value, err
+}
+
+// Returns the value with its version, the sequence number of the write. The
+// bloom filters of the segments answer most of the misses without the lock of
+// the index.
+func (db *Db) GetVersion(key string) (string, uint64, error) {
+	if !db.mayContain(key) {
+		atomic.AddUint64(&db.filterNegatives, 1)
+		return "", 0, ErrNotFound
+	}
+	e, err := db.read(func() (hashIndexEntry, bool) {
+		position, ok := db.index[key]
+		return position, ok
+	})
+	if err == ErrNotFound {
+		atomic.AddUint64(&db.falsePositives, 1)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return e.value, e.seq, nil
+}
+
+// Reads the entry at the position found by locate, which is called with
+// indexMutex locked.
+func (db *Db) read(locate func() (hashIndexEntry, bool)) (*entry, error) {
+	e, err := db.readOnce(locate)
+	if os.IsNotExist(err) {
+		// segment was merged meanwhile, so the index points to the new one
+		e, err = db.readOnce(locate)
+	}
+	return e, err
+}
+
+func (db *Db) readOnce(locate func() (hashIndexEntry, bool)) (*entry, error) {
 	db.indexMutex.Lock()
-	position, ok := db.index[key]
+	position, ok := locate()
+	var segName string
+	if ok {
+		segName = db.segments[position.segmentIdx]
+	}
 	db.indexMutex.Unlock()
 	if !ok {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	}
+	return readEntryAt(segName, position.offset)
+}
 
-	segName := &db.segments[position.segmentIdx]
-	file, err := os.Open(*segName)
+func readEntryAt(segName string, offset int64) (*entry, error) {
+	file, err := os.Open(segName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer file.Close()
 
-	_, err = file.Seek(position.offset, 0)
+	_, err = file.Seek(offset, 0)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	reader := bufio.NewReader(file)
-	e, err := readEntry(reader)
+	return readEntry(reader)
+}
+
+// Bloom filter of the segment is kept next to it
+func segmentFilterPath(segmentPath string) string {
+	return filepath.Join(filepath.Dir(segmentPath), "bloom-"+filepath.Base(segmentPath))
+}
+
+func filterOf(hashes []uint64) *bloomFilter {
+	filter := newBloomFilter(len(hashes), bloomFalsePositiveRate)
+	for _, h := range hashes {
+		filter.addHash(h)
+	}
+	return filter
+}
+
+func (db *Db) newSegmentFilter() *bloomFilter {
+	n := db.maxSize/headerLen + 1
+	if n > maxSegmentFilterKeys {
+		n = maxSegmentFilterKeys
+	}
+	return newBloomFilter(int(n), bloomFalsePositiveRate)
+}
+
+func (db *Db) segmentFilters() []*bloomFilter {
+	filters, _ := db.filters.Load().([]*bloomFilter)
+	return filters
+}
+
+// Reports whether the key may be in any of the segments.
+func (db *Db) mayContain(key string) bool {
+	for _, filter := range db.segmentFilters() {
+		if filter.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes the filters of the recovered segments which lost them, and removes
+// the filters left by an interrupted merge.
+func (db *Db) saveFilters() error {
+	filters := db.segmentFilters()
+	kept := make(map[string]bool)
+	for i, path := range db.segments {
+		kept[filepath.Base(segmentFilterPath(path))] = true
+		if _, err := readBloomFilter(segmentFilterPath(path)); err == nil {
+			continue
+		}
+		if err := writeBloomFilter(segmentFilterPath(path), filters[i]); err != nil {
+			return err
+		}
+	}
+	files, err := ioutil.ReadDir(db.dir)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return e.value, nil
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "bloom-segment-") && !kept[file.Name()] {
+			if err := os.Remove(filepath.Join(db.dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (db *Db) pushNewSegment() error {
+	if err := db.sealSegment(); err != nil {
+		return err
+	}
+	if len(db.segments) >= 3 {
+		return db.mergeSegments()
+	}
+	return nil
+}
+
+// Closes the current segment and starts a new one.
+func (db *Db) sealSegment() error {
+	filters := append([]*bloomFilter(nil), db.segmentFilters()...)
 	if db.out != nil {
 		if err := db.out.Close(); err != nil {
 			return err
 		}
+		// the filter filled while the segment was written is larger than
+		// needed
+		sealed := filterOf(db.segmentHashes)
+		if err := writeBloomFilter(segmentFilterPath(db.out.Name()), sealed); err != nil {
+			return err
+		}
+		filters[len(filters)-1] = sealed
+		db.segmentHashes = nil
 	}
 	filepath, file, err := db.openNewSegment()
 	if err != nil {
 		return err
 	}
+	db.indexMutex.Lock()
 	db.segments = append(db.segments, filepath)
-	db.out = file
+	db.filters.Store(append(filters, db.newSegmentFilter()))
 	db.offset = 0
-
-	if len(db.segments) >= 3 {
-		return db.mergeSegments()
-	}
+	db.indexMutex.Unlock()
+	db.out = file
 	return nil
 }
 
@@ -198,25 +445,102 @@ func (db *Db) openNewSegment() (string, *os.File, error) {
 	return filepath, file, err
 }
 
-func (db *Db) putUnsafe(key, value string) error {
-	e := entry{
-		key:   key,
-		value: value,
+// Applies the writes of the request, called by the writing thread only.
+func (db *Db) apply(req writeRequest) error {
+	db.indexMutex.Lock()
+	err := checkReads(req.reads, func(key string) (uint64, error) {
+		return db.index[key].version, nil
+	})
+	db.indexMutex.Unlock()
+	if err != nil || len(req.writes) == 0 {
+		return err
 	}
-	n, err := db.out.Write(e.Encode())
+	if err := db.opts.Limits.checkWrites(req.writes); err != nil {
+		return err
+	}
+
+	timestamp := db.now().UnixNano()
+	entries := make([]entry, len(req.writes))
+	var data []byte
+	for i, w := range req.writes {
+		entries[i] = entry{
+			key:       w.Key,
+			value:     w.Value,
+			seq:       db.seq + uint64(i) + 1,
+			timestamp: timestamp,
+		}
+		if w.Delete {
+			entries[i].value = ""
+			entries[i].kind = kindTombstone
+		}
+		data = append(data, entries[i].Encode()...)
+	}
+	err = db.opts.Limits.checkDisk(atomic.LoadInt64(&db.diskSize), int64(len(data)), req.writes)
 	if err == nil {
-		entry := hashIndexEntry{
+		err = db.opts.Quota.check(int64(len(data)), req.writes)
+	}
+	if err != nil {
+		return err
+	}
+	// single write, so all the changes get to the file together
+	n, err := db.out.Write(data)
+	atomic.AddInt64(&db.diskSize, int64(n))
+	db.opts.Quota.add(int64(n))
+	if err != nil {
+		return err
+	}
+	// the keys get to the filter before the index, so the lookups which find
+	// them in the index don't miss them in the filter
+	filters := db.segmentFilters()
+	for _, e := range entries {
+		h := bloomHash(e.key)
+		filters[len(filters)-1].addHash(h)
+		db.segmentHashes = append(db.segmentHashes, h)
+	}
+
+	db.indexMutex.Lock()
+	offset := db.offset
+	for _, e := range entries {
+		position := hashIndexEntry{
 			segmentIdx: len(db.segments) - 1,
-			offset:     db.offset,
+			offset:     offset,
+			size:       e.serializedSize(),
+			version:    e.seq,
+		}
+		db.recordExports(e.key)
+		if e.kind == kindTombstone {
+			delete(db.index, e.key)
+		} else {
+			db.index[e.key] = position
 		}
-		db.index[key] = entry
-		db.offset += int64(n)
+		if db.opts.MVCC {
+			db.history[e.key] = append(db.history[e.key], position)
+		}
+		offset += e.serializedSize()
+	}
+	db.offset = offset
+	db.indexMutex.Unlock()
 
-		if db.offset >= db.maxSize {
-			return db.pushNewSegment()
+	for _, e := range entries {
+		event := ChangeEvent{
+			Key:   e.key,
+			Value: e.value,
+			Op:    OpPut,
+			Seq:   e.seq,
+		}
+		if e.kind == kindTombstone {
+			db.removeFromSecondaryIndexes(e.key)
+			event.Op = OpDelete
+		} else {
+			db.updateSecondaryIndexes(e.key, e.value)
 		}
+		db.publish(event)
 	}
-	return err
+
+	if db.offset >= db.maxSize {
+		return db.pushNewSegment()
+	}
+	return nil
 }
 
 func randStringBytes(n int) string {
@@ -234,8 +558,13 @@ func nextSegName() string {
 	return fmt.Sprintf("segment-%s", randStringBytes(10))
 }
 
+// Merges all the segments except the current one into a single segment.
 func (db *Db) mergeSegments() error {
-	values := make(map[string]string)
+	started := time.Now()
+	versions := make(map[string][]*entry)
+	// the last write of the merged segments, recover takes the sequence
+	// number from it
+	var last *entry
 	oldsegments := db.segments[:len(db.segments)-1]
 	for _, filename := range oldsegments {
 		file, err := os.Open(filename)
@@ -251,7 +580,14 @@ func (db *Db) mergeSegments() error {
 			} else if err != nil {
 				return err
 			}
-			values[entr.key] = entr.value
+			if last == nil || entr.seq > last.seq {
+				last = entr
+			}
+			if db.opts.MVCC {
+				versions[entr.key] = append(versions[entr.key], entr)
+			} else if old := versions[entr.key]; len(old) == 0 || old[0].seq <= entr.seq {
+				versions[entr.key] = []*entry{entr}
+			}
 		}
 	}
 
@@ -265,40 +601,94 @@ func (db *Db) mergeSegments() error {
 	filename := nextSegName()
 	filepth := filepath.Join(db.dir, filename)
 
-	index := make(hashIndex)
-	segments := []string{filepth, db.segments[len(db.segments)-1]}
+	merged := make(map[string][]hashIndexEntry)
+	current := len(db.segments) - 1
+	segments := []string{filepth, db.segments[current]}
 
 	var offset int64 = 0
-	if err != nil {
-		return err
-	}
-	for key, value := range values {
-		entr := entry{
-			key:   key,
-			value: value,
+	var hashes []uint64
+	for key, entries := range versions {
+		if db.opts.MVCC {
+			db.indexMutex.Lock()
+			newer := 0
+			for _, position := range db.history[key] {
+				if position.segmentIdx == current {
+					newer++
+				}
+			}
+			db.indexMutex.Unlock()
+			entries = db.retainVersions(entries, newer)
 		}
-		_, err := file.Write(entr.Encode())
-		if err != nil {
-			return err
+		// older versions are gone, so there is nothing for the tombstones to
+		// hide, except the last one, which keeps the sequence number from
+		// being reused
+		for len(entries) > 0 && entries[0].kind == kindTombstone && entries[0] != last {
+			entries = entries[1:]
 		}
-		indexEntr := hashIndexEntry{
-			segmentIdx: 0, // resulted segment is the first in the array
-			offset:     offset,
+		if len(entries) > 0 {
+			hashes = append(hashes, bloomHash(key))
+		}
+		for _, entr := range entries {
+			n, err := file.Write(entr.Encode())
+			if err != nil {
+				return err
+			}
+			indexEntr := hashIndexEntry{
+				segmentIdx: 0, // resulted segment is the first in the array
+				offset:     offset,
+				size:       int64(n),
+				version:    entr.seq,
+			}
+			merged[key] = append(merged[key], indexEntr)
+			offset += int64(n)
 		}
-		index[key] = indexEntr
 	}
 
 	err = file.Close()
 	if err != nil {
 		return err
 	}
+	// the filter goes first, so every segment on disk has one
+	filter := filterOf(hashes)
+	if err := writeBloomFilter(segmentFilterPath(filepth), filter); err != nil {
+		return err
+	}
 	err = os.Rename(file.Name(), filepth)
 	if err != nil {
+		os.Remove(segmentFilterPath(filepth))
 		return err
 	}
 
 	db.indexMutex.Lock()
+	for key, position := range db.index {
+		if position.segmentIdx == current {
+			// current segment becomes the second one
+			position.segmentIdx = 1
+			db.index[key] = position
+		} else {
+			positions := merged[key]
+			db.index[key] = positions[len(positions)-1]
+		}
+	}
+	for key, positions := range db.history {
+		kept := merged[key]
+		for _, position := range positions {
+			if position.segmentIdx == current {
+				position.segmentIdx = 1
+				kept = append(kept, position)
+			}
+		}
+		if len(kept) == 0 {
+			delete(db.history, key)
+		} else {
+			db.history[key] = kept
+		}
+	}
 	db.segments = segments
+	filters := db.segmentFilters()
+	db.filters.Store([]*bloomFilter{filter, filters[current]})
+	db.lastMerge = time.Now()
+	db.lastMergeDuration = db.lastMerge.Sub(started)
 	db.indexMutex.Unlock()
 
 	for _, seg := range oldsegments {
@@ -306,10 +696,31 @@ func (db *Db) mergeSegments() error {
 		if err != nil {
 			return err
 		}
+		err = os.Remove(segmentFilterPath(seg))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return db.updateDiskSize()
+}
+
+func (db *Db) updateDiskSize() error {
+	size, err := dirSize(db.dir)
+	if err != nil {
+		return err
 	}
+	db.opts.Quota.add(size - atomic.SwapInt64(&db.diskSize, size))
 	return nil
 }
 
+// Returns the limits of the db and the current size of its directory.
+func (db *Db) Usage() Usage {
+	return Usage{
+		Limits:   db.opts.Limits,
+		DiskSize: atomic.LoadInt64(&db.diskSize),
+	}
+}
+
 // Start write thread. Without it, db will not work
 func (db *Db) Start() {
 	// only one thread should be started
@@ -322,19 +733,34 @@ func (db *Db) Start() {
 			if !ok {
 				return
 			}
-			err := db.putUnsafe(req.key, req.value)
+			var err error
+			if req.compact {
+				err = db.compact()
+			} else {
+				err = db.apply(req)
+			}
 			req.callback <- err
 		}
 	}()
 }
 
 func (db *Db) Put(key, value string) error {
-	callback := make(chan error)
-	req := writeRequest{
-		key:      key,
-		value:    value,
-		callback: callback,
-	}
-	db.writeChan <- req
-	return <-callback
+	return db.Apply(nil, []Write{{Key: key, Value: value}})
+}
+
+func (db *Db) Delete(key string) error {
+	return db.Apply(nil, []Write{{Key: key, Delete: true}})
+}
+
+// Applies the writes at once, if the keys from reads still have the given
+// versions (0 for absent keys). Otherwise returns ErrConflict.
+func (db *Db) Apply(reads map[string]uint64, writes []Write) error {
+	atomic.AddInt32(&db.pending, 1)
+	defer atomic.AddInt32(&db.pending, -1)
+	return sendWrites(db.writeChan, reads, writes)
+}
+
+// Starts an optimistic transaction.
+func (db *Db) Begin() *Txn {
+	return newTxn(db)
 }
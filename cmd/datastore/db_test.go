@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -152,6 +153,101 @@ func TestDb_Merge(t *testing.T) {
 	}
 }
 
+func TestDb_SegmentNamedDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// e.g. the directory of the namespace "team"
+	if err := os.Mkdir(filepath.Join(dir, "segment-team"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	if len(db.segments) != 1 {
+		t.Errorf("Expected 1 segment, got %v", db.segments)
+	}
+}
+
+func TestDb_BloomFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SegmentSize(1024)
+	db.Start()
+	const n = 200
+	for i := 0; i < n; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the lost filter is built again from the segment, the current one gets
+	// it when it's sealed
+	filters, err := filepath.Glob(filepath.Join(dir, "bloom-segment-*"))
+	if err != nil || len(filters) == 0 {
+		t.Fatalf("Expected the filters of the segments, got %v, error %v", filters, err)
+	}
+	if err := os.Remove(filters[0]); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+	for _, path := range db.segments[:len(db.segments)-1] {
+		if _, err := os.Stat(segmentFilterPath(path)); err != nil {
+			t.Errorf("Segment has no filter: %s", err)
+		}
+	}
+	if filters, _ := filepath.Glob(filepath.Join(dir, "bloom-segment-*")); len(filters) != len(db.segments)-1 {
+		t.Errorf("Unexpected filters %v of segments %v", filters, db.segments)
+	}
+
+	for i := 1; i < n; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatalf("Cannot get key%d: %s", i, err)
+		}
+	}
+	if _, err := db.Get("key0"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound of the deleted key, got %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := db.Get(fmt.Sprintf("absent%d", i)); err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound, got %v", err)
+		}
+	}
+	stats, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FilterNegatives+stats.FalsePositives != 1001 || stats.FalsePositiveRate > 0.1 {
+		t.Errorf("Unexpected filter stats %+v", stats)
+	}
+}
+
 func TestDbPar(t *testing.T) {
 	dir, err := ioutil.TempDir("", "test-db")
 	if err != nil {
@@ -214,3 +310,109 @@ func TestDbPar(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_Versions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	// small segments to get through merges
+	db.SegmentSize(64)
+
+	const keys = 10
+	for round := 0; round < 3; round++ {
+		for i := 0; i < keys; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(db *Db) {
+		for i := 0; i < keys; i++ {
+			value, version, err := db.GetVersion(fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", i, err)
+			}
+			if expected := fmt.Sprintf("value%d-2", i); value != expected {
+				t.Errorf("Bad value returned expected %s, got %s", expected, value)
+			}
+			if expected := uint64(2*keys + i + 1); version != expected {
+				t.Errorf("Bad version of key%d: expected %d, got %d", i, expected, version)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	check(db)
+
+	// numbering goes on after the restart
+	if err := db.Put("key0", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, _ := db.GetVersion("key0"); version != 3*keys+1 {
+		t.Errorf("Expected version %d after restart, got %d", 3*keys+1, version)
+	}
+}
+
+func TestDb_SeqAfterMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	if err := db.Put("x", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("x"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// every reopen adds a segment, until they are merged
+	for i := 0; i < 3; i++ {
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("y", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, err := db.GetVersion("y"); err != nil || version != 3 {
+		t.Errorf("Expected version 3, got %d, error %v", version, err)
+	}
+}
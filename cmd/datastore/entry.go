@@ -7,25 +7,38 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 )
 
 type entry struct {
 	key, value string
+	seq        uint64 // sequence number of the write
+	timestamp  int64  // time of the write in unix nanoseconds
+	kind       byte
 }
 
+const (
+	kindValue     = 0
+	kindTombstone = 1 // the key is deleted by this write
+)
+
 const sha1Len = 20
 
-// 4 bytes + 4 bytes + hash
-const headerLen = 8 + sha1Len
+// 4 bytes + 4 bytes + 8 bytes + 8 bytes + 1 byte
+const fixedLen = 25
 
-var ErrHashSumDontMatch = fmt.Errorf("hashsums don't match")
+// fixed fields + hash
+const headerLen = fixedLen + sha1Len
 
-// Entry is serialized as follows:
-// ------------------------------------------------------------
-// | 4 bytes  |  4 bytes   | key_size | value_size | 20 bytes |
-// ------------------------------------------------------------
-// | key_size | value_size |   key    |   value    | sha1sum  |
-// ------------------------------------------------------------
+var ErrHashSumDontMatch = fmt.Errorf("hashsums don't match")
+var ErrBadEntrySize = fmt.Errorf("entry is longer than the data left")
+
+// Entry is serialized as follows, since version 2 of the format:
+// ------------------------------------------------------------------------------------------
+// | 4 bytes  |  4 bytes   | 8 bytes |  8 bytes  | 1 byte | key_size | value_size | 20 bytes |
+// ------------------------------------------------------------------------------------------
+// | key_size | value_size |   seq   | timestamp |  kind  |   key    |   value    | sha1sum  |
+// ------------------------------------------------------------------------------------------
 func (e *entry) Encode() []byte {
 	kl := len(e.key)
 	vl := len(e.value)
@@ -33,8 +46,11 @@ func (e *entry) Encode() []byte {
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res[0:4], uint32(kl))
 	binary.LittleEndian.PutUint32(res[4:8], uint32(vl))
-	copy(res[8:], e.key)
-	copy(res[8+kl:], e.value)
+	binary.LittleEndian.PutUint64(res[8:16], e.seq)
+	binary.LittleEndian.PutUint64(res[16:24], uint64(e.timestamp))
+	res[24] = e.kind
+	copy(res[fixedLen:], e.key)
+	copy(res[fixedLen+kl:], e.value)
 	hashIndex := size - sha1Len
 	hash := sha1.Sum(res[:hashIndex])
 	copy(res[hashIndex:], hash[:])
@@ -44,8 +60,11 @@ func (e *entry) Encode() []byte {
 func (e *entry) Decode(input []byte) error {
 	kl := binary.LittleEndian.Uint32(input[0:4])
 	vl := binary.LittleEndian.Uint32(input[4:8])
+	e.seq = binary.LittleEndian.Uint64(input[8:16])
+	e.timestamp = int64(binary.LittleEndian.Uint64(input[16:24]))
+	e.kind = input[24]
 
-	keyStart := uint32(8)
+	keyStart := uint32(fixedLen)
 	valueStart := keyStart + kl
 	hashStart := valueStart + vl
 
@@ -69,7 +88,13 @@ func (e *entry) Decode(input []byte) error {
 }
 
 func readEntry(in *bufio.Reader) (*entry, error) {
-	var header [8]byte
+	return readEntryMax(in, math.MaxInt64)
+}
+
+// Reads the entry, but fails with ErrBadEntrySize if it would be longer than
+// max bytes, e.g. because of a corrupted size, instead of reading it.
+func readEntryMax(in *bufio.Reader, max int64) (*entry, error) {
+	var header [fixedLen]byte
 	_, err := io.ReadFull(in, header[:])
 	if err != nil {
 		return nil, err
@@ -77,6 +102,9 @@ func readEntry(in *bufio.Reader) (*entry, error) {
 
 	keySize := int(binary.LittleEndian.Uint32(header[0:4]))
 	valueSize := int(binary.LittleEndian.Uint32(header[4:8]))
+	if headerLen+int64(keySize)+int64(valueSize) > max {
+		return nil, ErrBadEntrySize
+	}
 	key := make([]byte, keySize)
 	value := make([]byte, valueSize)
 
@@ -104,13 +132,16 @@ func readEntry(in *bufio.Reader) (*entry, error) {
 	hasher.Write(value)
 	expectedHash := hasher.Sum(nil)
 
-	if !bytes.Equal(hash[:], expectedHash) {
-		return nil, ErrHashSumDontMatch
-	}
-
 	entr := entry{
-		key:   string(key),
-		value: string(value),
+		key:       string(key),
+		value:     string(value),
+		seq:       binary.LittleEndian.Uint64(header[8:16]),
+		timestamp: int64(binary.LittleEndian.Uint64(header[16:24])),
+		kind:      header[24],
+	}
+	if !bytes.Equal(hash[:], expectedHash) {
+		// the entry is returned, so the reader may skip it
+		return &entr, ErrHashSumDontMatch
 	}
 	return &entr, nil
 }
@@ -7,18 +7,30 @@ import (
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
-	e.Decode(e.Encode())
-	if e.key != "key" {
+	e := entry{key: "key", value: "value", seq: 42, timestamp: 1000, kind: kindTombstone}
+	var decoded entry
+	if err := decoded.Decode(e.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.key != "key" {
 		t.Error("incorrect key")
 	}
-	if e.value != "value" {
+	if decoded.value != "value" {
 		t.Error("incorrect value")
 	}
+	if decoded.seq != 42 {
+		t.Error("incorrect seq")
+	}
+	if decoded.timestamp != 1000 {
+		t.Error("incorrect timestamp")
+	}
+	if decoded.kind != kindTombstone {
+		t.Error("incorrect kind")
+	}
 }
 
 func TestReadEntry(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value", seq: 7, timestamp: 1000, kind: kindTombstone}
 	data := e.Encode()
 	entr, err := readEntry(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -30,10 +42,19 @@ func TestReadEntry(t *testing.T) {
 	if entr.value != e.value {
 		t.Errorf("Got bat value [%s]", entr.value)
 	}
+	if entr.seq != e.seq {
+		t.Errorf("Got bat seq [%d]", entr.seq)
+	}
+	if entr.timestamp != e.timestamp {
+		t.Errorf("Got bat timestamp [%d]", entr.timestamp)
+	}
+	if entr.kind != e.kind {
+		t.Errorf("Got bat kind [%d]", entr.kind)
+	}
 }
 
 func TestFailSum(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value", seq: 1, timestamp: 1000}
 	data := e.Encode()
 	data[10] = ^data[10] // let's flip some bits
 	_, err := readEntry(bufio.NewReader(bytes.NewReader(data)))
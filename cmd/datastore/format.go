@@ -0,0 +1,241 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version of the data files, kept in the format file of the data directory.
+// Entries of version 1 have no sequence number, timestamp and kind; the
+// directories without the format file are of it.
+const formatVersion = 2
+
+const formatFile = "format"
+
+// File which marks the data directories written in MVCC mode, so that the
+// offline tools don't drop the history
+const mvccFile = "mvcc"
+
+var ErrUnsupportedFormat = fmt.Errorf("unsupported data format")
+
+// Returns the version of the data in the directory, 0 if it has no data yet.
+func readFormat(dir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, formatFile))
+	if err == nil {
+		version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return 0, fmt.Errorf("%w: bad %s file in %s", ErrUnsupportedFormat, formatFile, dir)
+		}
+		return version, nil
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(name, "segment-") || isLsmFile(name) {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func isLsmFile(name string) bool {
+	return strings.HasSuffix(name, ".sst") || strings.HasPrefix(name, "wal-")
+}
+
+// Fails with ErrUnsupportedFormat unless the data in the directory is of the
+// current version or there is none.
+func checkFormat(dir string) error {
+	version, err := readFormat(dir)
+	if err != nil {
+		return err
+	}
+	if version == 1 {
+		return fmt.Errorf("%w: %s is of version 1, convert it with dbtool migrate", ErrUnsupportedFormat, dir)
+	}
+	if version != 0 && version != formatVersion {
+		return fmt.Errorf("%w: %s is of version %d, %d is supported", ErrUnsupportedFormat, dir, version, formatVersion)
+	}
+	return nil
+}
+
+// Checks the format of the directory, which is opened for writing, and marks
+// it with the current version.
+func initFormat(dir string) error {
+	if err := checkFormat(dir); err != nil {
+		return err
+	}
+	return writeFormat(dir)
+}
+
+func writeFormat(dir string) error {
+	return ioutil.WriteFile(filepath.Join(dir, formatFile), []byte(strconv.Itoa(formatVersion)+"\n"), 0o600)
+}
+
+// Reports whether the db in the directory was last opened in MVCC mode.
+func IsMVCC(dir string) (bool, error) {
+	_, err := os.Stat(filepath.Join(dir, mvccFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func writeMode(dir string, mvcc bool) error {
+	path := filepath.Join(dir, mvccFile)
+	if mvcc {
+		return ioutil.WriteFile(path, nil, 0o600)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Reads the entry of version 1:
+// ------------------------------------------------------------
+// | 4 bytes  |  4 bytes   | key_size | value_size | 20 bytes |
+// ------------------------------------------------------------
+// | key_size | value_size |   key    |   value    | sha1sum  |
+// ------------------------------------------------------------
+func readEntryV1(in *bufio.Reader) (*entry, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return nil, err
+	}
+	key := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	value := make([]byte, binary.LittleEndian.Uint32(header[4:8]))
+	var hash [sha1Len]byte
+	for _, buf := range [][]byte{key, value, hash[:]} {
+		if _, err := io.ReadFull(in, buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	hasher := sha1.New()
+	hasher.Write(header[:])
+	hasher.Write(key)
+	hasher.Write(value)
+	if !bytes.Equal(hash[:], hasher.Sum(nil)) {
+		return nil, ErrHashSumDontMatch
+	}
+	return &entry{key: string(key), value: string(value), kind: kindValue}, nil
+}
+
+// Converts the data directory of version 1 of a stopped Db into the empty dst
+// directory. The writes get sequence numbers in the order they were made and
+// the modification times of their segments as timestamps. Returns the number
+// of the converted entries. The directories of the lsm engine are refused.
+func Migrate(src, dst string) (int, error) {
+	version, err := readFormat(src)
+	if err != nil {
+		return 0, err
+	}
+	if version != 1 {
+		return 0, fmt.Errorf("%w: %s is not of version 1", ErrUnsupportedFormat, src)
+	}
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range files {
+		if isLsmFile(file.Name()) {
+			return 0, fmt.Errorf("%w: %s is of the lsm engine, only the hash one is migrated", ErrUnsupportedFormat, src)
+		}
+	}
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return 0, err
+	}
+	existing, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		return 0, ErrDirNotEmpty
+	}
+
+	// the later segments have the later writes
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	var seq uint64
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		from := filepath.Join(src, file.Name())
+		to := filepath.Join(dst, file.Name())
+		if strings.HasPrefix(file.Name(), "segment-") {
+			if err := migrateSegment(from, to, file.ModTime().UnixNano(), &seq); err != nil {
+				return int(seq), err
+			}
+		} else if err := copyFile(from, to); err != nil {
+			return int(seq), err
+		}
+		// recovery reads the segments in the order of their modification
+		if err := os.Chtimes(to, file.ModTime(), file.ModTime()); err != nil {
+			return int(seq), err
+		}
+	}
+	return int(seq), writeFormat(dst)
+}
+
+func migrateSegment(from, to string, timestamp int64, seq *uint64) error {
+	input, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	in := bufio.NewReaderSize(input, bufSize)
+	out := bufio.NewWriterSize(output, bufSize)
+	var offset int64
+	for err == nil {
+		var e *entry
+		e, err = readEntryV1(in)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			err = fmt.Errorf("%s at offset %d: %w", from, offset, err)
+			break
+		}
+		offset += 8 + int64(len(e.key)) + int64(len(e.value)) + sha1Len
+		*seq++
+		e.seq = *seq
+		e.timestamp = timestamp
+		_, err = out.Write(e.Encode())
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encodeV1(key, value string) []byte {
+	res := make([]byte, 8, 8+len(key)+len(value)+sha1Len)
+	binary.LittleEndian.PutUint32(res[0:4], uint32(len(key)))
+	binary.LittleEndian.PutUint32(res[4:8], uint32(len(value)))
+	res = append(append(res, key...), value...)
+	hash := sha1.Sum(res)
+	return append(res, hash[:]...)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.Mkdir(src, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second segment overwrites a key of the first one
+	modTime := time.Now().Add(-time.Hour)
+	for i, entries := range [][]string{{"a", "1", "b", "2"}, {"a", "3"}} {
+		var data []byte
+		for j := 0; j < len(entries); j += 2 {
+			data = append(data, encodeV1(entries[j], entries[j+1])...)
+		}
+		path := filepath.Join(src, "segment-"+string(rune('0'+i)))
+		if err := ioutil.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewDb(src); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Fatalf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+	if _, err := VerifyDir(src); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	n, err := Migrate(src, dst)
+	if err != nil || n != 3 {
+		t.Fatalf("Migrated %d entries, error %v", n, err)
+	}
+	if _, err := Migrate(dst, filepath.Join(dir, "again")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	// the sstables and the logs are not converted
+	lsm := filepath.Join(dir, "lsm")
+	if err := os.Mkdir(lsm, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(lsm, "wal-000001.log"), encodeV1("a", "1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Migrate(lsm, filepath.Join(dir, "lsm-dst")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	db, err := NewDb(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+	for key, expected := range map[string]string{"a": "3", "b": "2"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Expected %s of %s, got %q, error %v", expected, key, value, err)
+		}
+	}
+	// the new writes go after the migrated ones
+	if err := db.Put("c", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, version, err := db.GetVersion("c"); err != nil || version != 4 {
+		t.Errorf("Expected version 4, got %d, error %v", version, err)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-format")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if version, err := readFormat(dir); err != nil || version != formatVersion {
+		t.Errorf("Expected version %d, got %d, error %v", formatVersion, version, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, formatFile), []byte("3\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync/atomic"
+)
+
+// Largest key or value the entry encoding can hold
+const maxEntryField = math.MaxUint32
+
+var ErrKeyTooLarge = fmt.Errorf("key is too large")
+var ErrValueTooLarge = fmt.Errorf("value is too large")
+var ErrDiskFull = fmt.Errorf("data directory size limit is reached")
+
+// Limits of the stored data, a zero field means no limit.
+type Limits struct {
+	MaxKeySize   int   `json:"maxKeySize"`
+	MaxValueSize int   `json:"maxValueSize"`
+	MaxDiskSize  int64 `json:"maxDiskSize"` // total size of the data directory
+}
+
+// Usage of the store against its limits.
+type Usage struct {
+	Limits   Limits `json:"limits"`
+	DiskSize int64  `json:"diskSize"`
+}
+
+func (l Limits) checkWrites(writes []Write) error {
+	for _, w := range writes {
+		if int64(len(w.Key)) > maxEntryField || l.MaxKeySize > 0 && len(w.Key) > l.MaxKeySize {
+			return ErrKeyTooLarge
+		}
+		if int64(len(w.Value)) > maxEntryField || l.MaxValueSize > 0 && len(w.Value) > l.MaxValueSize {
+			return ErrValueTooLarge
+		}
+	}
+	return nil
+}
+
+// Checks whether size bytes more fit into the directory. Deletes are let
+// through, as they are the way to free the space.
+func (l Limits) checkDisk(used, size int64, writes []Write) error {
+	if l.MaxDiskSize <= 0 || used+size <= l.MaxDiskSize {
+		return nil
+	}
+	for _, w := range writes {
+		if !w.Delete {
+			return ErrDiskFull
+		}
+	}
+	return nil
+}
+
+// DiskQuota limits the total size of the directories of several stores, e.g.
+// the namespaces of a database, on top of their own limits. The writes made
+// at the same moment by different stores may exceed it a little. A nil quota
+// has no limit.
+type DiskQuota struct {
+	max  int64
+	used int64 // updated atomically
+}
+
+func NewDiskQuota(max int64) *DiskQuota {
+	return &DiskQuota{max: max}
+}
+
+// Returns the limit and the total size of the directories.
+func (q *DiskQuota) Usage() Usage {
+	return Usage{
+		Limits:   Limits{MaxDiskSize: q.max},
+		DiskSize: atomic.LoadInt64(&q.used),
+	}
+}
+
+func (q *DiskQuota) add(size int64) {
+	if q != nil {
+		atomic.AddInt64(&q.used, size)
+	}
+}
+
+// Checks whether size bytes more fit into the quota, like Limits.checkDisk.
+func (q *DiskQuota) check(size int64, writes []Write) error {
+	if q == nil {
+		return nil
+	}
+	return Limits{MaxDiskSize: q.max}.checkDisk(atomic.LoadInt64(&q.used), size, writes)
+}
+
+// Returns the total size of the files in the directory.
+func dirSize(dir string) (int64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, file := range files {
+		if !file.IsDir() {
+			size += file.Size()
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,124 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	limits := Limits{MaxKeySize: 8, MaxValueSize: 64, MaxDiskSize: 1024}
+	openers := map[string]storeOpener{
+		"hash": func(dir string) (Store, error) {
+			return NewDbWithOptions(dir, Options{Limits: limits})
+		},
+		"lsm": func(dir string) (Store, error) {
+			db, err := NewLsmDb(dir)
+			if err != nil {
+				return nil, err
+			}
+			return db.Limits(limits), nil
+		},
+	}
+
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-limits")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Start()
+			defer db.Close()
+
+			if err := db.Put("long key", "value"); err != nil {
+				t.Errorf("Cannot put the key of the max size: %s", err)
+			}
+			if err := db.Put("too long key", "value"); err != ErrKeyTooLarge {
+				t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+			}
+			if err := db.Put("key", strings.Repeat("v", 65)); err != ErrValueTooLarge {
+				t.Errorf("Expected ErrValueTooLarge, got %v", err)
+			}
+
+			value := strings.Repeat("v", 64)
+			for i := 0; ; i++ {
+				err := db.Put("key", value)
+				if err == ErrDiskFull {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if i > 1024/64 {
+					t.Fatal("Disk limit is not enforced")
+				}
+			}
+			usage := db.Usage()
+			if usage.Limits != limits || usage.DiskSize > limits.MaxDiskSize {
+				t.Errorf("Unexpected usage %+v", usage)
+			}
+			if err := db.Delete("key"); err != nil {
+				t.Errorf("Cannot delete over the limit: %s", err)
+			}
+		})
+	}
+}
+
+func TestDiskQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-limits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	quota := NewDiskQuota(1024)
+	a, err := NewDbWithOptions(filepath.Join(dir, "a"), Options{Quota: quota})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Start()
+	defer a.Close()
+	b, err := NewLsmDb(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Quota(quota).Start()
+	defer b.Close()
+
+	value := strings.Repeat("v", 64)
+	for i := 0; ; i++ {
+		// the stores share the limit
+		db := Store(a)
+		if i%2 == 1 {
+			db = b
+		}
+		err := db.Put("key", value)
+		if err == ErrDiskFull {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if i > 1024/64 {
+			t.Fatal("Quota is not enforced")
+		}
+	}
+	used := quota.Usage().DiskSize
+	if used > 1024 || used != a.Usage().DiskSize+b.Usage().DiskSize {
+		t.Errorf("Unexpected usage %d of %d and %d", used, a.Usage().DiskSize, b.Usage().DiskSize)
+	}
+	if err := b.Delete("key"); err != nil {
+		t.Errorf("Cannot delete over the quota: %s", err)
+	}
+}
@@ -0,0 +1,725 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMemtableSize = 4 * MB
+
+// Number of level 0 tables which triggers their compaction into level 1
+const l0CompactionTrigger = 4
+
+// Every next level may hold this many times more data than the previous one
+const levelSizeMultiplier = 10
+
+// LsmDb is a log-structured merge-tree storage. Recent writes are kept in
+// the memtable and the write-ahead log, older ones in sstables on disk, so
+// only the sparse indexes and the bloom filters have to fit in memory.
+type LsmDb struct {
+	// bloom filter statistics, updated atomically
+	filterNegatives uint64 // misses answered by the filter
+	falsePositives  uint64 // keys passed by the filter, but absent in the table
+	diskSize        int64  // size of the data directory, updated atomically
+
+	dir          string
+	memtableSize int64
+	limits       Limits
+	quota        *DiskQuota
+
+	mu     sync.RWMutex
+	mem    *memtable
+	levels [][]*sstable // level 0 is sorted by id, other levels by key
+
+	wal      *os.File
+	walFiles []string // logs which hold data of the memtable
+	nextId   uint64
+	seq      uint64 // sequence number of the last write
+
+	started   uint32 // flag whether the writing thread has started
+	closed    uint32 // flag whether the db is closed to prevent double closing of the channel
+	writeChan chan writeRequest
+}
+
+func NewLsmDb(dir string) (*LsmDb, error) {
+	db := &LsmDb{
+		dir:          dir,
+		memtableSize: defaultMemtableSize,
+		mem:          newMemtable(),
+		levels:       [][]*sstable{{}},
+		nextId:       1,
+		writeChan:    make(chan writeRequest),
+	}
+	if err := initFormat(dir); err != nil {
+		return nil, err
+	}
+	err := db.recover()
+	if err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	err = db.openWal()
+	if err == nil {
+		err = db.updateDiskSize()
+	}
+	if err != nil {
+		db.closeTables()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Sets max size of the memtable. Returns *db for the chaining
+func (db *LsmDb) MemtableSize(max int64) *LsmDb {
+	db.memtableSize = max
+	return db
+}
+
+// Sets limits of the stored data. Returns *db for the chaining
+func (db *LsmDb) Limits(limits Limits) *LsmDb {
+	db.limits = limits
+	return db
+}
+
+// Sets the total size limit shared with other stores, before the db is
+// started. Returns *db for the chaining
+func (db *LsmDb) Quota(quota *DiskQuota) *LsmDb {
+	db.quota = quota
+	db.quota.add(atomic.LoadInt64(&db.diskSize))
+	return db
+}
+
+func (db *LsmDb) updateDiskSize() error {
+	size, err := dirSize(db.dir)
+	if err != nil {
+		return err
+	}
+	db.quota.add(size - atomic.SwapInt64(&db.diskSize, size))
+	return nil
+}
+
+// Returns the limits of the db and the current size of its directory.
+func (db *LsmDb) Usage() Usage {
+	return Usage{
+		Limits:   db.limits,
+		DiskSize: atomic.LoadInt64(&db.diskSize),
+	}
+}
+
+func walName(id uint64) string {
+	return fmt.Sprintf("wal-%06d.log", id)
+}
+
+func parseWalName(name string) (id uint64, ok bool) {
+	n, err := fmt.Sscanf(name, "wal-%d.log", &id)
+	return id, err == nil && n == 1
+}
+
+func (db *LsmDb) recover() error {
+	files, err := ioutil.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	var wals []uint64
+	tables := make(map[string]bool)
+	for _, file := range files {
+		name := file.Name()
+		path := filepath.Join(db.dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			// leftover of an interrupted flush or compaction
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		} else if level, id, ok := parseSSTableName(name); ok {
+			t, err := openSSTable(path, level, id)
+			if err != nil {
+				return err
+			}
+			for len(db.levels) <= level {
+				db.levels = append(db.levels, []*sstable{})
+			}
+			db.levels[level] = append(db.levels[level], t)
+			tables[filterPath(path)] = true
+			db.useId(id)
+			if t.maxSeq > db.seq {
+				db.seq = t.maxSeq
+			}
+		} else if id, ok := parseWalName(name); ok {
+			wals = append(wals, id)
+			db.useId(id)
+		}
+	}
+
+	for _, file := range files {
+		path := filepath.Join(db.dir, file.Name())
+		if strings.HasSuffix(path, ".bloom") && !tables[path] {
+			// filter of a table removed by an interrupted compaction
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.sortLevels()
+	sort.Slice(wals, func(i, j int) bool {
+		return wals[i] < wals[j]
+	})
+	for _, id := range wals {
+		path := filepath.Join(db.dir, walName(id))
+		if err := db.replayWal(path); err != nil {
+			return err
+		}
+		db.walFiles = append(db.walFiles, path)
+	}
+	return nil
+}
+
+func (db *LsmDb) useId(id uint64) {
+	if id >= db.nextId {
+		db.nextId = id + 1
+	}
+}
+
+func (db *LsmDb) sortLevels() {
+	sort.Slice(db.levels[0], func(i, j int) bool {
+		return db.levels[0][i].id < db.levels[0][j].id
+	})
+	for _, tables := range db.levels[1:] {
+		tables := tables
+		sort.Slice(tables, func(i, j int) bool {
+			return tables[i].firstKey < tables[j].firstKey
+		})
+	}
+}
+
+// Restores the memtable from the log.
+func (db *LsmDb) replayWal(path string) error {
+	input, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	in := bufio.NewReaderSize(input, bufSize)
+	for {
+		e, err := readEntry(in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the last record may be cut by a crash in the middle of the write
+			return nil
+		} else if err != nil {
+			return err
+		}
+		db.mem.put(e)
+		if e.seq > db.seq {
+			db.seq = e.seq
+		}
+	}
+}
+
+func (db *LsmDb) openWal() error {
+	path := filepath.Join(db.dir, walName(db.nextId))
+	db.nextId++
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	db.wal = file
+	db.walFiles = append(db.walFiles, path)
+	return nil
+}
+
+func (db *LsmDb) Close() error {
+	if !atomic.CompareAndSwapUint32(&db.closed, 0, CLOSED) {
+		return nil
+	}
+	close(db.writeChan)
+	db.quota.add(-atomic.LoadInt64(&db.diskSize))
+	err := db.wal.Close()
+	if cerr := db.closeTables(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (db *LsmDb) closeTables() error {
+	var err error
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			if cerr := t.close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (db *LsmDb) Get(key string) (string, error) {
+	value, _, err := db.GetVersion(key)
+	return value, err
+}
+
+// Returns the value with its version, the sequence number of the write.
+func (db *LsmDb) GetVersion(key string) (string, uint64, error) {
+	e, err := db.find(key)
+	if err != nil {
+		return "", 0, err
+	}
+	if e.kind == kindTombstone {
+		return "", 0, ErrNotFound
+	}
+	return e.value, e.seq, nil
+}
+
+// Returns the latest entry of the key, which may be a tombstone.
+func (db *LsmDb) find(key string) (*entry, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if e, ok := db.mem.get(key); ok {
+		return e, nil
+	}
+
+	// level 0 tables may overlap, so the newest one wins
+	l0 := db.levels[0]
+	for i := len(l0) - 1; i >= 0; i-- {
+		e, err := db.probe(l0[i], key)
+		if err != ErrNotFound {
+			return e, err
+		}
+	}
+
+	for _, tables := range db.levels[1:] {
+		i := sort.Search(len(tables), func(i int) bool {
+			return tables[i].lastKey >= key
+		})
+		if i < len(tables) && tables[i].firstKey <= key {
+			e, err := db.probe(tables[i], key)
+			if err != ErrNotFound {
+				return e, err
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Looks the key up in the table, consulting its bloom filter first, so most
+// of the misses don't touch the disk.
+func (db *LsmDb) probe(t *sstable, key string) (*entry, error) {
+	if !t.inRange(key) {
+		return nil, ErrNotFound
+	}
+	if !t.filter.mayContain(key) {
+		atomic.AddUint64(&db.filterNegatives, 1)
+		return nil, ErrNotFound
+	}
+	e, err := t.get(key)
+	if err == ErrNotFound {
+		atomic.AddUint64(&db.falsePositives, 1)
+	}
+	return e, err
+}
+
+type LsmStats struct {
+	// Lookups of absent keys rejected by the bloom filters
+	FilterNegatives uint64 `json:"filterNegatives"`
+	// Lookups passed by the bloom filters, but not found in the table
+	FalsePositives uint64 `json:"falsePositives"`
+	// Share of the absent keys which were not rejected by the bloom filters
+	FalsePositiveRate float64 `json:"falsePositiveRate"`
+}
+
+func (db *LsmDb) Stats() LsmStats {
+	stats := LsmStats{
+		FilterNegatives: atomic.LoadUint64(&db.filterNegatives),
+		FalsePositives:  atomic.LoadUint64(&db.falsePositives),
+	}
+	if total := stats.FilterNegatives + stats.FalsePositives; total > 0 {
+		stats.FalsePositiveRate = float64(stats.FalsePositives) / float64(total)
+	}
+	return stats
+}
+
+// Applies the writes of the request, called by the writing thread only.
+func (db *LsmDb) apply(req writeRequest) error {
+	err := checkReads(req.reads, func(key string) (uint64, error) {
+		_, version, err := db.GetVersion(key)
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return version, err
+	})
+	if err != nil || len(req.writes) == 0 {
+		return err
+	}
+	if err := db.limits.checkWrites(req.writes); err != nil {
+		return err
+	}
+
+	timestamp := time.Now().UnixNano()
+	entries := make([]*entry, len(req.writes))
+	var data []byte
+	for i, w := range req.writes {
+		entries[i] = &entry{
+			key:       w.Key,
+			value:     w.Value,
+			seq:       db.seq + uint64(i) + 1,
+			timestamp: timestamp,
+		}
+		if w.Delete {
+			entries[i].value = ""
+			entries[i].kind = kindTombstone
+		}
+		data = append(data, entries[i].Encode()...)
+	}
+	err = db.limits.checkDisk(atomic.LoadInt64(&db.diskSize), int64(len(data)), req.writes)
+	if err == nil {
+		err = db.quota.check(int64(len(data)), req.writes)
+	}
+	if err != nil {
+		return err
+	}
+	// single write, so all the changes get to the log together
+	n, err := db.wal.Write(data)
+	atomic.AddInt64(&db.diskSize, int64(n))
+	db.quota.add(int64(n))
+	if err != nil {
+		return err
+	}
+	db.seq += uint64(len(entries))
+
+	db.mu.Lock()
+	for _, e := range entries {
+		db.mem.put(e)
+	}
+	db.mu.Unlock()
+
+	if db.mem.size >= db.memtableSize {
+		return db.flush()
+	}
+	return nil
+}
+
+// Writes the memtable into a new level 0 table and starts a new log.
+func (db *LsmDb) flush() error {
+	w, err := newSSTableWriter(db.dir, 0, db.nextId)
+	if err != nil {
+		return err
+	}
+	db.nextId++
+	for _, key := range db.mem.sortedKeys() {
+		if err := w.add(db.mem.data[key]); err != nil {
+			return w.abort(err)
+		}
+	}
+	t, err := w.finish()
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	db.levels[0] = append(db.levels[0], t)
+	db.mem = newMemtable()
+	db.mu.Unlock()
+
+	// data of the old logs is in the table now
+	if err := db.wal.Close(); err != nil {
+		return err
+	}
+	oldWals := db.walFiles
+	db.walFiles = nil
+	if err := db.openWal(); err != nil {
+		return err
+	}
+	for _, path := range oldWals {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := db.compact(); err != nil {
+		return err
+	}
+	return db.updateDiskSize()
+}
+
+// Max size of the level in bytes
+func (db *LsmDb) maxLevelSize(level int) int64 {
+	size := db.memtableSize * l0CompactionTrigger
+	for i := 1; i < level; i++ {
+		size *= levelSizeMultiplier
+	}
+	return size
+}
+
+func levelSize(tables []*sstable) int64 {
+	var size int64
+	for _, t := range tables {
+		size += t.size
+	}
+	return size
+}
+
+// Compacts levels until all of them fit into their limits.
+func (db *LsmDb) compact() error {
+	for {
+		level := -1
+		if len(db.levels[0]) >= l0CompactionTrigger {
+			level = 0
+		} else {
+			for i := 1; i < len(db.levels); i++ {
+				if levelSize(db.levels[i]) > db.maxLevelSize(i) {
+					level = i
+					break
+				}
+			}
+		}
+		if level < 0 {
+			return nil
+		}
+		if err := db.compactLevel(level); err != nil {
+			return err
+		}
+	}
+}
+
+// Merges tables of the level with the overlapping tables of the next one.
+// Whole level 0 is merged at once, as its tables overlap each other; from
+// other levels the oldest table is taken.
+func (db *LsmDb) compactLevel(level int) error {
+	var inputs []*sstable
+	if level == 0 {
+		// newest tables go first, so their values win
+		for i := len(db.levels[0]) - 1; i >= 0; i-- {
+			inputs = append(inputs, db.levels[0][i])
+		}
+	} else {
+		oldest := db.levels[level][0]
+		for _, t := range db.levels[level] {
+			if t.id < oldest.id {
+				oldest = t
+			}
+		}
+		inputs = append(inputs, oldest)
+	}
+
+	from, to := inputs[0].firstKey, inputs[0].lastKey
+	for _, t := range inputs {
+		if t.firstKey < from {
+			from = t.firstKey
+		}
+		if t.lastKey > to {
+			to = t.lastKey
+		}
+	}
+	if level+1 == len(db.levels) {
+		db.mu.Lock()
+		db.levels = append(db.levels, []*sstable{})
+		db.mu.Unlock()
+	}
+	for _, t := range db.levels[level+1] {
+		if t.overlaps(from, to) {
+			inputs = append(inputs, t)
+		}
+	}
+
+	// older versions of the keys can only be in the deeper levels
+	bottom := true
+	for _, tables := range db.levels[level+2:] {
+		if len(tables) > 0 {
+			bottom = false
+		}
+	}
+
+	outputs, err := db.mergeTables(level+1, inputs, bottom)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[*sstable]bool)
+	for _, t := range inputs {
+		removed[t] = true
+	}
+	db.mu.Lock()
+	for _, l := range []int{level, level + 1} {
+		var tables []*sstable
+		for _, t := range db.levels[l] {
+			if !removed[t] {
+				tables = append(tables, t)
+			}
+		}
+		db.levels[l] = tables
+	}
+	db.levels[level+1] = append(db.levels[level+1], outputs...)
+	db.sortLevels()
+	db.mu.Unlock()
+
+	for _, t := range inputs {
+		if err := t.remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes merged content of the inputs into new tables of the level. Inputs
+// are ordered from the newest to the oldest. Tombstones are dropped when
+// there is nothing older left for them to hide.
+func (db *LsmDb) mergeTables(level int, inputs []*sstable, dropTombstones bool) ([]*sstable, error) {
+	iterators := make([]*sstableIterator, len(inputs))
+	for i, t := range inputs {
+		iterators[i] = t.iterator()
+	}
+	it, err := newMergeIterator(iterators)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []*sstable
+	var w *sstableWriter
+	fail := func(err error) ([]*sstable, error) {
+		if w != nil {
+			w.abort(err)
+		}
+		for _, t := range outputs {
+			t.remove()
+		}
+		return nil, err
+	}
+
+	for {
+		e, err := it.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		if dropTombstones && e.kind == kindTombstone {
+			continue
+		}
+		if w == nil {
+			w, err = newSSTableWriter(db.dir, level, db.nextId)
+			if err != nil {
+				return fail(err)
+			}
+			db.nextId++
+		}
+		if err := w.add(e); err != nil {
+			return fail(err)
+		}
+		if w.size() >= db.memtableSize {
+			t, err := w.finish()
+			w = nil
+			if err != nil {
+				return fail(err)
+			}
+			outputs = append(outputs, t)
+		}
+	}
+	if w != nil {
+		t, err := w.finish()
+		w = nil
+		if err != nil {
+			return fail(err)
+		}
+		outputs = append(outputs, t)
+	}
+	return outputs, nil
+}
+
+// Merges sorted iterators. When several of them hold the same key, the entry
+// of the first one is taken.
+type mergeIterator struct {
+	inputs []*sstableIterator
+	heads  []*entry
+}
+
+func newMergeIterator(inputs []*sstableIterator) (*mergeIterator, error) {
+	it := &mergeIterator{
+		inputs: inputs,
+		heads:  make([]*entry, len(inputs)),
+	}
+	for i := range inputs {
+		if err := it.advance(i); err != nil {
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+func (it *mergeIterator) advance(i int) error {
+	e, err := it.inputs[i].next()
+	if err == io.EOF {
+		it.heads[i] = nil
+		return nil
+	} else if err != nil {
+		return err
+	}
+	it.heads[i] = e
+	return nil
+}
+
+func (it *mergeIterator) next() (*entry, error) {
+	var res *entry
+	for _, head := range it.heads {
+		if head != nil && (res == nil || head.key < res.key) {
+			res = head
+		}
+	}
+	if res == nil {
+		return nil, io.EOF
+	}
+	for i, head := range it.heads {
+		if head != nil && head.key == res.key {
+			if err := it.advance(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// Start write thread. Without it, db will not work
+func (db *LsmDb) Start() {
+	// only one thread should be started
+	if !atomic.CompareAndSwapUint32(&db.started, 0, STARTED) {
+		return
+	}
+	go func() {
+		for {
+			req, ok := <-db.writeChan
+			if !ok {
+				return
+			}
+			err := db.apply(req)
+			req.callback <- err
+		}
+	}()
+}
+
+func (db *LsmDb) Put(key, value string) error {
+	return db.Apply(nil, []Write{{Key: key, Value: value}})
+}
+
+func (db *LsmDb) Delete(key string) error {
+	return db.Apply(nil, []Write{{Key: key, Delete: true}})
+}
+
+// Applies the writes at once, if the keys from reads still have the given
+// versions (0 for absent keys). Otherwise returns ErrConflict.
+func (db *LsmDb) Apply(reads map[string]uint64, writes []Write) error {
+	return sendWrites(db.writeChan, reads, writes)
+}
+
+// Starts an optimistic transaction.
+func (db *LsmDb) Begin() *Txn {
+	return newTxn(db)
+}
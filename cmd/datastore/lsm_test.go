@@ -0,0 +1,254 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLsmDb_Put(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	pairs := [][]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
+		{"key3", "value3"},
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		for _, pair := range pairs {
+			err := db.Put(pair[0], pair[1])
+			if err != nil {
+				t.Errorf("Cannot put %s: %s", pair[0], err)
+			}
+			value, err := db.Get(pair[0])
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", pair[0], err)
+			}
+			if value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s", pair[1], value)
+			}
+		}
+		if _, err := db.Get("missing"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, but got %v", err)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewLsmDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Start()
+
+		for _, pair := range pairs {
+			value, err := db.Get(pair[0])
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", pair[0], err)
+			}
+			if value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s", pair[1], value)
+			}
+		}
+	})
+}
+
+func TestLsmDb_Compaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MemtableSize(256)
+	db.Start()
+	defer db.Close()
+
+	// every key is overwritten several times, so compaction has to keep the newest values
+	const keys = 100
+	for round := 0; round < 5; round++ {
+		for i := 0; i < keys; i++ {
+			err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, round))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if len(db.levels[0]) >= l0CompactionTrigger {
+		t.Errorf("Level 0 was not compacted: %d tables", len(db.levels[0]))
+	}
+	if len(db.levels) < 2 || len(db.levels[1]) == 0 {
+		t.Fatalf("Expected tables on level 1")
+	}
+	for l, tables := range db.levels[1:] {
+		for i := 1; i < len(tables); i++ {
+			if tables[i-1].lastKey >= tables[i].firstKey {
+				t.Errorf("Tables of level %d overlap", l+1)
+			}
+		}
+	}
+
+	check := func(db *LsmDb) {
+		for i := 0; i < keys; i++ {
+			value, err := db.Get(fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", i, err)
+			}
+			if expected := fmt.Sprintf("value%d-4", i); value != expected {
+				t.Errorf("Bad value returned expected %s, got %s", expected, value)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	check(db)
+}
+
+func TestLsmDbPar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MemtableSize(512)
+	db.Start()
+	defer db.Close()
+
+	done := make(chan struct{})
+	for i := 0; i < 255; i++ {
+		i := i
+		go func() {
+			key := fmt.Sprintf("key%d", i)
+			if err := db.Put(key, key); err != nil {
+				t.Errorf("Cannot put %s: %s", key, err)
+			}
+			if value, err := db.Get(key); err != nil || value != key {
+				t.Errorf("Cannot get %s: %v %s", key, err, value)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 255; i++ {
+		<-done
+	}
+}
+
+func TestLsmDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MemtableSize(KB)
+	db.Start()
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put(fmt.Sprintf("key%03d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// keys inside of the table ranges, but absent in them
+	const misses = 1000
+	for i := 0; i < misses; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%03d-missing", i%100)); err != ErrNotFound {
+			t.Fatalf("Expected ErrNotFound, but got %v", err)
+		}
+	}
+
+	stats := db.Stats()
+	if stats.FilterNegatives == 0 {
+		t.Errorf("Expected misses to be answered by the filters, got %+v", stats)
+	}
+	if stats.FalsePositiveRate > 0.05 {
+		t.Errorf("False positive rate is too high: %+v", stats)
+	}
+}
+
+func TestLsmDb_Versions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-lsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MemtableSize(256)
+	db.Start()
+	defer db.Close()
+
+	const keys = 20
+	for round := 0; round < 3; round++ {
+		for i := 0; i < keys; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	check := func(db *LsmDb) {
+		for i := 0; i < keys; i++ {
+			_, version, err := db.GetVersion(fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatalf("Cannot get key%d: %s", i, err)
+			}
+			if expected := uint64(2*keys + i + 1); version != expected {
+				t.Errorf("Bad version of key%d: expected %d, got %d", i, expected, version)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewLsmDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	check(db)
+	if db.seq != 3*keys {
+		t.Errorf("Expected last sequence number %d after restart, got %d", 3*keys, db.seq)
+	}
+}
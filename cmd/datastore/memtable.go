@@ -0,0 +1,40 @@
+package datastore
+
+import "sort"
+
+// In-memory table of the latest writes. It is flushed to an sstable once it
+// grows over the configured size.
+type memtable struct {
+	data map[string]*entry
+	size int64 // approximate size of the data when it is encoded
+}
+
+func newMemtable() *memtable {
+	return &memtable{
+		data: make(map[string]*entry),
+	}
+}
+
+func (m *memtable) put(e *entry) {
+	if old, ok := m.data[e.key]; ok {
+		m.size -= int64(len(old.value))
+	} else {
+		m.size += headerLen + int64(len(e.key))
+	}
+	m.size += int64(len(e.value))
+	m.data[e.key] = e
+}
+
+func (m *memtable) get(key string) (*entry, bool) {
+	e, ok := m.data[key]
+	return e, ok
+}
+
+func (m *memtable) sortedKeys() []string {
+	keys := make([]string, 0, len(m.data))
+	for key := range m.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,122 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+var ErrVersioningDisabled = fmt.Errorf("versioning is disabled")
+
+type Version struct {
+	Value     string    `json:"value"`
+	Version   uint64    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Deleted   bool      `json:"deleted,omitempty"`
+}
+
+// Returns the value of the key as of the version, i.e. the latest write of the
+// key with sequence number not greater than the version. Works in MVCC mode
+// only.
+func (db *Db) GetAt(key string, version uint64) (string, uint64, error) {
+	if !db.opts.MVCC {
+		return "", 0, ErrVersioningDisabled
+	}
+	e, err := db.read(func() (hashIndexEntry, bool) {
+		positions := db.history[key]
+		i := sort.Search(len(positions), func(i int) bool {
+			return positions[i].version > version
+		})
+		if i == 0 {
+			return hashIndexEntry{}, false
+		}
+		return positions[i-1], true
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	if e.kind == kindTombstone {
+		// the key was deleted as of the version
+		return "", 0, ErrNotFound
+	}
+	return e.value, e.seq, nil
+}
+
+// Returns up to limit of the latest versions of the key, newest first. Limit
+// of zero returns all the kept versions. Works in MVCC mode only.
+func (db *Db) History(key string, limit int) ([]Version, error) {
+	if !db.opts.MVCC {
+		return nil, ErrVersioningDisabled
+	}
+	res, err := db.readHistory(key, limit)
+	if os.IsNotExist(err) {
+		// segment was merged meanwhile, so the history points to the new one
+		res, err = db.readHistory(key, limit)
+	}
+	return res, err
+}
+
+func (db *Db) readHistory(key string, limit int) ([]Version, error) {
+	type location struct {
+		segName string
+		offset  int64
+	}
+	db.indexMutex.Lock()
+	positions := db.history[key]
+	var locations []location
+	for i := len(positions) - 1; i >= 0 && (limit <= 0 || len(locations) < limit); i-- {
+		locations = append(locations, location{
+			segName: db.segments[positions[i].segmentIdx],
+			offset:  positions[i].offset,
+		})
+	}
+	db.indexMutex.Unlock()
+	if len(locations) == 0 {
+		return nil, ErrNotFound
+	}
+
+	res := make([]Version, 0, len(locations))
+	for _, l := range locations {
+		e, err := readEntryAt(l.segName, l.offset)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Version{
+			Value:     e.value,
+			Version:   e.seq,
+			Timestamp: time.Unix(0, e.timestamp),
+			Deleted:   e.kind == kindTombstone,
+		})
+	}
+	return res, nil
+}
+
+// Selects versions of a key which are kept by the merge. Newer is the number
+// of versions of the key in the current segment, which is not merged.
+func (db *Db) retainVersions(entries []*entry, newer int) []*entry {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	now := db.now().UnixNano()
+	var kept []*entry
+	for i, e := range entries {
+		// 0 for the latest version of the key
+		rank := len(entries) - 1 - i + newer
+		if rank > 0 && db.opts.KeepVersions > 0 && rank >= db.opts.KeepVersions {
+			continue
+		}
+		if rank > 0 && db.opts.KeepFor > 0 {
+			// version in the current segment is treated as a recent one
+			overwritten := now
+			if i+1 < len(entries) {
+				overwritten = entries[i+1].timestamp
+			}
+			if time.Duration(now-overwritten) > db.opts.KeepFor {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
@@ -0,0 +1,215 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_MVCC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, Options{MVCC: true, KeepVersions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	for i := 1; i <= 5; i++ {
+		if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("other", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("get at", func(t *testing.T) {
+		// key gets odd sequence numbers
+		value, version, err := db.GetAt("key", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != "value2" || version != 3 {
+			t.Errorf("Unexpected value %s of version %d", value, version)
+		}
+		if _, _, err := db.GetAt("missing", 4); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, but got %v", err)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		versions, err := db.History("key", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 2 || versions[0].Value != "value5" || versions[1].Value != "value4" {
+			t.Errorf("Unexpected history %+v", versions)
+		}
+		if versions[0].Version != 9 || versions[0].Timestamp.IsZero() {
+			t.Errorf("Unexpected version %+v", versions[0])
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		db.SegmentSize(64)
+		// every write seals the segment, so versions get merged
+		for i := 6; i <= 8; i++ {
+			if err := db.Put("key", fmt.Sprintf("value%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		versions, err := db.History("key", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 3 || versions[0].Value != "value8" || versions[2].Value != "value6" {
+			t.Errorf("Unexpected history %+v", versions)
+		}
+		if _, _, err := db.GetAt("key", 3); err != ErrNotFound {
+			t.Errorf("Expected merged version to be removed, but got %v", err)
+		}
+		if value, err := db.Get("other"); err != nil || value != "value" {
+			t.Errorf("Cannot get other after merge: %v %s", err, value)
+		}
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions(dir, Options{MVCC: true, KeepVersions: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Start()
+
+		versions, err := db.History("key", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 3 || versions[0].Value != "value8" {
+			t.Errorf("Unexpected history %+v", versions)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		_, before, err := db.GetVersion("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		versions, err := db.History("key", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != 4 || !versions[0].Deleted || versions[1].Value != "value8" {
+			t.Errorf("Unexpected history %+v", versions)
+		}
+		if _, _, err := db.GetAt("key", versions[0].Version); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound, but got %v", err)
+		}
+		if value, _, err := db.GetAt("key", before); err != nil || value != "value8" {
+			t.Errorf("Cannot get the version before the delete: %v %s", err, value)
+		}
+	})
+}
+
+func TestDb_MVCCKeepFor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDbWithOptions(dir, Options{MVCC: true, KeepFor: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	db.now = func() time.Time {
+		return now
+	}
+	db.Start()
+	defer db.Close()
+
+	put := func(value string) {
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("old")
+	now = now.Add(time.Minute)
+	put("recent")
+	now = now.Add(2 * time.Hour)
+	put("latest")
+	now = now.Add(30 * time.Minute)
+
+	// every write seals the segment, so the second one triggers the merge
+	db.SegmentSize(1)
+	put("current")
+	put("current")
+
+	versions, err := db.History("key", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, v := range versions {
+		values = append(values, v.Value)
+	}
+	// "old" was overwritten more than an hour ago, "recent" just 30 minutes ago
+	if fmt.Sprint(values) != "[current current latest recent]" {
+		t.Errorf("Unexpected history %v", values)
+	}
+}
+
+func TestDb_MVCCDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	if _, _, err := db.GetAt("key", 1); err != ErrVersioningDisabled {
+		t.Errorf("Expected ErrVersioningDisabled, but got %v", err)
+	}
+	if _, err := db.History("key", 1); err != ErrVersioningDisabled {
+		t.Errorf("Expected ErrVersioningDisabled, but got %v", err)
+	}
+}
+
+func TestIsMVCC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, mvcc := range []bool{true, false} {
+		db, err := NewDbWithOptions(dir, Options{MVCC: mvcc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if marked, err := IsMVCC(dir); err != nil || marked != mvcc {
+			t.Errorf("Expected MVCC %t, got %t, error %v", mvcc, marked, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Functions below work with the data directory of a stopped Db.
+
+var ErrDirNotEmpty = fmt.Errorf("directory is not empty")
+
+// Reads the directory without starting a new segment, so nothing is written
+// to it. Returned db may only be read from.
+func openReadOnly(dir string) (*Db, error) {
+	if err := checkFormat(dir); err != nil {
+		return nil, err
+	}
+	db := &Db{
+		dir:       dir,
+		index:     make(hashIndex),
+		history:   make(map[string][]hashIndexEntry),
+		secondary: make(map[string]*secondaryIndex),
+		watchers:  make(map[*Watcher]struct{}),
+	}
+	if err := db.recover(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Passes the live keys with their values to fn in the order of the keys.
+func Dump(dir string, fn func(key, value string) error) error {
+	db, err := openReadOnly(dir)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func segmentFiles(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []os.FileInfo
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), "segment-") && file.Mode().IsRegular() {
+			res = append(res, file)
+		}
+	}
+	return res, nil
+}
+
+// Checks the checksums of all the entries in every segment of the directory.
+func VerifyDir(dir string) ([]SegmentCheck, error) {
+	if err := checkFormat(dir); err != nil {
+		return nil, err
+	}
+	files, err := segmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]SegmentCheck, 0, len(files))
+	for _, file := range files {
+		check, err := checkSegment(filepath.Join(dir, file.Name()), file.Size())
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// Copies the data directory into the empty dst directory, leaving out the
+// entries with bad checksums and everything after an entry with a broken
+// size. Returns the checks of the source segments.
+func Repair(src, dst string) ([]SegmentCheck, error) {
+	if err := checkFormat(src); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return nil, err
+	}
+	existing, err := ioutil.ReadDir(dst)
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, ErrDirNotEmpty
+	}
+
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return nil, err
+	}
+	var checks []SegmentCheck
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		from := filepath.Join(src, file.Name())
+		to := filepath.Join(dst, file.Name())
+		if strings.HasPrefix(file.Name(), "segment-") {
+			check, err := repairSegment(from, to, file.Size())
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, check)
+		} else if err := copyFile(from, to); err != nil {
+			return nil, err
+		}
+		// recovery reads the segments in the order of their modification
+		if err := os.Chtimes(to, file.ModTime(), file.ModTime()); err != nil {
+			return nil, err
+		}
+	}
+	return checks, nil
+}
+
+func repairSegment(from, to string, size int64) (SegmentCheck, error) {
+	output, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return SegmentCheck{}, err
+	}
+	out := bufio.NewWriterSize(output, bufSize)
+	check, err := scanSegment(from, size, func(e *entry) error {
+		_, err := out.Write(e.Encode())
+		return err
+	})
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return check, err
+}
+
+func copyFile(from, to string) error {
+	input, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, input)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
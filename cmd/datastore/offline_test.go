@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOffline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	for i := 0; i < 4; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dump := func(dir string) string {
+		res := ""
+		err := Dump(dir, func(key, value string) error {
+			res += key + "=" + value + " "
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	if res := dump(dir); res != "key0=value0 key1=value1 key2=value2 " {
+		t.Errorf("Unexpected dump %q", res)
+	}
+
+	files, err := segmentFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, files[0].Name())
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt the value of the first entry and cut the last one
+	data[headerLen] ^= 0xff
+	if err := ioutil.WriteFile(path, data[:len(data)-1], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	checks, err := VerifyDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 1 || len(checks[0].Corrupt) != 1 || checks[0].Error != ErrBadEntrySize.Error() {
+		t.Errorf("Unexpected checks %+v", checks)
+	}
+
+	repaired := filepath.Join(dir, "repaired")
+	if _, err := Repair(dir, repaired); err != nil {
+		t.Fatal(err)
+	}
+	// tombstone of key3 is cut
+	if res := dump(repaired); res != "key1=value1 key2=value2 key3=value3 " {
+		t.Errorf("Unexpected dump after repair %q", res)
+	}
+	checks, err = VerifyDir(repaired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checks) != 1 || !checks[0].OK() || checks[0].Entries != 3 {
+		t.Errorf("Unexpected checks after repair %+v", checks)
+	}
+	if _, err := Repair(dir, repaired); err != ErrDirNotEmpty {
+		t.Errorf("Expected ErrDirNotEmpty, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package datastore
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// Returns up to limit keys greater than after in ascending order, all of them
+// if limit is 0. Only limit keys are kept while the index is read, so a page
+// costs O(n log limit) and no copy of the index.
+func (db *Db) Scan(after string, limit int) ([]string, error) {
+	keys := &maxHeap{}
+	db.indexMutex.Lock()
+	for key := range db.index {
+		if key <= after {
+			continue
+		}
+		if limit <= 0 {
+			*keys = append(*keys, key)
+		} else if keys.Len() < limit {
+			heap.Push(keys, key)
+		} else if key < (*keys)[0] {
+			(*keys)[0] = key
+			heap.Fix(keys, 0)
+		}
+	}
+	db.indexMutex.Unlock()
+
+	res := []string(*keys)
+	if res == nil {
+		res = []string{}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Heap of strings with the greatest one on top.
+type maxHeap []string
+
+func (h maxHeap) Len() int            { return len(h) }
+func (h maxHeap) Less(i, j int) bool  { return h[i] > h[j] }
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,93 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	for _, key := range []string{"c", "a", "d", "b"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("d"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		after string
+		limit int
+		keys  []string
+	}{
+		{"", 0, []string{"a", "b", "c"}},
+		{"", 2, []string{"a", "b"}},
+		{"b", 2, []string{"c"}},
+		{"c", 0, []string{}},
+	} {
+		keys, err := db.Scan(tc.after, tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, tc.keys) {
+			t.Errorf("Scan(%q, %d): expected %v, got %v", tc.after, tc.limit, tc.keys, keys)
+		}
+	}
+}
+
+func TestDb_ScanPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	var expected []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%02d", (i*37)%100)
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, fmt.Sprintf("key%02d", i))
+	}
+
+	var keys []string
+	after := ""
+	for {
+		page, err := db.Scan(after, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		keys = append(keys, page...)
+		after = page[len(page)-1]
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
@@ -0,0 +1,307 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// File in the data directory with definitions of the secondary indexes
+const indexesFile = "indexes.json"
+
+var ErrIndexNotFound = fmt.Errorf("index does not exist")
+var ErrIndexExists = fmt.Errorf("index already exists")
+var ErrBadJSONPath = fmt.Errorf("bad json path")
+
+type IndexDef struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Secondary index maps values found by the JSON path in the stored documents
+// to the keys of these documents. Values which are not JSON documents or don't
+// have a scalar at the path are not indexed.
+type secondaryIndex struct {
+	def   IndexDef
+	steps []pathStep
+
+	keys   map[string]map[string]struct{} // indexed value -> primary keys
+	values map[string]string              // primary key -> indexed value
+}
+
+type pathStep struct {
+	field string
+	index int // used when the field is empty
+}
+
+// Parses a path like $.owner.name or $.tags[0].
+func parseJSONPath(path string) ([]pathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, ErrBadJSONPath
+	}
+	var steps []pathStep
+	rest := path[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			field := rest[1 : end+1]
+			if field == "" {
+				return nil, ErrBadJSONPath
+			}
+			steps = append(steps, pathStep{field: field})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, ErrBadJSONPath
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, ErrBadJSONPath
+			}
+			steps = append(steps, pathStep{index: index})
+			rest = rest[end+1:]
+		default:
+			return nil, ErrBadJSONPath
+		}
+	}
+	if len(steps) == 0 {
+		return nil, ErrBadJSONPath
+	}
+	return steps, nil
+}
+
+func newSecondaryIndex(def IndexDef) (*secondaryIndex, error) {
+	steps, err := parseJSONPath(def.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &secondaryIndex{
+		def:    def,
+		steps:  steps,
+		keys:   make(map[string]map[string]struct{}),
+		values: make(map[string]string),
+	}, nil
+}
+
+// Returns the value at the index path, strings as they are, numbers and
+// booleans in their JSON form.
+func (idx *secondaryIndex) extract(document string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(document))
+	decoder.UseNumber()
+	var node interface{}
+	if err := decoder.Decode(&node); err != nil {
+		return "", false
+	}
+	for _, step := range idx.steps {
+		if step.field != "" {
+			object, ok := node.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			node = object[step.field]
+		} else {
+			array, ok := node.([]interface{})
+			if !ok || step.index >= len(array) {
+				return "", false
+			}
+			node = array[step.index]
+		}
+	}
+	switch v := node.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+func (idx *secondaryIndex) update(key, document string) {
+	value, ok := idx.extract(document)
+	if old, indexed := idx.values[key]; indexed && ok && old == value {
+		return
+	}
+	idx.remove(key)
+	if !ok {
+		return
+	}
+	set := idx.keys[value]
+	if set == nil {
+		set = make(map[string]struct{})
+		idx.keys[value] = set
+	}
+	set[key] = struct{}{}
+	idx.values[key] = value
+}
+
+func (idx *secondaryIndex) remove(key string) {
+	old, indexed := idx.values[key]
+	if !indexed {
+		return
+	}
+	delete(idx.keys[old], key)
+	if len(idx.keys[old]) == 0 {
+		delete(idx.keys, old)
+	}
+	delete(idx.values, key)
+}
+
+func (idx *secondaryIndex) find(value string) []string {
+	res := make([]string, 0, len(idx.keys[value]))
+	for key := range idx.keys[value] {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (db *Db) loadIndexDefs() error {
+	data, err := ioutil.ReadFile(filepath.Join(db.dir, indexesFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var defs []IndexDef
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return fmt.Errorf("%s: %w", indexesFile, err)
+	}
+	for _, def := range defs {
+		idx, err := newSecondaryIndex(def)
+		if err != nil {
+			return fmt.Errorf("%s: index %s: %w", indexesFile, def.Name, err)
+		}
+		db.secondary[def.Name] = idx
+	}
+	return nil
+}
+
+// Must be called with secondaryMutex locked.
+func (db *Db) saveIndexDefs() error {
+	defs := make([]IndexDef, 0, len(db.secondary))
+	for _, idx := range db.secondary {
+		defs = append(defs, idx.def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	data, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(db.dir, indexesFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (db *Db) updateSecondaryIndexes(key, value string) {
+	db.secondaryMutex.Lock()
+	defer db.secondaryMutex.Unlock()
+	for _, idx := range db.secondary {
+		idx.update(key, value)
+	}
+}
+
+func (db *Db) removeFromSecondaryIndexes(key string) {
+	db.secondaryMutex.Lock()
+	defer db.secondaryMutex.Unlock()
+	for _, idx := range db.secondary {
+		idx.remove(key)
+	}
+}
+
+// Creates an index over the value at the JSON path, e.g. $.owner, and fills
+// it with the stored documents. Definition is saved in the data directory,
+// the content is rebuilt on recovery.
+func (db *Db) CreateIndex(name, path string) error {
+	idx, err := newSecondaryIndex(IndexDef{Name: name, Path: path})
+	if err != nil {
+		return err
+	}
+
+	// writes wait for the index to be built before updating it
+	db.secondaryMutex.Lock()
+	defer db.secondaryMutex.Unlock()
+	if _, ok := db.secondary[name]; ok {
+		return ErrIndexExists
+	}
+
+	db.indexMutex.Lock()
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+	db.indexMutex.Unlock()
+
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if err == ErrNotFound {
+			// deleted meanwhile
+			continue
+		} else if err != nil {
+			return err
+		}
+		idx.update(key, value)
+	}
+
+	db.secondary[name] = idx
+	if err := db.saveIndexDefs(); err != nil {
+		delete(db.secondary, name)
+		return err
+	}
+	return nil
+}
+
+func (db *Db) DropIndex(name string) error {
+	db.secondaryMutex.Lock()
+	defer db.secondaryMutex.Unlock()
+	idx, ok := db.secondary[name]
+	if !ok {
+		return ErrIndexNotFound
+	}
+	delete(db.secondary, name)
+	if err := db.saveIndexDefs(); err != nil {
+		db.secondary[name] = idx
+		return err
+	}
+	return nil
+}
+
+func (db *Db) Indexes() []IndexDef {
+	db.secondaryMutex.RLock()
+	defer db.secondaryMutex.RUnlock()
+	defs := make([]IndexDef, 0, len(db.secondary))
+	for _, idx := range db.secondary {
+		defs = append(defs, idx.def)
+	}
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
+}
+
+// Returns sorted keys of the documents which have the value at the index path.
+func (db *Db) FindByIndex(name, value string) ([]string, error) {
+	db.secondaryMutex.RLock()
+	defer db.secondaryMutex.RUnlock()
+	idx, ok := db.secondary[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	return idx.find(value), nil
+}
@@ -0,0 +1,169 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJSONPath(t *testing.T) {
+	steps, err := parseJSONPath("$.owner.tags[1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []pathStep{{field: "owner"}, {field: "tags"}, {index: 1}}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("Unexpected steps %+v", steps)
+	}
+
+	for _, path := range []string{"", "$", "owner", "$.", "$..a", "$[a]", "$[-1]", "$[0"} {
+		if _, err := parseJSONPath(path); err != ErrBadJSONPath {
+			t.Errorf("Expected ErrBadJSONPath for %q, but got %v", path, err)
+		}
+	}
+}
+
+func TestDb_SecondaryIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	put := func(key, value string) {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	find := func(name, value string, expected ...string) {
+		t.Helper()
+		keys, err := db.FindByIndex(name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 && len(expected) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(keys, expected) {
+			t.Errorf("Expected %v for %s=%s, but got %v", expected, name, value, keys)
+		}
+	}
+
+	put("a", `{"owner": "alice", "size": 1}`)
+	put("b", `{"owner": "bob", "size": 2}`)
+	put("c", `not a json`)
+
+	if err := db.CreateIndex("owner", "$.owner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("owner", "$.owner"); err != ErrIndexExists {
+		t.Errorf("Expected ErrIndexExists, but got %v", err)
+	}
+	if err := db.CreateIndex("size", "$.size"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.FindByIndex("missing", "x"); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, but got %v", err)
+	}
+
+	t.Run("existing documents", func(t *testing.T) {
+		find("owner", "alice", "a")
+		find("owner", "bob", "b")
+		find("size", "2", "b")
+	})
+
+	t.Run("write path", func(t *testing.T) {
+		put("c", `{"owner": "alice"}`)
+		put("b", `{"owner": "alice", "size": 2}`)
+		put("a", `{"size": 1}`)
+		find("owner", "alice", "b", "c")
+		find("owner", "bob")
+		find("size", "1", "a")
+	})
+
+	t.Run("recovery", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.Start()
+
+		expected := []IndexDef{{"owner", "$.owner"}, {"size", "$.size"}}
+		if !reflect.DeepEqual(db.Indexes(), expected) {
+			t.Errorf("Unexpected indexes %+v", db.Indexes())
+		}
+		find("owner", "alice", "b", "c")
+		find("size", "1", "a")
+		find("size", "2", "b")
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		if err := db.DropIndex("size"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.FindByIndex("size", "1"); err != ErrIndexNotFound {
+			t.Errorf("Expected ErrIndexNotFound, but got %v", err)
+		}
+		if err := db.DropIndex("size"); err != ErrIndexNotFound {
+			t.Errorf("Expected ErrIndexNotFound, but got %v", err)
+		}
+	})
+}
+
+func TestDb_CreateIndexWhileDeleting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	var writes []Write
+	for i := 0; i < 10000; i++ {
+		writes = append(writes, Write{Key: fmt.Sprintf("key%d", i), Value: `{"owner": "alice"}`})
+	}
+	if err := db.Apply(nil, writes); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		// the index is being filled by then
+		time.Sleep(10 * time.Millisecond)
+		for _, w := range writes {
+			if err := db.Delete(w.Key); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := db.CreateIndex("owner", "$.owner"); err != nil {
+		t.Errorf("Index is not created: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := db.FindByIndex("owner", "alice"); err != nil || len(keys) != 0 {
+		t.Errorf("Expected no keys, got %v, error %v", keys, err)
+	}
+}
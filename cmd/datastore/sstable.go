@@ -0,0 +1,363 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sparse index keeps one key for every indexInterval bytes of data
+const indexInterval = 4 * KB
+
+const bloomFalsePositiveRate = 0.01
+
+const sstableMagic = 0x55ab1e
+
+// 8 bytes index offset + 4 bytes index entries count + 4 bytes magic
+const footerLen = 16
+
+var ErrBadTable = fmt.Errorf("bad sstable")
+
+// SSTable file is laid out as follows:
+// --------------------------------------------------
+// | data entries | meta | index entries | footer  |
+// --------------------------------------------------
+// Data entries are sorted by key and use the usual entry encoding. Meta is an
+// entry with the last key of the table, the number of data entries and their
+// max sequence number. Index entries map the first key of every block to its
+// offset.
+type sstable struct {
+	path  string
+	level int
+	id    uint64
+
+	file    *os.File
+	size    int64
+	dataEnd int64 // offset where the meta entry starts
+	count   uint64
+	maxSeq  uint64
+
+	firstKey, lastKey string
+	index             []sparseIndexEntry
+	filter            *bloomFilter
+}
+
+type sparseIndexEntry struct {
+	key    string
+	offset int64
+}
+
+func sstableName(level int, id uint64) string {
+	return fmt.Sprintf("L%d-%06d.sst", level, id)
+}
+
+// Bloom filter of the table is kept next to it
+func filterPath(tablePath string) string {
+	return strings.TrimSuffix(tablePath, ".sst") + ".bloom"
+}
+
+func parseSSTableName(name string) (level int, id uint64, ok bool) {
+	n, err := fmt.Sscanf(name, "L%d-%d.sst", &level, &id)
+	return level, id, err == nil && n == 2
+}
+
+func encodeUint64(v uint64) string {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return string(buf[:])
+}
+
+func decodeUint64(s string) (uint64, error) {
+	if len(s) != 8 {
+		return 0, ErrBadTable
+	}
+	return binary.LittleEndian.Uint64([]byte(s)), nil
+}
+
+// Writes the table to a temporary file. Keys must be added in increasing order.
+type sstableWriter struct {
+	path   string
+	level  int
+	id     uint64
+	file   *os.File
+	out    *bufio.Writer
+	offset int64
+
+	blockStart int64
+	index      []sparseIndexEntry
+	hashes     []uint64 // hashes of the keys for the bloom filter
+	lastKey    string
+	maxSeq     uint64
+}
+
+func newSSTableWriter(dir string, level int, id uint64) (*sstableWriter, error) {
+	path := filepath.Join(dir, sstableName(level, id))
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{
+		path:       path,
+		level:      level,
+		id:         id,
+		file:       file,
+		out:        bufio.NewWriterSize(file, bufSize),
+		blockStart: -indexInterval,
+	}, nil
+}
+
+func (w *sstableWriter) add(e *entry) error {
+	if w.offset-w.blockStart >= indexInterval {
+		w.index = append(w.index, sparseIndexEntry{key: e.key, offset: w.offset})
+		w.blockStart = w.offset
+	}
+	n, err := w.out.Write(e.Encode())
+	if err != nil {
+		return err
+	}
+	w.offset += int64(n)
+	w.hashes = append(w.hashes, bloomHash(e.key))
+	w.lastKey = e.key
+	if e.seq > w.maxSeq {
+		w.maxSeq = e.seq
+	}
+	return nil
+}
+
+// Size of the data written so far
+func (w *sstableWriter) size() int64 {
+	return w.offset
+}
+
+// Writes meta, index and footer, moves the file to its final path and opens
+// the resulting table.
+func (w *sstableWriter) finish() (*sstable, error) {
+	indexOffset := w.offset
+	meta := entry{
+		key:   w.lastKey,
+		value: encodeUint64(uint64(len(w.hashes))) + encodeUint64(w.maxSeq),
+	}
+	if _, err := w.out.Write(meta.Encode()); err != nil {
+		return nil, w.abort(err)
+	}
+	for _, ie := range w.index {
+		e := entry{
+			key:   ie.key,
+			value: encodeUint64(uint64(ie.offset)),
+		}
+		if _, err := w.out.Write(e.Encode()); err != nil {
+			return nil, w.abort(err)
+		}
+	}
+
+	var footer [footerLen]byte
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(indexOffset))
+	binary.LittleEndian.PutUint32(footer[8:12], uint32(len(w.index)))
+	binary.LittleEndian.PutUint32(footer[12:16], sstableMagic)
+	if _, err := w.out.Write(footer[:]); err != nil {
+		return nil, w.abort(err)
+	}
+	if err := w.out.Flush(); err != nil {
+		return nil, w.abort(err)
+	}
+	if err := w.file.Close(); err != nil {
+		return nil, w.abort(err)
+	}
+	filter := newBloomFilter(len(w.hashes), bloomFalsePositiveRate)
+	for _, h := range w.hashes {
+		filter.addHash(h)
+	}
+	// the filter goes first, so every table on disk has one
+	if err := writeBloomFilter(filterPath(w.path), filter); err != nil {
+		return nil, w.abort(err)
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		return nil, w.abort(err)
+	}
+	return openSSTable(w.path, w.level, w.id)
+}
+
+func (w *sstableWriter) abort(err error) error {
+	w.file.Close()
+	os.Remove(w.file.Name())
+	os.Remove(filterPath(w.path))
+	return err
+}
+
+func openSSTable(path string, level int, id uint64) (*sstable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	t.path = path
+	t.level = level
+	t.id = id
+
+	t.filter, err = readBloomFilter(filterPath(path))
+	if err != nil {
+		// filter is lost or damaged, so rebuild it from the keys of the table
+		if err := t.buildFilter(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := writeBloomFilter(filterPath(path), t.filter); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func loadSSTable(file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < footerLen {
+		return nil, ErrBadTable
+	}
+
+	var footer [footerLen]byte
+	if _, err := file.ReadAt(footer[:], size-footerLen); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[12:16]) != sstableMagic {
+		return nil, ErrBadTable
+	}
+	dataEnd := int64(binary.LittleEndian.Uint64(footer[0:8]))
+	indexCount := int(binary.LittleEndian.Uint32(footer[8:12]))
+	if dataEnd > size-footerLen {
+		return nil, ErrBadTable
+	}
+
+	in := bufio.NewReader(io.NewSectionReader(file, dataEnd, size-footerLen-dataEnd))
+	meta, err := readEntry(in)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.value) != 16 {
+		return nil, ErrBadTable
+	}
+	count, _ := decodeUint64(meta.value[:8])
+	maxSeq, _ := decodeUint64(meta.value[8:])
+
+	t := &sstable{
+		file:    file,
+		size:    size,
+		dataEnd: dataEnd,
+		count:   count,
+		maxSeq:  maxSeq,
+		lastKey: meta.key,
+		index:   make([]sparseIndexEntry, 0, indexCount),
+	}
+	for i := 0; i < indexCount; i++ {
+		e, err := readEntry(in)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := decodeUint64(e.value)
+		if err != nil {
+			return nil, err
+		}
+		t.index = append(t.index, sparseIndexEntry{key: e.key, offset: int64(offset)})
+	}
+	if len(t.index) > 0 {
+		t.firstKey = t.index[0].key
+	}
+	return t, nil
+}
+
+func (t *sstable) buildFilter() error {
+	filter := newBloomFilter(int(t.count), bloomFalsePositiveRate)
+	it := t.iterator()
+	for {
+		e, err := it.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		filter.add(e.key)
+	}
+	t.filter = filter
+	return nil
+}
+
+func (t *sstable) close() error {
+	return t.file.Close()
+}
+
+// Closes the table and deletes its files.
+func (t *sstable) remove() error {
+	if err := t.close(); err != nil {
+		return err
+	}
+	if err := os.Remove(t.path); err != nil {
+		return err
+	}
+	return os.Remove(filterPath(t.path))
+}
+
+// Whether the key range of the table intersects [from, to]
+func (t *sstable) overlaps(from, to string) bool {
+	return t.count > 0 && t.firstKey <= to && from <= t.lastKey
+}
+
+func (t *sstable) inRange(key string) bool {
+	return t.count > 0 && t.firstKey <= key && key <= t.lastKey
+}
+
+func (t *sstable) get(key string) (*entry, error) {
+	if !t.inRange(key) {
+		return nil, ErrNotFound
+	}
+	// last block which starts with a key that is not greater than the searched one
+	block := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	}) - 1
+	if block < 0 {
+		return nil, ErrNotFound
+	}
+
+	offset := t.index[block].offset
+	in := bufio.NewReader(io.NewSectionReader(t.file, offset, t.dataEnd-offset))
+	for {
+		e, err := readEntry(in)
+		if err == io.EOF {
+			return nil, ErrNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		if e.key == key {
+			return e, nil
+		} else if e.key > key {
+			return nil, ErrNotFound
+		}
+	}
+}
+
+func (t *sstable) iterator() *sstableIterator {
+	return &sstableIterator{
+		in: bufio.NewReaderSize(io.NewSectionReader(t.file, 0, t.dataEnd), bufSize),
+	}
+}
+
+// Iterates over data entries of the table in the key order.
+type sstableIterator struct {
+	in *bufio.Reader
+}
+
+func (it *sstableIterator) next() (*entry, error) {
+	return readEntry(it.in)
+}
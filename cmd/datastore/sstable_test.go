@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSSTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := newSSTableWriter(dir, 1, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// big enough to have several blocks in the sparse index
+	const n = 1000
+	for i := 0; i < n; i++ {
+		e := &entry{
+			key:   fmt.Sprintf("key%04d", i*2),
+			value: fmt.Sprintf("value%d", i*2),
+			seq:   uint64(i + 1),
+		}
+		if err := w.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.close()
+
+	if table.level != 1 || table.id != 42 {
+		t.Errorf("Unexpected table level %d and id %d", table.level, table.id)
+	}
+	if len(table.index) < 2 {
+		t.Errorf("Expected several index entries, but got %d", len(table.index))
+	}
+	if table.firstKey != "key0000" || table.lastKey != "key1998" {
+		t.Errorf("Unexpected key range [%s, %s]", table.firstKey, table.lastKey)
+	}
+	if table.count != n || table.maxSeq != n {
+		t.Errorf("Unexpected count %d and max seq %d", table.count, table.maxSeq)
+	}
+
+	t.Run("get", func(t *testing.T) {
+		for i := 0; i < n; i++ {
+			e, err := table.get(fmt.Sprintf("key%04d", i*2))
+			if err != nil {
+				t.Fatalf("Cannot get key%04d: %s", i*2, err)
+			}
+			if e.value != fmt.Sprintf("value%d", i*2) || e.seq != uint64(i+1) {
+				t.Errorf("Bad entry returned for key%04d: %+v", i*2, e)
+			}
+		}
+	})
+
+	t.Run("missing keys", func(t *testing.T) {
+		for _, key := range []string{"a", "key0001", "key1001", "key1999", "z"} {
+			if _, err := table.get(key); err != ErrNotFound {
+				t.Errorf("Expected ErrNotFound for %s, but got %v", key, err)
+			}
+		}
+	})
+
+	t.Run("iterator", func(t *testing.T) {
+		it := table.iterator()
+		count := 0
+		for {
+			e, err := it.next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if e.key != fmt.Sprintf("key%04d", count*2) {
+				t.Fatalf("Unexpected key %s at position %d", e.key, count)
+			}
+			count++
+		}
+		if count != n {
+			t.Errorf("Expected %d entries, but got %d", n, count)
+		}
+	})
+}
+
+func TestSSTable_Filter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := newSSTableWriter(dir, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := w.add(&entry{key: fmt.Sprintf("key%03d", i), value: "value"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table, err := w.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	persisted := table.filter
+	if _, err := os.Stat(filterPath(table.path)); err != nil {
+		t.Fatalf("Filter is not persisted: %s", err)
+	}
+	table.close()
+
+	// lost filter is rebuilt from the table
+	if err := os.Remove(filterPath(table.path)); err != nil {
+		t.Fatal(err)
+	}
+	table, err = openSSTable(table.path, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(table.filter, persisted) {
+		t.Errorf("Rebuilt filter differs from the persisted one")
+	}
+	if _, err := os.Stat(filterPath(table.path)); err != nil {
+		t.Errorf("Rebuilt filter is not persisted: %s", err)
+	}
+
+	if err := table.remove(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected table files to be removed, but found %d files", len(files))
+	}
+}
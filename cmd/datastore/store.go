@@ -0,0 +1,79 @@
+package datastore
+
+// Store is the key-value API implemented by both storage engines, so users
+// can switch between the hash index Db and the LsmDb.
+type Store interface {
+	Get(key string) (string, error)
+	// Returns the value with its version, the sequence number of the write
+	GetVersion(key string) (string, uint64, error)
+	Put(key, value string) error
+	Delete(key string) error
+	// Applies the writes at once, if the keys from reads still have the given
+	// versions (0 for absent keys). Otherwise returns ErrConflict
+	Apply(reads map[string]uint64, writes []Write) error
+	// Starts an optimistic transaction
+	Begin() *Txn
+	// Returns the limits of the store and the current size of its directory
+	Usage() Usage
+	// Start write thread. Without it, store will not work
+	Start()
+	Close() error
+}
+
+var _ Store = (*Db)(nil)
+var _ Store = (*LsmDb)(nil)
+
+// Indexer is implemented by the stores which support secondary indexes over
+// JSON values.
+type Indexer interface {
+	CreateIndex(name, path string) error
+	DropIndex(name string) error
+	Indexes() []IndexDef
+	FindByIndex(name, value string) ([]string, error)
+}
+
+var _ Indexer = (*Db)(nil)
+
+// Watchable is implemented by the stores which stream their changes.
+type Watchable interface {
+	Watch(prefix string) *Watcher
+	WatchFrom(prefix string, since uint64) (*Watcher, error)
+}
+
+var _ Watchable = (*Db)(nil)
+
+// MultiVersion is implemented by the stores which keep previous versions of
+// the keys.
+type MultiVersion interface {
+	GetAt(key string, version uint64) (string, uint64, error)
+	History(key string, limit int) ([]Version, error)
+}
+
+var _ MultiVersion = (*Db)(nil)
+
+// Maintainable is implemented by the stores which report their state and
+// run maintenance on demand.
+type Maintainable interface {
+	Stats() (DbStats, error)
+	Compact() error
+	Verify() ([]SegmentCheck, error)
+}
+
+var _ Maintainable = (*Db)(nil)
+
+// Exporter is implemented by the stores which can stream their content.
+type Exporter interface {
+	// Passes every key with its value to fn, in no particular order
+	Export(fn func(key, value string) error) error
+}
+
+var _ Exporter = (*Db)(nil)
+
+// Scanner is implemented by the stores which list their keys in order.
+type Scanner interface {
+	// Returns up to limit keys greater than after in ascending order, all of
+	// them if limit is 0
+	Scan(after string, limit int) ([]string, error)
+}
+
+var _ Scanner = (*Db)(nil)
@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+)
+
+var ErrConflict = fmt.Errorf("keys read by the transaction were changed")
+var ErrTxnDone = fmt.Errorf("transaction is already committed")
+
+// Write is a single change of the key applied by Apply.
+type Write struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+type writeRequest struct {
+	writes []Write
+	// versions of the keys expected by the writer, 0 for absent keys
+	reads map[string]uint64
+	// merge the segments instead of writing, see Db.Compact
+	compact  bool
+	callback chan error
+}
+
+// Sends the writes to the writing thread, which applies all of them at once if
+// the keys still have the expected versions, and fails with ErrConflict
+// otherwise.
+func sendWrites(writeChan chan writeRequest, reads map[string]uint64, writes []Write) error {
+	callback := make(chan error)
+	writeChan <- writeRequest{
+		writes:   writes,
+		reads:    reads,
+		callback: callback,
+	}
+	return <-callback
+}
+
+// Checks whether the versions of the keys match the read ones.
+func checkReads(reads map[string]uint64, version func(key string) (uint64, error)) error {
+	for key, expected := range reads {
+		actual, err := version(key)
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+type txnStore interface {
+	GetVersion(key string) (string, uint64, error)
+	Apply(reads map[string]uint64, writes []Write) error
+}
+
+// Txn is an optimistic transaction. Writes are buffered until the commit,
+// which fails with ErrConflict if any of the keys read by the transaction was
+// changed meanwhile.
+type Txn struct {
+	store txnStore
+
+	mutex  sync.Mutex
+	reads  map[string]uint64
+	writes map[string]Write
+	order  []string // keys in the order of the first write
+	done   bool
+}
+
+func newTxn(store txnStore) *Txn {
+	return &Txn{
+		store:  store,
+		reads:  make(map[string]uint64),
+		writes: make(map[string]Write),
+	}
+}
+
+// Returns the value written by the transaction or the stored one.
+func (t *Txn) Get(key string) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.done {
+		return "", ErrTxnDone
+	}
+	if w, ok := t.writes[key]; ok {
+		if w.Delete {
+			return "", ErrNotFound
+		}
+		return w.Value, nil
+	}
+
+	value, version, err := t.store.GetVersion(key)
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	// a key read twice keeps the first version, so the change is detected
+	if _, ok := t.reads[key]; !ok {
+		t.reads[key] = version
+	}
+	return value, err
+}
+
+func (t *Txn) Put(key, value string) error {
+	return t.write(Write{Key: key, Value: value})
+}
+
+func (t *Txn) Delete(key string) error {
+	return t.write(Write{Key: key, Delete: true})
+}
+
+func (t *Txn) write(w Write) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	if _, ok := t.writes[w.Key]; !ok {
+		t.order = append(t.order, w.Key)
+	}
+	t.writes[w.Key] = w
+	return nil
+}
+
+func (t *Txn) Commit() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	if len(t.writes) == 0 {
+		// nothing to make consistent with the reads
+		return nil
+	}
+	writes := make([]Write, 0, len(t.order))
+	for _, key := range t.order {
+		writes = append(writes, t.writes[key])
+	}
+	return t.store.Apply(t.reads, writes)
+}
@@ -0,0 +1,185 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type storeOpener func(dir string) (Store, error)
+
+var engines = map[string]storeOpener{
+	"hash": func(dir string) (Store, error) {
+		db, err := NewDb(dir)
+		if err != nil {
+			return nil, err
+		}
+		return db.SegmentSize(256), nil
+	},
+	"lsm": func(dir string) (Store, error) {
+		db, err := NewLsmDb(dir)
+		if err != nil {
+			return nil, err
+		}
+		return db.MemtableSize(256), nil
+	},
+}
+
+func TestTxn(t *testing.T) {
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-txn")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Start()
+			defer db.Close()
+
+			if err := db.Put("a", "1"); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Run("commit", func(t *testing.T) {
+				txn := db.Begin()
+				value, err := txn.Get("a")
+				if err != nil || value != "1" {
+					t.Fatalf("Expected 1, got %q, %v", value, err)
+				}
+				if _, err := txn.Get("b"); err != ErrNotFound {
+					t.Fatalf("Expected ErrNotFound, got %v", err)
+				}
+				txn.Put("a", "2")
+				txn.Put("b", "3")
+				if value, _ := txn.Get("b"); value != "3" {
+					t.Errorf("Transaction does not see its write, got %q", value)
+				}
+				if _, err := db.Get("b"); err != ErrNotFound {
+					t.Errorf("Write is visible before the commit")
+				}
+				if err := txn.Commit(); err != nil {
+					t.Fatal(err)
+				}
+				if err := txn.Commit(); err != ErrTxnDone {
+					t.Errorf("Expected ErrTxnDone, got %v", err)
+				}
+				for key, expected := range map[string]string{"a": "2", "b": "3"} {
+					if value, err := db.Get(key); err != nil || value != expected {
+						t.Errorf("Expected %s for %s, got %q, %v", expected, key, value, err)
+					}
+				}
+			})
+
+			t.Run("conflict", func(t *testing.T) {
+				txn := db.Begin()
+				txn.Get("a")
+				txn.Get("c")
+				txn.Put("b", "4")
+
+				if err := db.Put("c", "concurrent"); err != nil {
+					t.Fatal(err)
+				}
+				if err := txn.Commit(); err != ErrConflict {
+					t.Fatalf("Expected ErrConflict, got %v", err)
+				}
+				if value, _ := db.Get("b"); value != "3" {
+					t.Errorf("Conflicting transaction was applied, b = %q", value)
+				}
+			})
+
+			t.Run("apply", func(t *testing.T) {
+				_, version, err := db.GetVersion("a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				writes := []Write{{Key: "a", Value: "5"}, {Key: "b", Delete: true}}
+				if err := db.Apply(map[string]uint64{"a": version + 100}, writes); err != ErrConflict {
+					t.Errorf("Expected ErrConflict, got %v", err)
+				}
+				if err := db.Apply(map[string]uint64{"a": version}, writes); err != nil {
+					t.Fatal(err)
+				}
+				if value, _ := db.Get("a"); value != "5" {
+					t.Errorf("Expected 5, got %q", value)
+				}
+				if _, err := db.Get("b"); err != ErrNotFound {
+					t.Errorf("Expected b to be deleted, got %v", err)
+				}
+			})
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-delete")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Start()
+
+			// enough writes to merge the segments and compact the tables
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key%d", i%10)
+				if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 10; i += 2 {
+				if err := db.Delete(fmt.Sprintf("key%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 100; i++ {
+				if err := db.Put(fmt.Sprintf("other%d", i), "value"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := func(t *testing.T) {
+				for i := 0; i < 10; i++ {
+					key := fmt.Sprintf("key%d", i)
+					value, err := db.Get(key)
+					if i%2 == 0 && err != ErrNotFound {
+						t.Errorf("Expected %s to be deleted, got %q, %v", key, value, err)
+					}
+					if i%2 == 1 && value != fmt.Sprintf("value%d", 90+i) {
+						t.Errorf("Bad value of %s: %q, %v", key, value, err)
+					}
+				}
+			}
+			check(t)
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db.Start()
+			defer db.Close()
+			check(t)
+
+			if err := db.Put("key0", "again"); err != nil {
+				t.Fatal(err)
+			}
+			if value, _ := db.Get("key0"); value != "again" {
+				t.Errorf("Deleted key was not written again, got %q", value)
+			}
+		})
+	}
+}
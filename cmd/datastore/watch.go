@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Minimal number of recent changes kept in memory for the watchers to resume
+// from
+const changeLogSize = 1024
+
+// Buffer of every watcher. Watchers which fall behind it are closed.
+const watchBufferSize = 256
+
+var ErrSeqUnavailable = fmt.Errorf("changes after the sequence number are not available")
+var ErrWatchOverflow = fmt.Errorf("watcher fell behind the changes")
+
+type Op string
+
+const (
+	OpPut    Op = "put"
+	OpDelete Op = "delete"
+)
+
+type ChangeEvent struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Op    Op     `json:"op"`
+	Seq   uint64 `json:"seq"`
+}
+
+// Watcher receives changes of the keys with the prefix.
+type Watcher struct {
+	// Events is closed when the watcher or the db is closed, or the watcher
+	// falls behind the changes.
+	Events <-chan ChangeEvent
+	// Sequence number of the last change made before the watcher has started.
+	// Watching again from it does not miss any changes.
+	StartSeq uint64
+
+	db     *Db
+	prefix string
+	events chan ChangeEvent
+	err    error
+}
+
+// Returns ErrWatchOverflow if the watcher was closed because it fell behind.
+// Changes after the last received event may be watched again with WatchFrom.
+func (w *Watcher) Err() error {
+	w.db.watchMutex.Lock()
+	defer w.db.watchMutex.Unlock()
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.db.watchMutex.Lock()
+	defer w.db.watchMutex.Unlock()
+	if _, ok := w.db.watchers[w]; ok {
+		delete(w.db.watchers, w)
+		close(w.events)
+	}
+}
+
+// Watches changes of the keys with the prefix made from now on.
+func (db *Db) Watch(prefix string) *Watcher {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	return db.addWatcher(prefix, nil)
+}
+
+// Watches changes of the keys with the prefix made after the sequence number.
+// Recent changes are delivered first; if they are not kept in memory anymore,
+// ErrSeqUnavailable is returned.
+func (db *Db) WatchFrom(prefix string, since uint64) (*Watcher, error) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	if since > db.seq {
+		return nil, ErrSeqUnavailable
+	}
+	// the log is empty after the db is reopened
+	if since < db.seq && (len(db.changes) == 0 || since+1 < db.changes[0].Seq) {
+		return nil, ErrSeqUnavailable
+	}
+	var backlog []ChangeEvent
+	for _, e := range db.changes {
+		if e.Seq > since && strings.HasPrefix(e.Key, prefix) {
+			backlog = append(backlog, e)
+		}
+	}
+	return db.addWatcher(prefix, backlog), nil
+}
+
+// Must be called with watchMutex locked.
+func (db *Db) addWatcher(prefix string, backlog []ChangeEvent) *Watcher {
+	events := make(chan ChangeEvent, watchBufferSize+len(backlog))
+	for _, e := range backlog {
+		events <- e
+	}
+	w := &Watcher{
+		Events:   events,
+		StartSeq: db.seq,
+		db:       db,
+		prefix:   prefix,
+		events:   events,
+	}
+	db.watchers[w] = struct{}{}
+	return w
+}
+
+// Called by the writing thread after every write.
+func (db *Db) publish(e ChangeEvent) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	db.seq = e.Seq
+	if len(db.changes) == 2*changeLogSize {
+		// trim the log once in a while rather than on every write
+		db.changes = append(db.changes[:0], db.changes[changeLogSize:]...)
+	}
+	db.changes = append(db.changes, e)
+
+	for w := range db.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- e:
+		default:
+			// writes must not wait for slow watchers
+			w.err = ErrWatchOverflow
+			delete(db.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+func (db *Db) closeWatchers() {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	for w := range db.watchers {
+		delete(db.watchers, w)
+		close(w.events)
+	}
+}
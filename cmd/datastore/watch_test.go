@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, w *Watcher) ChangeEvent {
+	t.Helper()
+	select {
+	case e, ok := <-w.Events:
+		if !ok {
+			t.Fatalf("Watcher is closed: %v", w.Err())
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("No event received")
+	}
+	return ChangeEvent{}
+}
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	w := db.Watch("config/")
+	defer w.Close()
+
+	for _, key := range []string{"config/a", "other", "config/b"} {
+		if err := db.Put(key, key+"-value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("prefix", func(t *testing.T) {
+		e := receive(t, w)
+		if e.Key != "config/a" || e.Value != "config/a-value" || e.Op != OpPut || e.Seq != 1 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+		e = receive(t, w)
+		if e.Key != "config/b" || e.Seq != 3 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		w, err := db.WatchFrom("config/", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if w.StartSeq != 3 {
+			t.Errorf("Expected start sequence number 3, but got %d", w.StartSeq)
+		}
+		if e := receive(t, w); e.Key != "config/b" || e.Seq != 3 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+		if err := db.Put("config/c", "c"); err != nil {
+			t.Fatal(err)
+		}
+		if e := receive(t, w); e.Key != "config/c" || e.Seq != 4 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		if _, err := db.WatchFrom("", 100); err != ErrSeqUnavailable {
+			t.Errorf("Expected ErrSeqUnavailable, but got %v", err)
+		}
+		for i := 0; i < 2*changeLogSize; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.WatchFrom("", 0); err != ErrSeqUnavailable {
+			t.Errorf("Expected ErrSeqUnavailable, but got %v", err)
+		}
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		w := db.Watch("")
+		for i := 0; i < watchBufferSize+1; i++ {
+			if err := db.Put("key", "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		count := 0
+		for range w.Events {
+			count++
+		}
+		if count != watchBufferSize {
+			t.Errorf("Expected %d events before overflow, but got %d", watchBufferSize, count)
+		}
+		if w.Err() != ErrWatchOverflow {
+			t.Errorf("Expected ErrWatchOverflow, but got %v", w.Err())
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		w := db.Watch("")
+		w.Close()
+		w.Close()
+		if _, ok := <-w.Events; ok {
+			t.Error("Expected events to be closed")
+		}
+	})
+}
+
+func TestDb_WatchFromReopened(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = NewDb(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+	defer db.Close()
+
+	// the changes before the reopening are lost
+	if _, err := db.WatchFrom("", 1); err != ErrSeqUnavailable {
+		t.Errorf("Expected ErrSeqUnavailable, but got %v", err)
+	}
+	w, err := db.WatchFrom("", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := db.Put("d", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, w); e.Key != "d" || e.Seq != 4 {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if _, err := db.WatchFrom("", 2); err != ErrSeqUnavailable {
+		t.Errorf("Expected ErrSeqUnavailable, but got %v", err)
+	}
+}
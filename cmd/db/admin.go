@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+// Returns the store of the namespace in the ns parameter, the default one if
+// it is missing, if the store supports maintenance.
+func maintainableOf(rw http.ResponseWriter, r *http.Request, stores *namespaces) (datastore.Maintainable, bool) {
+	name := r.URL.Query().Get("ns")
+	if name == "" {
+		name = defaultNamespace
+	}
+	ns, ok := stores.get(name)
+	if !ok {
+		http.Error(rw, errNamespaceNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	m, ok := ns.store.(datastore.Maintainable)
+	if !ok {
+		http.Error(rw, "maintenance is not supported by the engine", http.StatusNotImplemented)
+	}
+	return m, ok
+}
+
+func writeJSON(rw http.ResponseWriter, status int, res interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Printf("Error while serving request: %s", err)
+	}
+}
+
+// Registers the admin endpoints, all of them take the namespace in the ns
+// parameter:
+// GET /admin/stats reports the state of the segments,
+// POST /admin/compact merges them,
+// GET /admin/verify checks the checksums of all the entries, it responds with
+// 500 if any of them is corrupt.
+func handleAdmin(r *mux.Router, stores *namespaces) {
+	r.HandleFunc("/admin/stats", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("GET %s", r.URL)
+		m, ok := maintainableOf(rw, r, stores)
+		if !ok {
+			return
+		}
+		stats, err := m.Stats()
+		if err != nil {
+			log.Printf("Error collecting stats: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &stats)
+	}).Methods("GET")
+
+	r.HandleFunc("/admin/compact", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("POST %s", r.URL)
+		m, ok := maintainableOf(rw, r, stores)
+		if !ok {
+			return
+		}
+		if err := m.Compact(); err != nil {
+			log.Printf("Error compacting: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		stats, err := m.Stats()
+		if err != nil {
+			log.Printf("Error collecting stats: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &stats)
+	}).Methods("POST")
+
+	r.HandleFunc("/admin/verify", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("GET %s", r.URL)
+		m, ok := maintainableOf(rw, r, stores)
+		if !ok {
+			return
+		}
+		checks, err := m.Verify()
+		if err != nil {
+			log.Printf("Error verifying: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res := struct {
+			OK       bool                     `json:"ok"`
+			Segments []datastore.SegmentCheck `json:"segments"`
+		}{true, checks}
+		for i := range checks {
+			if !checks[i].OK() {
+				res.OK = false
+			}
+		}
+		status := http.StatusOK
+		if !res.OK {
+			status = http.StatusInternalServerError
+		}
+		writeJSON(rw, status, &res)
+	}).Methods("GET")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+func TestAdmin(t *testing.T) {
+	stores, server, stop := openTestServer(t)
+	defer stop()
+	ns, _ := stores.get(defaultNamespace)
+	for i := 0; i < 3; i++ {
+		ns.store.Put("a", "value")
+	}
+	ns.store.Put("b", "value")
+
+	status, body := do(t, server, "GET", "/admin/stats", "")
+	var stats datastore.DbStats
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &stats) != nil {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if stats.Keys != 2 || stats.GarbageBytes == 0 {
+		t.Errorf("Got stats %+v", stats)
+	}
+
+	status, body = do(t, server, "POST", "/admin/compact", "")
+	stats = datastore.DbStats{}
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &stats) != nil {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if stats.Keys != 2 || stats.GarbageBytes != 0 || stats.LastMerge.IsZero() {
+		t.Errorf("Got stats %+v", stats)
+	}
+
+	status, body = do(t, server, "GET", "/admin/verify?ns="+defaultNamespace, "")
+	var verify struct {
+		OK       bool                     `json:"ok"`
+		Segments []datastore.SegmentCheck `json:"segments"`
+	}
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &verify) != nil {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if !verify.OK || len(verify.Segments) == 0 {
+		t.Errorf("Got %s", body)
+	}
+
+	if status, _ := do(t, server, "GET", "/admin/stats?ns=missing", ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/teramont/go2-lab-2/dbproto"
+)
+
+const benchKeys = 1000
+
+func openBenchStores(b *testing.B) (*namespaces, func()) {
+	dir, err := ioutil.TempDir("", "bench-db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	stores, err := openNamespaces(dir, nsOptions{Engine: "hash", SegmentSize: 10 * MB}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ns, _ := stores.get(defaultNamespace)
+	for i := 0; i < benchKeys; i++ {
+		if err := ns.store.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// the handlers log every request
+	log.SetOutput(ioutil.Discard)
+	return stores, func() {
+		log.SetOutput(os.Stderr)
+		stores.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func BenchmarkGet_HTTP(b *testing.B) {
+	stores, stop := openBenchStores(b)
+	defer stop()
+	server := httptest.NewServer(newRouter(stores))
+	defer server.Close()
+	client := server.Client()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			resp, err := client.Get(fmt.Sprintf("%s/db/key%d", server.URL, i%benchKeys))
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				b.Fatalf("Unexpected status %d", resp.StatusCode)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkGet_Binary(b *testing.B) {
+	stores, stop := openBenchStores(b)
+	defer stop()
+	client, closeServer := startBinary(b, stores)
+	defer closeServer()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := client.Get(fmt.Sprintf("key%d", i%benchKeys)); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkPut_HTTP(b *testing.B) {
+	stores, stop := openBenchStores(b)
+	defer stop()
+	server := httptest.NewServer(newRouter(stores))
+	defer server.Close()
+	client := server.Client()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			url := fmt.Sprintf("%s/db/key%d", server.URL, i%benchKeys)
+			resp, err := client.Post(url, "application/json", strings.NewReader(`{"value": "changed"}`))
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+				b.Fatalf("Unexpected status %d", resp.StatusCode)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkPut_Binary(b *testing.B) {
+	stores, stop := openBenchStores(b)
+	defer stop()
+	client, closeServer := startBinary(b, stores)
+	defer closeServer()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if err := client.Put(fmt.Sprintf("key%d", i%benchKeys), "changed"); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func startBinary(b *testing.B, stores *namespaces) (*dbproto.Client, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	ns, _ := stores.get(defaultNamespace)
+	server := dbproto.NewServer(ns.store)
+	go server.Serve(listener)
+	client, err := dbproto.Dial(listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		server.Close()
+	}
+}
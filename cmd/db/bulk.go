@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+	"github.com/teramont/go2-lab-2/httptools"
+)
+
+const defaultImportBatch = 1000
+
+// The import and the export take as long as their data needs, but every read
+// of the body and every write of the response must finish within this time
+const bulkProgressTimeout = 10 * time.Second
+
+// Registers bulk loading and unloading of the store:
+// POST prefix/_import?batch=N applies the JSON lines of writes from the body,
+// e.g. {"key": "a", "value": "b"} or {"key": "a", "delete": true}, N at once;
+// GET prefix/_export streams all the keys with their values as JSON lines, in
+// no particular order.
+// Instead of the server's timeouts, their bodies are limited by
+// bulkProgressTimeout.
+func handleBulk(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/_import", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("POST %s", r.URL)
+
+		batch := defaultImportBatch
+		if s := r.URL.Query().Get("batch"); s != "" {
+			var err error
+			batch, err = strconv.Atoi(s)
+			if err != nil || batch <= 0 {
+				http.Error(rw, "bad batch", http.StatusBadRequest)
+				return
+			}
+		}
+		db, ok := stores.store(rw, r, true)
+		if !ok {
+			return
+		}
+
+		n, err := datastore.Import(db, httptools.ProgressBody(r, bulkProgressTimeout), batch)
+		res := struct {
+			Imported int    `json:"imported"`
+			Error    string `json:"error,omitempty"`
+		}{Imported: n}
+		status := writeStatus(err)
+		if errors.Is(err, datastore.ErrBadRecord) {
+			status = http.StatusBadRequest
+		} else if status == http.StatusInternalServerError {
+			log.Printf("Error importing: %s", err)
+		}
+		if err != nil {
+			res.Error = err.Error()
+		}
+		writeJSON(rw, status, &res)
+	}).Methods("POST")
+
+	r.HandleFunc(prefix+"/_export", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("GET %s", r.URL)
+
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+		exporter, ok := db.(datastore.Exporter)
+		if !ok {
+			http.Error(rw, "export is not supported by the engine", http.StatusNotImplemented)
+			return
+		}
+
+		rw.Header().Set("content-type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+		out := bufio.NewWriter(httptools.ProgressWriter(rw, r, bulkProgressTimeout))
+		encoder := json.NewEncoder(out)
+		err := exporter.Export(func(key, value string) error {
+			return encoder.Encode(record{key, value})
+		})
+		if err == nil {
+			err = out.Flush()
+		}
+		if err != nil {
+			// status is already sent, the client sees the cut stream
+			log.Printf("Error exporting: %s", err)
+		}
+	}).Methods("GET")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBulk(t *testing.T) {
+	_, server, stop := openTestServer(t)
+	defer stop()
+
+	lines := `{"key": "a", "value": "1"}
+{"key": "b", "value": "2"}
+{"key": "c", "value": "3"}
+{"key": "a", "delete": true}
+`
+	status, body := do(t, server, "POST", "/db/_import?batch=2", lines)
+	if status != http.StatusOK || strings.TrimSpace(body) != `{"imported":4}` {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	// the batches before the bad record are applied
+	status, body = do(t, server, "POST", "/db/_import?batch=1", `{"key": "d", "value": "4"}
+{"key": ""}
+`)
+	if status != http.StatusBadRequest || !strings.Contains(body, `"imported":1`) {
+		t.Errorf("Got %d %s", status, body)
+	}
+	if status, _ := do(t, server, "POST", "/db/_import?batch=0", lines); status != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", status)
+	}
+
+	status, body = do(t, server, "GET", "/db/_export", "")
+	if status != http.StatusOK {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	var keys []string
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var r record
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Bad line %q: %s", line, err)
+		}
+		keys = append(keys, r.Key+"="+r.Value)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "b=2,c=3,d=4" {
+		t.Errorf("Got exported %v", keys)
+	}
+
+	if status, _ := do(t, server, "GET", "/db/missing/_export", ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+var errBadVersion = fmt.Errorf("bad version")
+
+// Reads the value of the key, or its older value if the version parameter is
+// given.
+func getValue(db datastore.Store, key string, query url.Values) (string, uint64, error) {
+	s := query.Get("version")
+	if s == "" {
+		return db.GetVersion(key)
+	}
+	version, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return "", 0, errBadVersion
+	}
+	mv, ok := db.(datastore.MultiVersion)
+	if !ok {
+		return "", 0, datastore.ErrVersioningDisabled
+	}
+	return mv.GetAt(key, version)
+}
+
+// Registers GET prefix/{key}/history?limit=N with the latest versions of the
+// key. For the default namespace the route is not matched when the key is the
+// name of a namespace, /db/default/{key}/history is there for such keys.
+func handleHistory(r *mux.Router, prefix string, stores *namespaces) {
+	route := r.HandleFunc(prefix+"/{key}/history", func(rw http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		log.Printf("GET %s", r.URL)
+
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+
+		limit := 0
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit < 0 {
+				http.Error(rw, "bad limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		mv, ok := db.(datastore.MultiVersion)
+		if !ok {
+			http.Error(rw, datastore.ErrVersioningDisabled.Error(), http.StatusNotImplemented)
+			return
+		}
+		versions, err := mv.History(key, limit)
+		if err == datastore.ErrNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		} else if err == datastore.ErrVersioningDisabled {
+			http.Error(rw, err.Error(), http.StatusNotImplemented)
+			return
+		} else if err != nil {
+			log.Printf("Error reading history of %s: %s", key, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := struct {
+			Key      string              `json:"key"`
+			Versions []datastore.Version `json:"versions"`
+		}{key, versions}
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(&res); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+	if prefix == "/db" {
+		route.MatcherFunc(func(r *http.Request, _ *mux.RouteMatch) bool {
+			return !stores.inPath(r)
+		})
+	}
+}
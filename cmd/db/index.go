@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Returns the store of the request if it supports secondary indexes.
+func indexerOf(rw http.ResponseWriter, r *http.Request, stores *namespaces, create bool) (datastore.Indexer, bool) {
+	db, ok := stores.store(rw, r, create)
+	if !ok {
+		return nil, false
+	}
+	indexer, ok := db.(datastore.Indexer)
+	if !ok {
+		http.Error(rw, "secondary indexes are not supported by the engine", http.StatusNotImplemented)
+	}
+	return indexer, ok
+}
+
+// Registers routes for the secondary indexes under prefix/_index/.
+func handleIndexes(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/_index", func(rw http.ResponseWriter, r *http.Request) {
+		indexer, ok := indexerOf(rw, r, stores, false)
+		if !ok {
+			return
+		}
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(indexer.Indexes()); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+
+	r.HandleFunc(prefix+"/_index/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		log.Printf("POST %s", r.URL)
+
+		indexer, ok := indexerOf(rw, r, stores, true)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch err := indexer.CreateIndex(name, body.Path); err {
+		case nil:
+			rw.WriteHeader(http.StatusCreated)
+		case datastore.ErrIndexExists:
+			rw.WriteHeader(http.StatusConflict)
+		case datastore.ErrBadJSONPath:
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("Error creating index %s: %s", name, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+
+	r.HandleFunc(prefix+"/_index/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		log.Printf("DELETE %s", r.URL)
+
+		indexer, ok := indexerOf(rw, r, stores, false)
+		if !ok {
+			return
+		}
+
+		switch err := indexer.DropIndex(name); err {
+		case nil:
+			rw.WriteHeader(http.StatusOK)
+		case datastore.ErrIndexNotFound:
+			rw.WriteHeader(http.StatusNotFound)
+		default:
+			log.Printf("Error dropping index %s: %s", name, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}).Methods("DELETE")
+
+	r.HandleFunc(prefix+"/_index/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		log.Printf("GET %s", r.URL)
+
+		indexer, ok := indexerOf(rw, r, stores, false)
+		if !ok {
+			return
+		}
+
+		eq, ok := r.URL.Query()["eq"]
+		if !ok {
+			http.Error(rw, "eq parameter is required", http.StatusBadRequest)
+			return
+		}
+		keys, err := indexer.FindByIndex(name, eq[0])
+		if err == datastore.ErrIndexNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := make([]record, 0, len(keys))
+		for _, key := range keys {
+			value, err := indexer.(datastore.Store).Get(key)
+			if err == datastore.ErrNotFound {
+				// removed after the index lookup
+				continue
+			} else if err != nil {
+				log.Printf("Error reading %s: %s", key, err)
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			res = append(res, record{key, value})
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(res); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestIndexes(t *testing.T) {
+	stores, server, stop := openTestServer(t)
+	defer stop()
+	ns, _ := stores.get(defaultNamespace)
+	ns.store.Put("a", `{"owner": "ann"}`)
+	ns.store.Put("b", `{"owner": "bob"}`)
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/db/_index/owner", `{"path": "$.owner"}`, http.StatusCreated},
+		{"POST", "/db/_index/owner", `{"path": "$.owner"}`, http.StatusConflict},
+		{"POST", "/db/_index/bad", `{"path": "owner"}`, http.StatusBadRequest},
+		{"POST", "/db/_index/bad", `{`, http.StatusBadRequest},
+		{"GET", "/db/_index/owner", "", http.StatusBadRequest},
+		{"GET", "/db/_index/missing?eq=ann", "", http.StatusNotFound},
+	} {
+		if status, body := do(t, server, c.method, c.path, c.body); status != c.status {
+			t.Errorf("%s %s: expected %d, got %d %s", c.method, c.path, c.status, status, body)
+		}
+	}
+
+	// the index follows the writes after its creation
+	ns.store.Put("c", `{"owner": "ann"}`)
+	ns.store.Delete("a")
+	status, body := do(t, server, "GET", "/db/_index/owner?eq=ann", "")
+	var found []record
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &found) != nil {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if len(found) != 1 || found[0].Key != "c" {
+		t.Errorf("Got %v", found)
+	}
+
+	var indexes []json.RawMessage
+	if _, body := do(t, server, "GET", "/db/_index", ""); json.Unmarshal([]byte(body), &indexes) != nil || len(indexes) != 1 {
+		t.Errorf("Got indexes %s", body)
+	}
+
+	if status, _ := do(t, server, "DELETE", "/db/_index/owner", ""); status != http.StatusOK {
+		t.Errorf("Expected 200, got %d", status)
+	}
+	if status, _ := do(t, server, "DELETE", "/db/_index/owner", ""); status != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", status)
+	}
+}
@@ -1,24 +1,44 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/teramont/go2-lab-2/cmd/datastore"
+	"github.com/teramont/go2-lab-2/dbproto"
 	"github.com/teramont/go2-lab-2/httptools"
+	"github.com/teramont/go2-lab-2/resp"
 	"github.com/teramont/go2-lab-2/signal"
 )
 
 const KB = 1024
 const MB = KB * 1024
 
+// How long the running requests may take at shutdown
+const shutdownTimeout = 10 * time.Second
+
 var port = flag.Int("p", 8070, "server's port")
 var path = flag.String("d", "database", "database's directory path")
 var segmentSize = flag.Int("s", 10*MB, "segment size in bytes")
+var engine = flag.String("engine", "hash", "storage engine: hash or lsm")
+var mvcc = flag.Bool("mvcc", false, "keep previous versions of the keys (hash engine only)")
+var keepVersions = flag.Int("keep-versions", 0, "number of versions of a key kept in mvcc mode, 0 for unlimited")
+var keepFor = flag.Duration("keep-for", 0, "how long overwritten versions are kept in mvcc mode, 0 for unlimited")
+var maxKeySize = flag.Int("max-key-size", KB, "max key size in bytes, 0 for unlimited")
+var maxValueSize = flag.Int("max-value-size", 4*MB, "max value size in bytes, 0 for unlimited")
+var maxDiskSize = flag.Int64("max-disk-size", 0, "max size of the database directory with all the namespaces in bytes, 0 for unlimited")
+var binaryPort = flag.Int("binary-port", 0, "port of the binary protocol for the default namespace, 0 to disable")
+var respPort = flag.Int("resp-port", 0, "port of the Redis protocol for the default namespace, 0 to disable")
 
 func main() {
 	flag.Parse()
@@ -28,36 +48,139 @@ func main() {
 		log.Fatalf("error creating directory: %s", err)
 	}
 
-	db, err := datastore.NewDb(*path)
+	var quota *datastore.DiskQuota
+	if *maxDiskSize > 0 {
+		quota = datastore.NewDiskQuota(*maxDiskSize)
+	}
+	stores, err := openNamespaces(*path, flagOptions(), quota)
 	if err != nil {
 		log.Fatalf("error creating db: %s", err)
 	}
-	db.SegmentSize(int64(*segmentSize))
-	db.Start()
 
-	defer db.Close()
+	h := new(http.ServeMux)
+	h.Handle("/", newRouter(stores))
+	server := httptools.CreateServer(*port, h, httptools.DefaultTimeouts)
+	server.Start()
+
+	var binary *dbproto.Server
+	if *binaryPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *binaryPort))
+		if err != nil {
+			log.Fatalf("error listening for binary protocol: %s", err)
+		}
+		ns, _ := stores.get(defaultNamespace)
+		binary = dbproto.NewServer(ns.store)
+		go func() {
+			if err := binary.Serve(listener); err != nil {
+				log.Fatalf("Binary protocol server finished: %s", err)
+			}
+		}()
+	}
+	var redis *resp.Server
+	if *respPort != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *respPort))
+		if err != nil {
+			log.Fatalf("error listening for Redis protocol: %s", err)
+		}
+		ns, _ := stores.get(defaultNamespace)
+		redis = resp.NewServer(ns.store)
+		go func() {
+			if err := redis.Serve(listener); err != nil {
+				log.Fatalf("Redis protocol server finished: %s", err)
+			}
+		}()
+	}
+	signal.WaitForTerminationSignal()
+
+	// requests have to finish before the stores are closed
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping the server: %s", err)
+	}
+	if binary != nil {
+		binary.Close()
+	}
+	if redis != nil {
+		redis.Close()
+	}
+	if err := stores.Close(); err != nil {
+		log.Fatalf("error closing db: %s", err)
+	}
+}
+
+func newRouter(stores *namespaces) *mux.Router {
+	// keys may contain slashes, so the routes match the escaped path
+	r := mux.NewRouter().UseEncodedPath()
+	r.Use(unescapeVars)
+	handleNamespaces(r, stores)
+	handleAdmin(r, stores)
+	for _, prefix := range []string{"/db", "/db/{ns:" + namespacePattern + "}"} {
+		handleIndexes(r, prefix, stores)
+		handleWatch(r, prefix, stores)
+		handleHistory(r, prefix, stores)
+		handleTxn(r, prefix, stores)
+		handleStats(r, prefix, stores)
+		handleBulk(r, prefix, stores)
+		handleScan(r, prefix, stores)
+		handleKeys(r, prefix, stores)
+	}
+	return r
+}
+
+// Unescapes the path variables matched in the escaped path.
+func unescapeVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for name, value := range vars {
+			unescaped, err := url.PathUnescape(value)
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			vars[name] = unescaped
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+// Registers GET, POST and DELETE of prefix/{key}.
+func handleKeys(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/{key}", func(rw http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["key"]
 
 		log.Printf("GET %s", r.URL)
 
-		value, err := db.Get(key)
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+		value, version, err := getValue(db, key, r.URL.Query())
 
 		rw.Header().Set("content-type", "application/json")
 
-		if err != nil {
+		if err == datastore.ErrNotFound {
 			rw.WriteHeader(http.StatusNotFound)
+		} else if err == errBadVersion {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		} else if err == datastore.ErrVersioningDisabled {
+			http.Error(rw, err.Error(), http.StatusNotImplemented)
+		} else if err != nil {
+			log.Printf("Error reading %s: %s", key, err)
+			rw.WriteHeader(http.StatusInternalServerError)
 		} else {
+			etag := fmt.Sprintf(`"%d"`, version)
+			rw.Header().Set("etag", etag)
+			rw.Header().Set("x-version", strconv.FormatUint(version, 10))
+			if r.Header.Get("if-none-match") == etag {
+				rw.WriteHeader(http.StatusNotModified)
+				return
+			}
 
 			rw.WriteHeader(http.StatusOK)
 
-			res := struct {
-				Key   string `json:"key"`
-				Value string `json:"value"`
-			}{key, value}
+			res := record{key, value}
 			err := json.NewEncoder(rw).Encode(&res)
 
 			if err != nil {
@@ -66,33 +189,58 @@ func main() {
 		}
 	}).Methods("GET")
 
-	r.HandleFunc("/db/{key}", func(rw http.ResponseWriter, r *http.Request) {
+	r.HandleFunc(prefix+"/{key}", func(rw http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["key"]
 		log.Printf("POST %s", r.URL)
 
+		db, ok := stores.store(rw, r, true)
+		if !ok {
+			return
+		}
 		rw.Header().Set("content-type", "application/json")
 
+		data, err := readBody(r, maxBodySize(db.Usage().Limits))
+		if err != nil {
+			http.Error(rw, err.Error(), writeStatus(err))
+			return
+		}
 		var body struct {
 			Value string `json:"value"`
 		}
-		err := json.NewDecoder(r.Body).Decode(&body)
+		err = json.Unmarshal(data, &body)
 		if err != nil {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		err = db.Put(key, body.Value)
-		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
+		if status := writeStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error writing %s: %s", key, err)
+			rw.WriteHeader(status)
+		} else if err != nil {
+			http.Error(rw, err.Error(), status)
 		} else {
-			rw.WriteHeader(http.StatusOK)
+			rw.WriteHeader(status)
 		}
 
 	}).Methods("POST")
 
-	h := new(http.ServeMux)
-	h.Handle("/", r)
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	signal.WaitForTerminationSignal()
+	r.HandleFunc(prefix+"/{key}", func(rw http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		log.Printf("DELETE %s", r.URL)
+
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+		err := db.Delete(key)
+		if status := writeStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error deleting %s: %s", key, err)
+			rw.WriteHeader(status)
+		} else if err != nil {
+			http.Error(rw, err.Error(), status)
+		} else {
+			rw.WriteHeader(status)
+		}
+	}).Methods("DELETE")
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/teramont/go2-lab-2/dbclient"
+)
+
+func openTestServer(t *testing.T) (*namespaces, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores, err := openNamespaces(dir, nsOptions{Engine: "hash", SegmentSize: 10 * MB}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter(stores))
+	// the handlers log every request
+	log.SetOutput(ioutil.Discard)
+	return stores, server, func() {
+		log.SetOutput(os.Stderr)
+		server.Close()
+		stores.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Sends the request to the server, returns the status and the body.
+func do(t *testing.T, server *httptest.Server, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestKeys(t *testing.T) {
+	stores, server, stop := openTestServer(t)
+	defer stop()
+	if _, err := stores.create("a", stores.defaults); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// a key with a slash is not taken for the key b of the namespace a
+	client := dbclient.New(server.URL, dbclient.Options{})
+	defer client.Close()
+	if err := client.Put(ctx, "a/b", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get(ctx, "a/b"); err != nil || value != "1" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+	ns, _ := stores.get("a")
+	if _, err := ns.store.Get("b"); err == nil {
+		t.Errorf("Expected no key b in the namespace a")
+	}
+
+	nsClient := dbclient.New(server.URL, dbclient.Options{Namespace: "a"})
+	defer nsClient.Close()
+	if err := nsClient.Put(ctx, "b/c", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := nsClient.Get(ctx, "b/c"); err != nil || value != "2" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+	if err := nsClient.Delete(ctx, "b/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nsClient.Get(ctx, "b/c"); err != dbclient.ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+// Namespace of the routes without one. Its data is kept in the root of the
+// database directory, as it was before namespaces.
+const defaultNamespace = "default"
+
+// File in the namespace directory with its options
+const namespaceFile = "namespace.json"
+
+// Names starting with _ are left for the routes like /db/_index
+const namespacePattern = "[a-zA-Z0-9][a-zA-Z0-9_-]*"
+
+var namespaceName = regexp.MustCompile("^" + namespacePattern + "$")
+
+var errBadNamespace = fmt.Errorf("bad namespace name")
+var errNamespaceExists = fmt.Errorf("namespace already exists")
+var errNamespaceNotFound = fmt.Errorf("namespace does not exist")
+var errShuttingDown = fmt.Errorf("database is shutting down")
+
+// Options of a namespace. Zero fields, except mvcc and keepVersions, take the
+// values of the flags when the namespace is created by the admin API.
+type nsOptions struct {
+	Engine       string           `json:"engine,omitempty"`
+	SegmentSize  int64            `json:"segmentSize,omitempty"`
+	MVCC         bool             `json:"mvcc,omitempty"`
+	KeepVersions int              `json:"keepVersions,omitempty"`
+	KeepFor      string           `json:"keepFor,omitempty"`
+	Limits       datastore.Limits `json:"limits"`
+}
+
+func flagOptions() nsOptions {
+	opts := nsOptions{
+		Engine:       *engine,
+		SegmentSize:  int64(*segmentSize),
+		MVCC:         *mvcc,
+		KeepVersions: *keepVersions,
+		// -max-disk-size limits all the namespaces together, see namespaces
+		Limits: datastore.Limits{
+			MaxKeySize:   *maxKeySize,
+			MaxValueSize: *maxValueSize,
+		},
+	}
+	if *keepFor != 0 {
+		opts.KeepFor = keepFor.String()
+	}
+	return opts
+}
+
+// Fills zero fields with the defaults.
+func (opts nsOptions) withDefaults(defaults nsOptions) nsOptions {
+	if opts.Engine == "" {
+		opts.Engine = defaults.Engine
+	}
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = defaults.SegmentSize
+	}
+	if opts.KeepFor == "" {
+		opts.KeepFor = defaults.KeepFor
+	}
+	if opts.Limits == (datastore.Limits{}) {
+		opts.Limits = defaults.Limits
+	}
+	return opts
+}
+
+func openStore(dir string, opts nsOptions, quota *datastore.DiskQuota) (datastore.Store, error) {
+	var keep time.Duration
+	if opts.KeepFor != "" {
+		var err error
+		keep, err = time.ParseDuration(opts.KeepFor)
+		if err != nil {
+			return nil, fmt.Errorf("bad keepFor: %w", err)
+		}
+	}
+	switch opts.Engine {
+	case "hash":
+		return datastore.NewDbWithOptions(dir, datastore.Options{
+			SegmentSize:  opts.SegmentSize,
+			MVCC:         opts.MVCC,
+			KeepVersions: opts.KeepVersions,
+			KeepFor:      keep,
+			Limits:       opts.Limits,
+			Quota:        quota,
+		})
+	case "lsm":
+		db, err := datastore.NewLsmDb(dir)
+		if err != nil {
+			return nil, err
+		}
+		// segment size bounds the memtable and the sstables
+		return db.MemtableSize(opts.SegmentSize).Limits(opts.Limits).Quota(quota), nil
+	default:
+		return nil, fmt.Errorf("unknown engine %q", opts.Engine)
+	}
+}
+
+type namespace struct {
+	Name    string    `json:"name"`
+	Options nsOptions `json:"options"`
+	store   datastore.Store
+}
+
+// Namespaces are separate stores in the subdirectories of the database
+// directory. They are opened at startup and created by the admin API or by
+// the first write. The maxDiskSize of a namespace limits its own directory,
+// while the quota limits the whole database directory.
+type namespaces struct {
+	root     string
+	defaults nsOptions
+	quota    *datastore.DiskQuota // nil for no limit
+
+	mutex  sync.RWMutex
+	stores map[string]*namespace
+	closed bool
+}
+
+func openNamespaces(root string, defaults nsOptions, quota *datastore.DiskQuota) (*namespaces, error) {
+	n := &namespaces{
+		root:     root,
+		defaults: defaults,
+		quota:    quota,
+		stores:   make(map[string]*namespace),
+	}
+	err := n.open(defaultNamespace, root, defaults)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(root)
+	if err != nil {
+		n.Close()
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() || !namespaceName.MatchString(file.Name()) || file.Name() == defaultNamespace {
+			continue
+		}
+		dir := filepath.Join(root, file.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, namespaceFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		var opts nsOptions
+		if err == nil {
+			err = json.Unmarshal(data, &opts)
+		}
+		if err == nil {
+			err = n.open(file.Name(), dir, opts)
+		}
+		if err != nil {
+			n.Close()
+			return nil, fmt.Errorf("namespace %s: %w", file.Name(), err)
+		}
+	}
+	return n, nil
+}
+
+// Must be called with the mutex locked.
+func (n *namespaces) open(name, dir string, opts nsOptions) error {
+	store, err := openStore(dir, opts, n.quota)
+	if err != nil {
+		return err
+	}
+	store.Start()
+	n.stores[name] = &namespace{Name: name, Options: opts, store: store}
+	return nil
+}
+
+// Creates a namespace, zero options are taken from the flags.
+func (n *namespaces) create(name string, opts nsOptions) (*namespace, error) {
+	if !namespaceName.MatchString(name) {
+		return nil, errBadNamespace
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.closed {
+		return nil, errShuttingDown
+	}
+	if _, ok := n.stores[name]; ok {
+		return nil, errNamespaceExists
+	}
+
+	opts = opts.withDefaults(n.defaults)
+	dir := filepath.Join(n.root, name)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	// options are saved first, so the namespace is found again after restart
+	data, err := json.MarshalIndent(opts, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, namespaceFile), data, 0o600); err != nil {
+		return nil, err
+	}
+	if err := n.open(name, dir, opts); err != nil {
+		return nil, err
+	}
+	log.Printf("Created namespace %s", name)
+	return n.stores[name], nil
+}
+
+func (n *namespaces) get(name string) (*namespace, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	ns, ok := n.stores[name]
+	return ns, ok && !n.closed
+}
+
+func (n *namespaces) list() []*namespace {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	res := make([]*namespace, 0, len(n.stores))
+	for _, ns := range n.stores {
+		res = append(res, ns)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Returns the store of the namespace in the request path, or the default one
+// for the paths without it. With create set, a missing namespace is created,
+// otherwise the error response is written.
+func (n *namespaces) store(rw http.ResponseWriter, r *http.Request, create bool) (datastore.Store, bool) {
+	name, ok := mux.Vars(r)["ns"]
+	if !ok {
+		name = defaultNamespace
+	}
+	if ns, ok := n.get(name); ok {
+		return ns.store, true
+	}
+	if !create {
+		http.Error(rw, errNamespaceNotFound.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	ns, err := n.create(name, n.defaults)
+	if err == errNamespaceExists {
+		// created by a concurrent request
+		return n.store(rw, r, create)
+	} else if err == errShuttingDown {
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	} else if err != nil {
+		log.Printf("Error creating namespace %s: %s", name, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return ns.store, true
+}
+
+// Closes all the stores. Requests to them fail afterwards.
+func (n *namespaces) Close() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.closed = true
+	var res error
+	for name, ns := range n.stores {
+		if err := ns.store.Close(); err != nil {
+			log.Printf("Error closing namespace %s: %s", name, err)
+			res = err
+		}
+	}
+	return res
+}
+
+// Tells whether the first segment of the path after /db/ is an existing
+// namespace, so it is not taken for a key of the default namespace.
+func (n *namespaces) inPath(r *http.Request) bool {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"), "/", 2)
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return false
+	}
+	_, ok := n.get(name)
+	return ok
+}
+
+// Registers the admin API of the namespaces:
+// GET /db/_ns lists them, POST /db/_ns/{ns} creates one with the options in
+// the body, GET /db/_ns/{ns} returns its options.
+func handleNamespaces(r *mux.Router, n *namespaces) {
+	r.HandleFunc("/db/_ns", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(n.list()); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+
+	r.HandleFunc("/db/_ns/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["name"]
+		log.Printf("POST %s", r.URL)
+
+		var opts nsOptions
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.KeepFor != "" {
+			if _, err := time.ParseDuration(opts.KeepFor); err != nil {
+				http.Error(rw, "bad keepFor", http.StatusBadRequest)
+				return
+			}
+		}
+		if opts.Engine != "" && opts.Engine != "hash" && opts.Engine != "lsm" {
+			http.Error(rw, "unknown engine", http.StatusBadRequest)
+			return
+		}
+
+		switch _, err := n.create(name, opts); err {
+		case nil:
+			rw.WriteHeader(http.StatusCreated)
+		case errNamespaceExists:
+			rw.WriteHeader(http.StatusConflict)
+		case errBadNamespace:
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+		case errShuttingDown:
+			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		default:
+			log.Printf("Error creating namespace %s: %s", name, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}).Methods("POST")
+
+	r.HandleFunc("/db/_ns/{name}", func(rw http.ResponseWriter, r *http.Request) {
+		ns, ok := n.get(mux.Vars(r)["name"])
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(ns); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+}
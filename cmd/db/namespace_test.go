@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	_, server, stop := openTestServer(t)
+	defer stop()
+
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/db/_ns/users", `{"mvcc": true, "keepVersions": 2}`, http.StatusCreated},
+		{"POST", "/db/_ns/users", `{}`, http.StatusConflict},
+		{"POST", "/db/_ns/other", `{"engine": "btree"}`, http.StatusBadRequest},
+		{"POST", "/db/_ns/other", `{"keepFor": "forever"}`, http.StatusBadRequest},
+		{"POST", "/db/_ns/other", `{`, http.StatusBadRequest},
+		{"GET", "/db/_ns/missing", "", http.StatusNotFound},
+
+		{"POST", "/db/users/a", `{"value": "1"}`, http.StatusOK},
+		{"GET", "/db/users/a", "", http.StatusOK},
+		{"GET", "/db/a", "", http.StatusNotFound},
+		{"GET", "/db/missing/a", "", http.StatusNotFound},
+		{"DELETE", "/db/users/a", "", http.StatusOK},
+		{"GET", "/db/users/a", "", http.StatusNotFound},
+		// the first write creates the namespace
+		{"POST", "/db/created/a", `{"value": "1"}`, http.StatusOK},
+	} {
+		if status, body := do(t, server, c.method, c.path, c.body); status != c.status {
+			t.Errorf("%s %s: expected %d, got %d %s", c.method, c.path, c.status, status, body)
+		}
+	}
+
+	status, body := do(t, server, "GET", "/db/_ns/users", "")
+	var ns namespace
+	if err := json.Unmarshal([]byte(body), &ns); err != nil || status != http.StatusOK {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if ns.Name != "users" || !ns.Options.MVCC || ns.Options.KeepVersions != 2 {
+		t.Errorf("Got namespace %+v", ns)
+	}
+
+	var list []namespace
+	if _, body := do(t, server, "GET", "/db/_ns", ""); json.Unmarshal([]byte(body), &list) != nil {
+		t.Fatalf("Got %s", body)
+	}
+	var names []string
+	for _, ns := range list {
+		names = append(names, ns.Name)
+	}
+	if len(names) != 3 || names[0] != "created" || names[1] != defaultNamespace || names[2] != "users" {
+		t.Errorf("Got namespaces %v", names)
+	}
+}
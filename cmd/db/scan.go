@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+// Registers GET prefix/_keys?after=K&limit=N with up to N keys greater than
+// K in ascending order.
+func handleScan(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/_keys", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("GET %s", r.URL)
+
+		limit := 0
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit < 0 {
+				http.Error(rw, "bad limit", http.StatusBadRequest)
+				return
+			}
+		}
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+		scanner, ok := db.(datastore.Scanner)
+		if !ok {
+			http.Error(rw, "scan is not supported by the engine", http.StatusNotImplemented)
+			return
+		}
+
+		keys, err := scanner.Scan(r.URL.Query().Get("after"), limit)
+		if err != nil {
+			log.Printf("Error scanning keys: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(rw, http.StatusOK, keys)
+	}).Methods("GET")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+// Escaping may make a value in JSON up to 6 times longer, e.g. \u0000
+const jsonEscapeFactor = 6
+
+// Transaction body may hold this many values of the max size
+const txnBodyFactor = 16
+
+var errBodyTooLarge = fmt.Errorf("request body is too large")
+
+// Max size of the body with a single value, 0 if unlimited.
+func maxBodySize(limits datastore.Limits) int64 {
+	if limits.MaxValueSize == 0 {
+		return 0
+	}
+	return int64(limits.MaxValueSize)*jsonEscapeFactor + int64(limits.MaxKeySize) + KB
+}
+
+// Reads the request body, at most max bytes if max is not 0.
+func readBody(r *http.Request, max int64) ([]byte, error) {
+	if max == 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err == nil && int64(len(data)) > max {
+		return nil, errBodyTooLarge
+	}
+	return data, err
+}
+
+// Returns the status of a write which failed with err.
+func writeStatus(err error) int {
+	switch err {
+	case nil:
+		return http.StatusOK
+	case errBodyTooLarge, datastore.ErrKeyTooLarge, datastore.ErrValueTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case datastore.ErrDiskFull:
+		return http.StatusInsufficientStorage
+	case datastore.ErrConflict:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+type stats struct {
+	datastore.Usage
+	// Limit and size of the whole database directory
+	Total   *datastore.Usage    `json:"total,omitempty"`
+	Filters *datastore.LsmStats `json:"filters,omitempty"`
+}
+
+// Registers GET prefix/_stats with the limits and the usage of the store.
+func handleStats(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/_stats", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("GET %s", r.URL)
+
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+
+		res := stats{Usage: db.Usage()}
+		if stores.quota != nil {
+			total := stores.quota.Usage()
+			res.Total = &total
+		}
+		if lsm, ok := db.(*datastore.LsmDb); ok {
+			filters := lsm.Stats()
+			res.Filters = &filters
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(&res); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+}
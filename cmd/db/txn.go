@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+type txnRequest struct {
+	// versions of the keys the writes depend on, 0 for absent keys
+	Reads  map[string]uint64 `json:"reads"`
+	Writes []datastore.Write `json:"writes"`
+}
+
+// Registers POST prefix/_txn, which applies all the writes at once, or none
+// of them if any of the read keys has changed.
+func handleTxn(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/_txn", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("POST %s", r.URL)
+
+		db, ok := stores.store(rw, r, true)
+		if !ok {
+			return
+		}
+
+		data, err := readBody(r, maxBodySize(db.Usage().Limits)*txnBodyFactor)
+		if err != nil {
+			http.Error(rw, err.Error(), writeStatus(err))
+			return
+		}
+		var req txnRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, w := range req.Writes {
+			if w.Key == "" {
+				http.Error(rw, "empty key", http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = db.Apply(req.Reads, req.Writes)
+		if status := writeStatus(err); status == http.StatusInternalServerError {
+			log.Printf("Error applying transaction: %s", err)
+			rw.WriteHeader(status)
+		} else if err != nil {
+			http.Error(rw, err.Error(), status)
+		} else {
+			rw.WriteHeader(status)
+		}
+	}).Methods("POST")
+}
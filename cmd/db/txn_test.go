@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	stores, server, stop := openTestServer(t)
+	defer stop()
+	ns, _ := stores.get(defaultNamespace)
+
+	status, body := do(t, server, "POST", "/db/_txn", `{"reads": {"a": 0}, "writes": [
+		{"key": "a", "value": "1"}, {"key": "b", "value": "2"}, {"key": "c", "value": "3"}, {"key": "c", "delete": true}]}`)
+	if status != http.StatusOK {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if value, err := ns.store.Get("b"); err != nil || value != "2" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+	if _, err := ns.store.Get("c"); err == nil {
+		t.Errorf("Expected c to be deleted")
+	}
+
+	// a is not absent anymore
+	status, _ = do(t, server, "POST", "/db/_txn", `{"reads": {"a": 0}, "writes": [{"key": "b", "value": "x"}]}`)
+	if status != http.StatusConflict {
+		t.Errorf("Expected 409, got %d", status)
+	}
+	_, version, err := ns.store.GetVersion("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := fmt.Sprintf(`{"reads": {"a": %d}, "writes": [{"key": "b", "value": "x"}]}`, version)
+	if status, body := do(t, server, "POST", "/db/_txn", txn); status != http.StatusOK {
+		t.Errorf("Got %d %s", status, body)
+	}
+	if value, err := ns.store.Get("b"); err != nil || value != "x" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+
+	for _, bad := range []string{
+		`{"writes": [{"key": "", "value": "1"}]}`,
+		`{"writes": `,
+	} {
+		if status, _ := do(t, server, "POST", "/db/_txn", bad); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", bad, status)
+		}
+	}
+}
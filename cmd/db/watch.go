@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+// Long poll has to finish before the server's write timeout
+const defaultPollTimeout = 5 * time.Second
+const maxPollTimeout = 8 * time.Second
+
+// Max number of events in one response
+const maxPollEvents = 1000
+
+// Registers the long poll endpoint for the changes:
+// GET prefix/_watch?prefix=...&since=seq&timeout=seconds
+// It responds as soon as there are changes after the sequence number, or with
+// no events after the timeout. Sequence number in the response is the one to
+// poll from next time.
+func handleWatch(r *mux.Router, prefix string, stores *namespaces) {
+	r.HandleFunc(prefix+"/_watch", func(rw http.ResponseWriter, r *http.Request) {
+		log.Printf("GET %s", r.URL)
+
+		db, ok := stores.store(rw, r, false)
+		if !ok {
+			return
+		}
+		watchable, ok := db.(datastore.Watchable)
+		if !ok {
+			http.Error(rw, "watching is not supported by the engine", http.StatusNotImplemented)
+			return
+		}
+		query := r.URL.Query()
+
+		timeout := defaultPollTimeout
+		if s := query.Get("timeout"); s != "" {
+			sec, err := strconv.Atoi(s)
+			if err != nil || sec < 0 {
+				http.Error(rw, "bad timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(sec) * time.Second
+			if timeout > maxPollTimeout {
+				timeout = maxPollTimeout
+			}
+		}
+
+		var watcher *datastore.Watcher
+		if s := query.Get("since"); s != "" {
+			since, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				http.Error(rw, "bad since", http.StatusBadRequest)
+				return
+			}
+			watcher, err = watchable.WatchFrom(query.Get("prefix"), since)
+			if err == datastore.ErrSeqUnavailable {
+				// client has to read the current state again
+				http.Error(rw, err.Error(), http.StatusGone)
+				return
+			}
+		} else {
+			watcher = watchable.Watch(query.Get("prefix"))
+		}
+		defer watcher.Close()
+
+		res := struct {
+			Events []datastore.ChangeEvent `json:"events"`
+			Seq    uint64                  `json:"seq"`
+		}{
+			Events: []datastore.ChangeEvent{},
+			Seq:    watcher.StartSeq,
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case e, ok := <-watcher.Events:
+			if ok {
+				res.Events = append(res.Events, e)
+			}
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+		// take whatever else is ready without waiting
+	drain:
+		for len(res.Events) > 0 && len(res.Events) < maxPollEvents {
+			select {
+			case e, ok := <-watcher.Events:
+				if !ok {
+					break drain
+				}
+				res.Events = append(res.Events, e)
+			default:
+				break drain
+			}
+		}
+		if n := len(res.Events); n > 0 {
+			res.Seq = res.Events[n-1].Seq
+		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(rw).Encode(&res); err != nil {
+			log.Printf("Error while serving request: %s", err)
+		}
+	}).Methods("GET")
+}
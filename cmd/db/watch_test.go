@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+type pollResponse struct {
+	Events []datastore.ChangeEvent `json:"events"`
+	Seq    uint64                  `json:"seq"`
+}
+
+func poll(t *testing.T, server *httptest.Server, path string) pollResponse {
+	status, body := do(t, server, "GET", path, "")
+	var res pollResponse
+	if status != http.StatusOK || json.Unmarshal([]byte(body), &res) != nil {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	return res
+}
+
+func TestWatch(t *testing.T) {
+	stores, server, stop := openTestServer(t)
+	defer stop()
+	ns, _ := stores.get(defaultNamespace)
+
+	// nothing happens within the timeout
+	start := poll(t, server, "/db/_watch?timeout=0")
+	if len(start.Events) != 0 {
+		t.Errorf("Expected no events, got %v", start.Events)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ns.store.Put("other", "0")
+		ns.store.Put("user1", "1")
+	}()
+	res := poll(t, server, fmt.Sprintf("/db/_watch?prefix=user&since=%d&timeout=5", start.Seq))
+	if len(res.Events) != 1 || res.Events[0].Key != "user1" || res.Events[0].Value != "1" {
+		t.Fatalf("Got events %v", res.Events)
+	}
+
+	// the changes after the sequence number are delivered at once
+	ns.store.Put("user2", "2")
+	ns.store.Delete("user1")
+	res = poll(t, server, fmt.Sprintf("/db/_watch?prefix=user&since=%d", res.Seq))
+	if len(res.Events) != 2 || res.Events[0].Key != "user2" || res.Events[1].Op != datastore.OpDelete {
+		t.Errorf("Got events %v", res.Events)
+	}
+
+	for _, bad := range []string{"timeout=-1", "timeout=x", "since=x"} {
+		if status, _ := do(t, server, "GET", "/db/_watch?"+bad, ""); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", bad, status)
+		}
+	}
+	if status, _ := do(t, server, "GET", "/db/_watch?since=1000", ""); status != http.StatusGone {
+		t.Errorf("Expected 410, got %d", status)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+const usage = `Usage: dbtool <command> [flags] <args>
+
+Works with the data directory of the hash engine while the db is stopped.
+
+Commands:
+  dump <dir>             print keys and values as JSON lines
+  verify <dir>           check the checksums of all the entries
+  repair <dir> <newdir>  copy the intact entries into a new directory
+  compact [-keep-versions N] [-keep-for D] <dir>
+                         merge the segments
+  migrate <dir> <newdir> convert the data written before the format file was
+                         added into a new directory
+  import [-batch N] [-keep-versions N] [-keep-for D] <dir> [file]
+                         load JSON lines {"key": ..., "value": ...} from the
+                         file or the standard input, {"key": ..., "delete": true}
+                         deletes the key
+
+The directories written in MVCC mode are opened in it and keep all the
+versions, unless -keep-versions or -keep-for limit them as the db flags do.
+`
+
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	commands := map[string]func(args []string) error{
+		"dump":    dump,
+		"verify":  verify,
+		"repair":  repair,
+		"compact": compact,
+		"import":  importRecords,
+		"migrate": migrate,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := command(flag.Args()[1:]); err != nil {
+		log.Fatalf("%s: %s", flag.Arg(0), err)
+	}
+}
+
+// Parses the flags of the command and checks the number of the arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) []string {
+	fs.Usage = flag.Usage
+	// flag set exits on errors
+	fs.Parse(args)
+	if fs.NArg() < min || fs.NArg() > max {
+		flag.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func dump(args []string) error {
+	args = parseArgs(flag.NewFlagSet("dump", flag.ExitOnError), args, 1, 1)
+	out := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(out)
+	err := datastore.Dump(args[0], func(key, value string) error {
+		return encoder.Encode(record{key, value})
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Prints the checks and returns an error if any of the segments is damaged.
+func report(checks []datastore.SegmentCheck) error {
+	damaged := 0
+	for _, check := range checks {
+		status := "ok"
+		if !check.OK() {
+			status = "damaged"
+			damaged++
+		}
+		fmt.Printf("%s: %d entries, %s\n", check.Name, check.Entries, status)
+		for _, offset := range check.Corrupt {
+			fmt.Printf("  bad checksum at offset %d\n", offset)
+		}
+		if check.Error != "" {
+			fmt.Printf("  %s at offset %d, the rest is unreadable\n", check.Error, check.ErrorOffset)
+		}
+	}
+	if damaged > 0 {
+		return fmt.Errorf("%d of %d segments are damaged", damaged, len(checks))
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	args = parseArgs(flag.NewFlagSet("verify", flag.ExitOnError), args, 1, 1)
+	checks, err := datastore.VerifyDir(args[0])
+	if err != nil {
+		return err
+	}
+	return report(checks)
+}
+
+func repair(args []string) error {
+	args = parseArgs(flag.NewFlagSet("repair", flag.ExitOnError), args, 2, 2)
+	checks, err := datastore.Repair(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if err := report(checks); err != nil {
+		log.Printf("%s, intact entries are copied to %s", err, args[1])
+	}
+	return nil
+}
+
+// Flags of the retention of the versions in MVCC mode.
+type versionFlags struct {
+	keepVersions *int
+	keepFor      *time.Duration
+}
+
+func addVersionFlags(fs *flag.FlagSet) versionFlags {
+	return versionFlags{
+		keepVersions: fs.Int("keep-versions", 0, "number of versions of a key kept in mvcc mode, 0 for unlimited"),
+		keepFor:      fs.Duration("keep-for", 0, "how long overwritten versions are kept in mvcc mode, 0 for unlimited"),
+	}
+}
+
+// Opens the db in the mode its directory was written in.
+func (f versionFlags) open(dir string) (*datastore.Db, error) {
+	mvcc, err := datastore.IsMVCC(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !mvcc && (*f.keepVersions != 0 || *f.keepFor != 0) {
+		return nil, fmt.Errorf("-keep-versions and -keep-for require a directory written in mvcc mode")
+	}
+	return datastore.NewDbWithOptions(dir, datastore.Options{
+		MVCC:         mvcc,
+		KeepVersions: *f.keepVersions,
+		KeepFor:      *f.keepFor,
+	})
+}
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	versions := addVersionFlags(fs)
+	args = parseArgs(fs, args, 1, 1)
+	db, err := versions.open(args[0])
+	if err != nil {
+		return err
+	}
+	db.Start()
+	err = db.Compact()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func migrate(args []string) error {
+	args = parseArgs(flag.NewFlagSet("migrate", flag.ExitOnError), args, 2, 2)
+	n, err := datastore.Migrate(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	log.Printf("converted %d entries", n)
+	return nil
+}
+
+func importRecords(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	batchSize := fs.Int("batch", 1000, "number of records written at once")
+	versions := addVersionFlags(fs)
+	args = parseArgs(fs, args, 1, 2)
+	if *batchSize <= 0 {
+		fmt.Fprintln(os.Stderr, "-batch must be positive")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	in := io.Reader(os.Stdin)
+	if len(args) == 2 {
+		file, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	db, err := versions.open(args[0])
+	if err != nil {
+		return err
+	}
+	db.Start()
+	n, err := datastore.Import(db, in, *batchSize)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	log.Printf("imported %d records", n)
+	return err
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How often a drained backend is checked for the finished requests
+const drainPollInterval = 100 * time.Millisecond
+
+type backendStatus struct {
+	BackendConfig
+	Alive       bool   `json:"alive"`
+	Ejected     bool   `json:"ejected"`
+	Breaker     string `json:"breaker"`
+	Connections uint64 `json:"connections"`
+}
+
+func statusOf(b *backend) backendStatus {
+	return backendStatus{
+		BackendConfig: b.config(),
+		Alive:         b.isAlive(),
+		Ejected:       b.ejected(time.Now()),
+		Breaker:       b.breaker.current(breakers, time.Now()).String(),
+		Connections:   b.activeConnections(),
+	}
+}
+
+func statuses(p *pool) []backendStatus {
+	backends := p.backends()
+	res := make([]backendStatus, 0, len(backends))
+	for _, b := range backends {
+		res = append(res, statusOf(b))
+	}
+	return res
+}
+
+// Registers GET /lb/status, which lists the backends with their health,
+// breakers and connections. It requires the admin token.
+func handleStatus(h *http.ServeMux, p *pool, token string) {
+	h.Handle("/lb/status", authorized(token, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, http.StatusOK, statuses(p))
+	})))
+}
+
+// Registers the admin API of the pool, all the requests must have the
+// "Authorization: Bearer <token>" header:
+// GET /lb/backends lists the backends with their health and connections,
+// POST /lb/backends adds the backend from the body, e.g. {"url": "server4:8080"},
+// DELETE /lb/backends/{url} removes the backend and waits up to drainTimeout
+// for its requests to finish.
+func handleAdmin(h *http.ServeMux, p *pool, token string, drainTimeout time.Duration) {
+	h.Handle("/lb/backends", authorized(token, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(rw, http.StatusOK, statuses(p))
+		case "POST":
+			var config BackendConfig
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := (Config{Backends: []BackendConfig{config}}).validate(); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b, created := p.add(config)
+			log.Printf("Backend %s registered", config.Url)
+			status := http.StatusOK
+			if created {
+				status = http.StatusCreated
+				// it takes the traffic as soon as it's healthy
+				probe(b, healthChecks)
+			}
+			writeJSON(rw, status, statusOf(b))
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})))
+
+	h.Handle("/lb/backends/", authorized(token, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		url := strings.TrimPrefix(r.URL.Path, "/lb/backends/")
+		b, ok := p.remove(url)
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Printf("Backend %s deregistered, draining", url)
+		res := struct {
+			backendStatus
+			Drained bool `json:"drained"`
+		}{}
+		res.Drained = drain(r, b, drainTimeout)
+		res.backendStatus = statusOf(b)
+		writeJSON(rw, http.StatusOK, res)
+	})))
+}
+
+// Waits for the requests forwarded to the server to finish. Returns false if
+// they didn't in time.
+func drain(r *http.Request, b *backend, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for b.activeConnections() > 0 {
+		select {
+		case <-deadline.C:
+			return false
+		case <-r.Context().Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func authorized(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("authorization")
+		given := strings.TrimPrefix(header, "Bearer ")
+		if given == header || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			rw.Header().Set("www-authenticate", "Bearer")
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+func writeJSON(rw http.ResponseWriter, status int, res interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Printf("Error while serving request: %s", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestAdmin(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendUrl := strings.TrimPrefix(backend.URL, "http://")
+
+	p := &pool{}
+	p.set(configOf([]string{"a:80"}).Backends)
+	h := new(http.ServeMux)
+	handleAdmin(h, p, "secret", time.Second)
+	admin := httptest.NewServer(h)
+	defer admin.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		c.Assert(err, IsNil)
+		if token != "" {
+			req.Header.Set("authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	c.Assert(do("GET", "/lb/backends", "", "").StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(do("GET", "/lb/backends", "wrong", "").StatusCode, Equals, http.StatusUnauthorized)
+
+	resp := do("POST", "/lb/backends", "secret", `{"url": "`+backendUrl+`", "weight": 2}`)
+	c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	resp = do("POST", "/lb/backends", "secret", `{"url": "`+backendUrl+`", "weight": 3}`)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(do("POST", "/lb/backends", "secret", `{"weight": 3}`).StatusCode, Equals, http.StatusBadRequest)
+
+	var list []backendStatus
+	resp = do("GET", "/lb/backends", "secret", "")
+	c.Assert(json.NewDecoder(resp.Body).Decode(&list), IsNil)
+	c.Assert(list, HasLen, 2)
+	c.Assert(list[1].Url, Equals, backendUrl)
+	c.Assert(list[1].Weight, Equals, 3)
+	c.Assert(list[1].Alive, Equals, true)
+
+	// registered backends survive the reload of the config
+	p.set(configOf([]string{"b:80"}).Backends)
+	c.Assert(p.snapshot(), HasLen, 2)
+
+	// the request is answered when the backend finishes its requests
+	release := p.backends()[1].acquire()
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		release()
+	}()
+	start := time.Now()
+	resp = do("DELETE", "/lb/backends/"+backendUrl, "secret", "")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(time.Since(start) >= 200*time.Millisecond, Equals, true)
+	var res struct {
+		Drained bool `json:"drained"`
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&res), IsNil)
+	c.Assert(res.Drained, Equals, true)
+	c.Assert(p.snapshot(), HasLen, 1)
+
+	c.Assert(do("DELETE", "/lb/backends/"+backendUrl, "secret", "").StatusCode, Equals, http.StatusNotFound)
+}
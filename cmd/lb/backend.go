@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Weight of the last response time in the moving average
+const latencyAlpha = 0.3
+
+// backend is the live state of a server of the pool, shared by the forwarded
+// requests, the health checks and the admin API. The strategies see its
+// snapshots.
+type backend struct {
+	// 64-bit atomic fields go first to be aligned on 32-bit platforms
+	connections uint64
+	latencyBits uint64 // moving average of the response time in nanoseconds
+	alive       int32
+
+	url     string
+	health  healthState
+	breaker breaker
+
+	mutex        sync.RWMutex // guards the config, which is replaced on reload
+	weight       int
+	metadata     map[string]string
+	healthPath   string
+	healthStatus int
+}
+
+func newBackend(config BackendConfig) *backend {
+	b := &backend{url: config.Url}
+	b.breaker.url = config.Url
+	b.setConfig(config)
+	return b
+}
+
+func (b *backend) setConfig(config BackendConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.weight = config.Weight
+	b.metadata = config.Metadata
+	b.healthPath = config.HealthPath
+	b.healthStatus = config.HealthStatus
+}
+
+func (b *backend) config() BackendConfig {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return BackendConfig{
+		Url:          b.url,
+		Weight:       b.weight,
+		Metadata:     b.metadata,
+		HealthPath:   b.healthPath,
+		HealthStatus: b.healthStatus,
+	}
+}
+
+func (b *backend) isAlive() bool {
+	return atomic.LoadInt32(&b.alive) == 1
+}
+
+func (b *backend) setAlive(alive bool) {
+	value := int32(0)
+	if alive {
+		value = 1
+	}
+	atomic.StoreInt32(&b.alive, value)
+}
+
+// Counts a request forwarded to the backend until release is called. Extra
+// calls of release are ignored, so it may be both deferred and called early.
+func (b *backend) acquire() (release func()) {
+	atomic.AddUint64(&b.connections, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			atomic.AddUint64(&b.connections, ^uint64(0))
+		})
+	}
+}
+
+func (b *backend) activeConnections() uint64 {
+	return atomic.LoadUint64(&b.connections)
+}
+
+// Records the response time of the backend.
+func (b *backend) observeLatency(d time.Duration) {
+	for {
+		old := atomic.LoadUint64(&b.latencyBits)
+		ewma := float64(d)
+		if old != 0 {
+			ewma = latencyAlpha*float64(d) + (1-latencyAlpha)*math.Float64frombits(old)
+		}
+		if atomic.CompareAndSwapUint64(&b.latencyBits, old, math.Float64bits(ewma)) {
+			return
+		}
+	}
+}
+
+// Moving average of the response time, 0 if unknown.
+func (b *backend) latency() time.Duration {
+	return time.Duration(math.Float64frombits(atomic.LoadUint64(&b.latencyBits)))
+}
+
+func (b *backend) snapshot() *Server {
+	now := time.Now()
+	config := b.config()
+	return &Server{
+		Url:         b.url,
+		Alive:       b.isAlive() && !b.ejected(now) && b.breaker.available(breakers, now),
+		Connections: b.activeConnections(),
+		Weight:      config.Weight,
+		Metadata:    config.Metadata,
+		Latency:     b.latency(),
+		backend:     b,
+	}
+}
@@ -4,38 +4,107 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"os"
 	"time"
 
 	"github.com/teramont/go2-lab-2/httptools"
 	"github.com/teramont/go2-lab-2/signal"
 )
 
+// Server is a snapshot of a backend taken for choosing the one to forward a
+// request to.
 type Server struct {
 	Url         string
 	Alive       bool
 	Connections uint64
+	Weight      int
+	Metadata    map[string]string
+	// Moving average of the response time, 0 if unknown
+	Latency time.Duration
+
+	backend *backend
+}
+
+// Weight of the server, 1 if not set.
+func (s *Server) weight() uint64 {
+	if s.Weight <= 0 {
+		return 1
+	}
+	return uint64(s.Weight)
 }
 
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
-	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
+	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds, until the response header")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	configPath   = flag.String("config", "", "JSON file with the backends, reloaded on SIGHUP and when changed")
+	adminToken   = flag.String("admin-token", os.Getenv("LB_ADMIN_TOKEN"), "token of the /lb/ admin API, which is disabled if empty")
+	drainTimeout = flag.Duration("drain-timeout", 5*time.Second, "how long a removed backend is waited for to finish its requests")
+	strategyName = flag.String("strategy", strategyLeastConnections, "balancing strategy: least-connections, round-robin, "+
+		"weighted-round-robin, random-two, consistent-hash or least-latency")
+	hashKey     = flag.String("hash-key", "ip", "key of the consistent hashing: ip, header:<name> or cookie:<name>")
+	stickySpec  = flag.String("sticky", "", "sticky sessions: cookie, cookie:<name> or header:<name>; disabled if empty")
+	stickyTTL   = flag.Duration("sticky-ttl", 30*time.Minute, "how long an idle session stays on its backend")
+	stickyLimit = flag.Int("sticky-max", 100000, "maximum number of the sticky sessions, the least recently used are dropped")
+	backends    stringList
+
+	healthInterval     = flag.Duration("health-interval", healthChecks.interval, "interval of the health checks")
+	healthTimeout      = flag.Duration("health-timeout", healthChecks.timeout, "timeout of a health check")
+	healthyThreshold   = flag.Int("healthy-threshold", healthChecks.healthyThreshold, "successful health checks in a row to mark a backend alive")
+	unhealthyThreshold = flag.Int("unhealthy-threshold", healthChecks.unhealthyThreshold, "failed health checks in a row to mark a backend dead")
+	ejectAfter         = flag.Int("eject-after", outliers.failures, "5xx responses or connection errors in a row to eject a backend; 0 disables ejection")
+	ejectBackoff       = flag.Duration("eject-backoff", outliers.backoff, "duration of the first ejection, doubled for every next one")
+	maxEjectBackoff    = flag.Duration("max-eject-backoff", outliers.maxBackoff, "maximum duration of an ejection")
+
+	retryAttempts = flag.Int("retries", retries.attempts, "retries of a failed idempotent request on other backends")
+	tryTimeout    = flag.Duration("try-timeout", retries.tryTimeout, "timeout of a single try of a request until the response header; 0 means the whole request timeout")
+	retryBody     = flag.Int64("retry-max-body", retries.maxBody, "largest request body in bytes buffered to be retried")
+	retryRatio    = flag.Float64("retry-budget", retries.budget.ratio, "retries allowed per request on average")
+
+	breakerErrorRate   = flag.Float64("breaker-error-rate", breakers.errorRate, "share of failed requests which opens the circuit breaker of a backend; 0 disables it")
+	breakerLatency     = flag.Duration("breaker-latency", breakers.latency, "mean response time which opens the circuit breaker of a backend; 0 disables it")
+	breakerWindow      = flag.Duration("breaker-window", breakers.window, "window of the requests counted by the circuit breakers")
+	breakerMinRequests = flag.Int("breaker-min-requests", breakers.minRequests, "requests within the window before a circuit breaker may open")
+	breakerOpenTimeout = flag.Duration("breaker-open-timeout", breakers.openTimeout, "how long a circuit breaker stays open before the trial requests")
+	breakerTrials      = flag.Int("breaker-trials", breakers.trials, "successful trial requests which close a circuit breaker")
+)
+
+var (
+	tlsPort     = flag.Int("tls-port", 8443, "port of the TLS frontend, which is served if -tls-cert is set")
+	h2cEnabled  = flag.Bool("h2c", false, "whether the plain frontend serves HTTP/2 without TLS to the clients which ask for it")
+	tlsCerts    stringList
+	tlsKeys     stringList
+	backendCA   = flag.String("backend-ca", "", "PEM file with the CAs of the backend certificates; the system ones are used if empty")
+	backendCert = flag.String("backend-cert", "", "PEM file with the client certificate presented to the backends over HTTPS")
+	backendKey  = flag.String("backend-key", "", "PEM file with the key of -backend-cert")
 )
 
+func init() {
+	flag.Var(&backends, "backend", "backend address, may be repeated; ignored if -config is set")
+	flag.Var(&tlsCerts, "tls-cert", "PEM file with a certificate of the TLS frontend, may be repeated for SNI; reloaded when changed")
+	flag.Var(&tlsKeys, "tls-key", "PEM file with the key of the -tls-cert at the same position")
+}
+
 var (
 	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []Server{
-		Server{Url: "server1:8080", Alive: false, Connections: 0},
-		Server{Url: "server2:8080", Alive: false, Connections: 0},
-		Server{Url: "server3:8080", Alive: false, Connections: 0},
-	}
+	serversPool = &pool{}
 )
 
+// The proxied responses and the upgraded connections of the frontends last as
+// long as they take, so only the request header has a deadline. The request
+// bodies must make progress within bodyTimeout.
+var frontendTimeouts = httptools.Timeouts{
+	ReadHeader: 10 * time.Second,
+	Idle:       time.Minute,
+}
+
+const bodyTimeout = 10 * time.Second
+
 func scheme() string {
 	if *https {
 		return "https"
@@ -43,98 +112,309 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
-	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
+// Forwards the request to the server, which must send the response header
+// before the deadline. If it fails and canRetry is set nothing is written and
+// true is returned, so the request may be sent to another server.
+func forward(server *backend, rw http.ResponseWriter, r *http.Request, deadline time.Time, canRetry bool) (retry bool) {
+	// the request is counted until it's done, even if the client is gone or
+	// the handler panics
+	release := server.acquire()
+	defer release()
+	dst := server.url
+	if !server.breaker.allow(breakers, time.Now()) {
+		log.Printf("Breaker of %s is open", dst)
+		if canRetry {
+			return true
+		}
+		rw.WriteHeader(http.StatusServiceUnavailable)
 		return false
 	}
-	if resp.StatusCode != http.StatusOK {
-		return false
+	// the deadline applies until the response header arrives, then the body
+	// or the upgraded connection lasts as long as it takes
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := time.AfterFunc(time.Until(deadline), cancel)
+	defer timer.Stop()
+
+	start := time.Now()
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = scheme()
+			req.URL.Host = dst
+			req.Host = dst
+			if r.GetBody != nil {
+				req.Body, _ = r.GetBody()
+			}
+			// X-Forwarded-For is added by the proxy
+			req.Header.Set("x-forwarded-proto", forwardedProto(r))
+		},
+		Transport:     transport,
+		FlushInterval: flushInterval,
+		BufferPool:    buffers,
+		ModifyResponse: func(resp *http.Response) error {
+			timer.Stop()
+			ok := resp.StatusCode < 500
+			server.observeResponse(ok, outliers, time.Now())
+			server.breaker.record(ok, time.Since(start), breakers, time.Now())
+			server.observeLatency(time.Since(start))
+			if until, ok := retryAfter(resp, time.Now()); ok {
+				server.pause(until)
+			}
+			if canRetry && retryableStatus(resp.StatusCode) {
+				log.Println("retry", resp.StatusCode, resp.Request.URL)
+				retry = true
+				return errRetry
+			}
+			if *traceEnabled {
+				resp.Header.Set("lb-from", fmt.Sprintf("%s; breaker=%s", dst, server.breaker.current(breakers, time.Now())))
+			}
+			log.Println("fwd", resp.StatusCode, resp.Request.URL)
+			return nil
+		},
+		ErrorHandler: func(rw http.ResponseWriter, _ *http.Request, err error) {
+			if retry {
+				// the response is dropped by ModifyResponse
+				return
+			}
+			clientGone := r.Context().Err() != nil
+			if clientGone {
+				// the requests cancelled by the client don't count against
+				// the backend
+				server.breaker.cancel()
+			} else {
+				server.observeResponse(false, outliers, time.Now())
+				server.breaker.record(false, time.Since(start), breakers, time.Now())
+			}
+			log.Printf("Failed to get response from %s: %s", dst, err)
+			if canRetry && !clientGone {
+				retry = true
+				return
+			}
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		},
+	}
+	// the proxy aborts the response if its body fails after the header is
+	// written
+	proxy.ServeHTTP(rw, r.WithContext(ctx))
+	return retry
+}
+
+// Returns the alive server with the least connections per weight, or -1 if
+// there are none.
+func chooseServer(pool []*Server) int {
+	res := -1
+	for i, s := range pool {
+		if !s.Alive {
+			continue
+		}
+		if res < 0 || lessLoaded(s, pool[res]) {
+			res = i
+		}
 	}
-	return true
+	return res
 }
 
-func forward(server int, rw http.ResponseWriter, r *http.Request) error {
-	serversPool[server].Connections++
-	dst := serversPool[server].Url
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
-	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
-	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
-
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
+// Forwards the requests to the backends of the pool chosen by the strategy.
+// The sessions are kept on their backends if sticky is not nil.
+func balance(p *pool, strategy Strategy, sticky *affinity) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		servers := p.snapshot()
+		var i int
+		if sticky != nil {
+			var err error
+			if i, err = sticky.choose(servers, strategy, rw, r); err != nil {
+				log.Printf("Failed to start session: %s", err)
 			}
+		} else {
+			i = strategy.Choose(servers, r)
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+		if i < 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
-		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+		if r.Body != nil && r.Body != http.NoBody {
+			// the handler must not change the request, so it's changed in a copy
+			r = r.WithContext(r.Context())
+			r.Body = httptools.ProgressBody(r, bodyTimeout)
 		}
-		serversPool[server].Connections--
-		return nil
-	} else {
-		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		serversPool[server].Connections--
-		return err
-	}
+		dispatch(p, strategy, servers, i, rw, r)
+	})
 }
 
-func chooseServer(pool []Server) int {
-	res := 0
-	alive := 0
-	for i := range pool {
-		if pool[i].Alive {
-			alive++
-			if pool[i].Connections < pool[res].Connections {
-				res = i
+// Forwards the request to the chosen server. The idempotent requests are
+// retried on other servers while the budget allows.
+func dispatch(p *pool, strategy Strategy, servers []*Server, i int, rw http.ResponseWriter, r *http.Request) {
+	deadline := time.Now().Add(timeout)
+	replayable := false
+	if retries.attempts > 0 && idempotent(r.Method) {
+		retries.budget.deposit()
+		// the handler must not change the request, so it's changed in a copy
+		r = r.Clone(r.Context())
+		var err error
+		if replayable, err = bufferBody(r, retries.maxBody); err != nil {
+			log.Printf("Failed to read request body: %s", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	tried := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		server := servers[i]
+		tried[server.Url] = true
+		tryDeadline := deadline
+		if retries.tryTimeout > 0 && time.Now().Add(retries.tryTimeout).Before(deadline) {
+			tryDeadline = time.Now().Add(retries.tryTimeout)
+		}
+		canRetry := replayable && attempt < retries.attempts &&
+			untried(servers, tried) && retries.budget.withdraw()
+		if !forward(server.backend, rw, r, tryDeadline, canRetry) {
+			if canRetry {
+				retries.budget.refund()
+			}
+			return
+		}
+		// the health of the servers may have changed meanwhile
+		servers = p.snapshot()
+		for _, s := range servers {
+			if tried[s.Url] {
+				s.Alive = false
 			}
 		}
+		if i = strategy.Choose(servers, r); i < 0 || !time.Now().Before(deadline) {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 	}
-	if alive == 0 {
-		return -1
-	} else {
-		return res
+}
+
+// Reports whether there are alive servers which weren't tried.
+func untried(servers []*Server, tried map[string]bool) bool {
+	for _, s := range servers {
+		if s.Alive && !tried[s.Url] {
+			return true
+		}
 	}
+	return false
 }
 
 func main() {
 	flag.Parse()
+	timeout = time.Duration(*timeoutSec) * time.Second
+	healthChecks = healthConfig{
+		interval:           *healthInterval,
+		timeout:            *healthTimeout,
+		healthyThreshold:   *healthyThreshold,
+		unhealthyThreshold: *unhealthyThreshold,
+	}
+	if err := healthChecks.validate(); err != nil {
+		log.Fatal(err)
+	}
+	outliers = outlierConfig{failures: *ejectAfter, backoff: *ejectBackoff, maxBackoff: *maxEjectBackoff}
+	if err := outliers.validate(); err != nil {
+		log.Fatal(err)
+	}
+	retries = retryConfig{
+		attempts:   *retryAttempts,
+		tryTimeout: *tryTimeout,
+		maxBody:    *retryBody,
+		budget:     newRetryBudget(*retryRatio),
+	}
+	if err := retries.validate(); err != nil {
+		log.Fatal(err)
+	}
+	breakers = breakerConfig{
+		errorRate:   *breakerErrorRate,
+		latency:     *breakerLatency,
+		window:      *breakerWindow,
+		minRequests: *breakerMinRequests,
+		openTimeout: *breakerOpenTimeout,
+		trials:      *breakerTrials,
+	}
+	if err := breakers.validate(); err != nil {
+		log.Fatal(err)
+	}
 
-	for i := range serversPool {
-		i := i
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				serversPool[i].Alive = health(serversPool[i].Url)
+	strategy, err := newStrategy(*strategyName, *hashKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var sticky *affinity
+	if *stickySpec != "" {
+		if sticky, err = newAffinity(*stickySpec, *stickyTTL, *stickyLimit); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// the backends are probed as soon as they are added to the pool, and the
+	// transport takes its TLS config with the first request
+	if *backendCA != "" || *backendCert != "" {
+		if !*https {
+			log.Fatal("-backend-ca and -backend-cert require -https")
+		}
+		var client *certificates
+		if *backendCert != "" {
+			if client, err = loadCertificates([]string{*backendCert}, []string{*backendKey}); err != nil {
+				log.Fatalf("Error loading backend certificate: %s", err)
 			}
-		}()
+			go watchCertificates(client, configPollInterval, nil)
+		}
+		if transport.TLSClientConfig, err = backendTLS(*backendCA, client); err != nil {
+			log.Fatalf("Error loading backend CA: %s", err)
+		}
 	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		i := chooseServer(serversPool)
-		if i < 0 {
-			rw.WriteHeader(http.StatusServiceUnavailable)
-		} else {
-			forward(i, rw, r)
+	config := configOf(defaultBackends)
+	if *configPath != "" {
+		if config, err = loadConfig(*configPath); err != nil {
+			log.Fatalf("Error loading config: %s", err)
+		}
+		go watchConfig(*configPath, serversPool, configPollInterval, nil)
+	} else if len(backends) > 0 {
+		config = configOf(backends)
+		if err := config.validate(); err != nil {
+			log.Fatalf("Bad backends: %s", err)
 		}
-	}))
+	}
+	serversPool.set(config.Backends)
+
+	go func() {
+		// the backends are probed by the pool as soon as they are added
+		for range time.Tick(healthChecks.interval) {
+			checkHealth(serversPool)
+		}
+	}()
+
+	h := new(http.ServeMux)
+	if *adminToken != "" {
+		handleAdmin(h, serversPool, *adminToken, *drainTimeout)
+		handleStatus(h, serversPool, *adminToken)
+	}
+	h.Handle("/", balance(serversPool, strategy, sticky))
+	var plain http.Handler = h
+	if *h2cEnabled {
+		plain = cleartextHTTP2(h)
+	}
+	frontend := httptools.CreateServer(*port, plain, frontendTimeouts)
+	var tlsFrontend httptools.Server
+	if len(tlsCerts) > 0 {
+		certs, err := loadCertificates(tlsCerts, tlsKeys)
+		if err != nil {
+			log.Fatalf("Error loading certificates: %s", err)
+		}
+		go watchCertificates(certs, configPollInterval, nil)
+		tlsFrontend = httptools.CreateTLSServer(*tlsPort, h, frontendTLS(certs), frontendTimeouts)
+	}
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
+	log.Printf("HTTP/2 without TLS enabled: %t", *h2cEnabled)
+	log.Printf("Balancing strategy: %s", *strategyName)
+	if sticky != nil {
+		log.Printf("Sticky sessions: %s", *stickySpec)
+	}
 	frontend.Start()
+	if tlsFrontend != nil {
+		log.Printf("Terminating TLS on port %d", *tlsPort)
+		tlsFrontend.Start()
+	}
 	signal.WaitForTerminationSignal()
 }
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -13,21 +22,282 @@ type MySuite struct{}
 var _ = Suite(&MySuite{})
 
 func (s *MySuite) TestBalancer(c *C) {
-	c.Assert(chooseServer([]Server{}), Equals, -1)
-	c.Assert(chooseServer([]Server{
-		Server{Url: "", Alive: false, Connections: 0},
+	c.Assert(chooseServer([]*Server{}), Equals, -1)
+	c.Assert(chooseServer([]*Server{
+		&Server{Url: "", Alive: false, Connections: 0},
 	}), Equals, -1)
-	c.Assert(chooseServer([]Server{
-		Server{Url: "", Alive: true, Connections: 0},
+	c.Assert(chooseServer([]*Server{
+		&Server{Url: "", Alive: true, Connections: 0},
 	}), Equals, 0)
-	c.Assert(chooseServer([]Server{
-		Server{Url: "", Alive: true, Connections: 20},
-		Server{Url: "", Alive: true, Connections: 5},
-		Server{Url: "", Alive: true, Connections: 10},
+	c.Assert(chooseServer([]*Server{
+		&Server{Url: "", Alive: true, Connections: 20},
+		&Server{Url: "", Alive: true, Connections: 5},
+		&Server{Url: "", Alive: true, Connections: 10},
 	}), Equals, 1)
-	c.Assert(chooseServer([]Server{
-		Server{Url: "", Alive: true, Connections: 20},
-		Server{Url: "", Alive: false, Connections: 5},
-		Server{Url: "", Alive: true, Connections: 10},
+	c.Assert(chooseServer([]*Server{
+		&Server{Url: "", Alive: true, Connections: 20},
+		&Server{Url: "", Alive: false, Connections: 5},
+		&Server{Url: "", Alive: true, Connections: 10},
 	}), Equals, 2)
+	c.Assert(chooseServer([]*Server{
+		&Server{Url: "", Alive: true, Connections: 20, Weight: 4},
+		&Server{Url: "", Alive: true, Connections: 6},
+		&Server{Url: "", Alive: true, Connections: 10, Weight: 2},
+	}), Equals, 0)
+}
+
+func aliveServers(weights ...int) []*Server {
+	servers := make([]*Server, len(weights))
+	for i, w := range weights {
+		servers[i] = &Server{Url: fmt.Sprintf("server%d:8080", i), Alive: true, Weight: w}
+	}
+	return servers
+}
+
+// Returns how many of n requests each server gets.
+func distribution(strategy Strategy, servers []*Server, n int, request func(i int) *http.Request) []int {
+	counts := make([]int, len(servers))
+	for i := 0; i < n; i++ {
+		chosen := strategy.Choose(servers, request(i))
+		if chosen >= 0 {
+			counts[chosen]++
+		}
+	}
+	return counts
+}
+
+func anyRequest(int) *http.Request {
+	return httptest.NewRequest("GET", "/", nil)
+}
+
+func (s *MySuite) TestRoundRobin(c *C) {
+	strategy, err := newStrategy(strategyRoundRobin, "")
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 5, 1)
+	c.Assert(distribution(strategy, servers, 300, anyRequest), DeepEquals, []int{100, 100, 100})
+
+	servers[1].Alive = false
+	counts := distribution(strategy, servers, 300, anyRequest)
+	c.Assert(counts[1], Equals, 0)
+	c.Assert(counts[0]+counts[2], Equals, 300)
+	c.Assert(strategy.Choose(aliveServers(), anyRequest(0)), Equals, -1)
+}
+
+func (s *MySuite) TestWeightedRoundRobin(c *C) {
+	strategy, err := newStrategy(strategyWeightedRoundRobin, "")
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 2, 3)
+	c.Assert(distribution(strategy, servers, 600, anyRequest), DeepEquals, []int{100, 200, 300})
+
+	// the heaviest server is not picked many times in a row
+	var order []int
+	for i := 0; i < 6; i++ {
+		order = append(order, strategy.Choose(servers, anyRequest(i)))
+	}
+	c.Assert(order, DeepEquals, []int{2, 1, 0, 2, 1, 2})
+
+	servers[2].Alive = false
+	c.Assert(distribution(strategy, servers, 300, anyRequest), DeepEquals, []int{100, 200, 0})
+}
+
+func (s *MySuite) TestLeastConnections(c *C) {
+	strategy, err := newStrategy(strategyLeastConnections, "")
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 1, 2)
+	// requests are not finished, so they spread by the weights
+	counts := make([]int, len(servers))
+	for i := 0; i < 400; i++ {
+		chosen := strategy.Choose(servers, anyRequest(i))
+		servers[chosen].Connections++
+		counts[chosen]++
+	}
+	c.Assert(counts, DeepEquals, []int{100, 100, 200})
+}
+
+func (s *MySuite) TestRandomTwo(c *C) {
+	strategy, err := newStrategy(strategyRandomTwo, "")
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 1, 1, 1)
+	servers[0].Connections = 100
+	counts := distribution(strategy, servers, 3000, anyRequest)
+	// the loaded server is picked only if both choices are it, which never
+	// happens, as the choices are distinct
+	c.Assert(counts[0], Equals, 0)
+	for _, count := range counts[1:] {
+		c.Assert(count > 800 && count < 1200, Equals, true, Commentf("counts %v", counts))
+	}
+
+	servers = aliveServers(1)
+	c.Assert(strategy.Choose(servers, anyRequest(0)), Equals, 0)
+}
+
+func (s *MySuite) TestConsistentHash(c *C) {
+	_, err := newStrategy(strategyConsistentHash, "header")
+	c.Assert(err, NotNil)
+	strategy, err := newStrategy(strategyConsistentHash, "header:x-user")
+	c.Assert(err, IsNil)
+
+	byUser := func(i int) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("x-user", fmt.Sprintf("user%d", i))
+		return r
+	}
+	servers := aliveServers(1, 1, 1)
+	counts := distribution(strategy, servers, 3000, byUser)
+	for _, count := range counts {
+		c.Assert(count > 700 && count < 1300, Equals, true, Commentf("counts %v", counts))
+	}
+
+	chosen := make([]int, 3000)
+	for i := range chosen {
+		chosen[i] = strategy.Choose(servers, byUser(i))
+	}
+	// only the keys of the dead server move
+	servers[1].Alive = false
+	for i := range chosen {
+		now := strategy.Choose(servers, byUser(i))
+		if chosen[i] != 1 {
+			c.Assert(now, Equals, chosen[i])
+		} else {
+			c.Assert(now, Not(Equals), 1)
+		}
+	}
+
+	// and of the removed one when the pool changes
+	servers = append(servers[:1:1], servers[2], &Server{Url: "server3:8080", Alive: true})
+	moved := 0
+	for i := range chosen {
+		now := strategy.Choose(servers, byUser(i))
+		if chosen[i] == 0 && servers[now].Url != "server0:8080" {
+			moved++
+		}
+	}
+	c.Assert(moved < 500, Equals, true, Commentf("%d keys of server0 moved", moved))
+
+	byCookie, err := newStrategy(strategyConsistentHash, "cookie:session")
+	c.Assert(err, IsNil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	first := byCookie.Choose(servers, r)
+	for i := 0; i < 10; i++ {
+		c.Assert(byCookie.Choose(servers, r), Equals, first)
+	}
+}
+
+func (s *MySuite) TestLeastLatency(c *C) {
+	strategy, err := newStrategy(strategyLeastLatency, "")
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 1, 1)
+	servers[0].Latency = 10 * time.Millisecond
+	servers[1].Latency = 50 * time.Millisecond
+	// unknown latency is tried first
+	c.Assert(strategy.Choose(servers, anyRequest(0)), Equals, 2)
+
+	servers[2].Latency = 100 * time.Millisecond
+	c.Assert(distribution(strategy, servers, 100, anyRequest), DeepEquals, []int{100, 0, 0})
+
+	// the fast server gets more requests, but not all of them
+	counts := make([]int, len(servers))
+	for i := 0; i < 100; i++ {
+		chosen := strategy.Choose(servers, anyRequest(i))
+		servers[chosen].Connections++
+		counts[chosen]++
+	}
+	c.Assert(counts[0] > counts[1] && counts[1] > counts[2] && counts[2] > 0, Equals, true, Commentf("counts %v", counts))
+
+	_, err = newStrategy("fastest", "")
+	c.Assert(err, NotNil)
+}
+
+func (s *MySuite) TestConcurrentForward(c *C) {
+	var backendUrls []string
+	for _, handler := range []http.HandlerFunc{
+		func(rw http.ResponseWriter, r *http.Request) {},
+		func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				return
+			}
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-r.Context().Done():
+			}
+		},
+		func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" {
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+			rw.(http.Flusher).Flush()
+			// the response is cut
+			panic(http.ErrAbortHandler)
+		},
+	} {
+		backend := httptest.NewServer(handler)
+		defer backend.Close()
+		backendUrls = append(backendUrls, strings.TrimPrefix(backend.URL, "http://"))
+	}
+
+	p := &pool{}
+	p.set(configOf(backendUrls).Backends)
+	checkHealth(p)
+	for _, b := range p.backends() {
+		c.Assert(b.isAlive(), Equals, true)
+	}
+	strategy, err := newStrategy(strategyLeastConnections, "")
+	c.Assert(err, IsNil)
+	frontend := httptest.NewServer(balance(p, strategy, nil))
+	defer frontend.Close()
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		// health checks and reloads run meanwhile
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			checkHealth(p)
+			p.set(configOf(backendUrls[:2+i%2]).Backends)
+			p.snapshot()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				wait := time.Minute
+				if (i+j)%3 == 0 {
+					// the client disconnects
+					wait = 5 * time.Millisecond
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), wait)
+				req, _ := http.NewRequestWithContext(ctx, "GET", frontend.URL+"/api", nil)
+				resp, err := http.DefaultClient.Do(req)
+				if err == nil {
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	p.set(configOf(backendUrls).Backends)
+	deadline := time.Now().Add(5 * time.Second)
+	for _, b := range p.backends() {
+		for b.activeConnections() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(b.activeConnections(), Equals, uint64(0), Commentf("backend %s", b.url))
+	}
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Buckets of the rolling window of a circuit breaker
+const breakerBuckets = 10
+
+type breakerState int
+
+const (
+	// The requests pass, their errors and latency are counted
+	breakerClosed breakerState = iota
+	// The requests are rejected until the open timeout passes
+	breakerOpen
+	// A few trial requests pass, which close the breaker if all succeed
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// Settings of the circuit breakers of the backends. A breaker opens when at
+// least minRequests were sent within the window and errorRate of them failed,
+// or their mean latency reached latency.
+type breakerConfig struct {
+	errorRate   float64       // 0 disables the error rate threshold
+	latency     time.Duration // 0 disables the latency threshold
+	window      time.Duration
+	minRequests int
+	openTimeout time.Duration
+	trials      int // requests of the half-open breaker
+}
+
+var breakers = breakerConfig{
+	errorRate:   0.5,
+	window:      10 * time.Second,
+	minRequests: 20,
+	openTimeout: 10 * time.Second,
+	trials:      3,
+}
+
+func (bc breakerConfig) validate() error {
+	if bc.errorRate < 0 || bc.errorRate > 1 || bc.latency < 0 {
+		return fmt.Errorf("breaker error rate must be between 0 and 1 and latency must not be negative")
+	}
+	if bc.window < breakerBuckets*time.Millisecond || bc.openTimeout <= 0 {
+		return fmt.Errorf("breaker window must be at least %s and open timeout must be positive",
+			breakerBuckets*time.Millisecond)
+	}
+	if bc.minRequests < 1 || bc.trials < 1 {
+		return fmt.Errorf("breaker minimum requests and trials must be at least 1")
+	}
+	return nil
+}
+
+func (bc breakerConfig) enabled() bool {
+	return bc.errorRate > 0 || bc.latency > 0
+}
+
+// Stops the traffic to a backend which fails or slows down, until trial
+// requests show it has recovered.
+type breaker struct {
+	url string // of the backend
+
+	mutex     sync.Mutex
+	state     breakerState
+	openedAt  time.Time
+	buckets   [breakerBuckets]breakerBucket
+	trials    int // of the half-open breaker, sent and not reported yet
+	successes int // of the half-open breaker
+}
+
+type breakerBucket struct {
+	start    time.Time
+	requests int
+	failures int
+	latency  time.Duration // total
+}
+
+// Returns the state of the breaker at the moment.
+func (b *breaker) current(bc breakerConfig, now time.Time) breakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.update(bc, now)
+	return b.state
+}
+
+// Reports whether the breaker would let a request through, without taking a
+// trial of the half-open one.
+func (b *breaker) available(bc breakerConfig, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.update(bc, now)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		return b.trials+b.successes < bc.trials
+	}
+	return true
+}
+
+// Lets a request through if the breaker allows. The result of the request
+// must be reported with record, or with cancel if it has none.
+func (b *breaker) allow(bc breakerConfig, now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.update(bc, now)
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.trials+b.successes >= bc.trials {
+			return false
+		}
+		b.trials++
+	}
+	return true
+}
+
+// Records the result of a request let through.
+func (b *breaker) record(ok bool, latency time.Duration, bc breakerConfig, now time.Time) {
+	if !bc.enabled() {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	slow := bc.latency > 0 && latency >= bc.latency
+	switch b.state {
+	case breakerHalfOpen:
+		if b.trials > 0 {
+			b.trials--
+		}
+		if !ok || slow {
+			b.open(now, "a trial request failed")
+			return
+		}
+		b.successes++
+		if b.successes >= bc.trials {
+			b.state = breakerClosed
+			b.buckets = [breakerBuckets]breakerBucket{}
+			log.Printf("Breaker of %s closed", b.url)
+		}
+	case breakerClosed:
+		bucket := b.bucket(bc, now)
+		bucket.requests++
+		bucket.latency += latency
+		if !ok {
+			bucket.failures++
+		}
+		requests, failures, total := b.totals(bc, now)
+		if requests < bc.minRequests {
+			return
+		}
+		if bc.errorRate > 0 && float64(failures) >= bc.errorRate*float64(requests) {
+			b.open(now, fmt.Sprintf("%d of %d requests failed", failures, requests))
+		} else if bc.latency > 0 && total/time.Duration(requests) >= bc.latency {
+			b.open(now, fmt.Sprintf("mean latency is %s", total/time.Duration(requests)))
+		}
+	}
+}
+
+// Returns the trial of a request which has no result, e.g. cancelled by
+// the client.
+func (b *breaker) cancel() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == breakerHalfOpen && b.trials > 0 {
+		b.trials--
+	}
+}
+
+// Moves the open breaker to half-open after the timeout. Called with the
+// mutex locked.
+func (b *breaker) update(bc breakerConfig, now time.Time) {
+	if b.state == breakerOpen && !now.Before(b.openedAt.Add(bc.openTimeout)) {
+		b.state = breakerHalfOpen
+		b.trials, b.successes = 0, 0
+	}
+}
+
+// Called with the mutex locked.
+func (b *breaker) open(now time.Time, reason string) {
+	b.state = breakerOpen
+	b.openedAt = now
+	log.Printf("Breaker of %s opened: %s", b.url, reason)
+}
+
+// Returns the bucket of the window for the moment. Called with the mutex
+// locked.
+func (b *breaker) bucket(bc breakerConfig, now time.Time) *breakerBucket {
+	width := bc.window / breakerBuckets
+	start := now.Truncate(width)
+	bucket := &b.buckets[(start.UnixNano()/int64(width))%breakerBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = breakerBucket{start: start}
+	}
+	return bucket
+}
+
+// Sums the buckets of the window. Called with the mutex locked.
+func (b *breaker) totals(bc breakerConfig, now time.Time) (requests, failures int, latency time.Duration) {
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < bc.window {
+			requests += bucket.requests
+			failures += bucket.failures
+			latency += bucket.latency
+		}
+	}
+	return requests, failures, latency
+}
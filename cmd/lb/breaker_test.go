@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+var testBreakers = breakerConfig{
+	errorRate:   0.5,
+	window:      10 * time.Second,
+	minRequests: 4,
+	openTimeout: 5 * time.Second,
+	trials:      2,
+}
+
+func (s *MySuite) TestBreakerErrorRate(c *C) {
+	bc := testBreakers
+	b := &breaker{url: "a:80"}
+	now := time.Unix(1000, 0)
+
+	// too few requests to judge
+	for i := 0; i < 3; i++ {
+		c.Assert(b.allow(bc, now), Equals, true)
+		b.record(false, time.Millisecond, bc, now)
+	}
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+	b.record(true, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerOpen)
+	c.Assert(b.available(bc, now), Equals, false)
+	c.Assert(b.allow(bc, now), Equals, false)
+
+	// the trials are let through after the timeout
+	now = now.Add(bc.openTimeout)
+	c.Assert(b.current(bc, now), Equals, breakerHalfOpen)
+	c.Assert(b.allow(bc, now), Equals, true)
+	c.Assert(b.allow(bc, now), Equals, true)
+	c.Assert(b.available(bc, now), Equals, false)
+	c.Assert(b.allow(bc, now), Equals, false)
+
+	// a cancelled trial is returned
+	b.cancel()
+	c.Assert(b.available(bc, now), Equals, true)
+	c.Assert(b.allow(bc, now), Equals, true)
+
+	b.record(true, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerHalfOpen)
+	b.record(true, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+
+	// the failures before closing are forgotten
+	b.record(false, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+}
+
+func (s *MySuite) TestBreakerTrialFails(c *C) {
+	bc := testBreakers
+	b := &breaker{url: "a:80"}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 4; i++ {
+		b.record(false, time.Millisecond, bc, now)
+	}
+	c.Assert(b.current(bc, now), Equals, breakerOpen)
+
+	now = now.Add(bc.openTimeout)
+	c.Assert(b.allow(bc, now), Equals, true)
+	b.record(false, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerOpen)
+	// the timeout starts again
+	c.Assert(b.current(bc, now.Add(bc.openTimeout-time.Millisecond)), Equals, breakerOpen)
+	c.Assert(b.current(bc, now.Add(bc.openTimeout)), Equals, breakerHalfOpen)
+}
+
+func (s *MySuite) TestBreakerWindow(c *C) {
+	bc := testBreakers
+	b := &breaker{url: "a:80"}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		b.record(false, time.Millisecond, bc, now)
+	}
+	// the failures leave the window
+	now = now.Add(bc.window)
+	for i := 0; i < 3; i++ {
+		b.record(true, time.Millisecond, bc, now)
+	}
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+	b.record(false, time.Millisecond, bc, now)
+	b.record(false, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+	b.record(false, time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerOpen)
+}
+
+func (s *MySuite) TestBreakerLatency(c *C) {
+	bc := testBreakers
+	bc.errorRate = 0
+	bc.latency = 100 * time.Millisecond
+	b := &breaker{url: "a:80"}
+	now := time.Unix(1000, 0)
+	for i := 0; i < 4; i++ {
+		b.record(false, time.Millisecond, bc, now)
+	}
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+	for i := 0; i < 8; i++ {
+		b.record(true, 200*time.Millisecond, bc, now)
+	}
+	c.Assert(b.current(bc, now), Equals, breakerOpen)
+
+	// a slow trial opens the breaker again
+	now = now.Add(bc.openTimeout)
+	c.Assert(b.allow(bc, now), Equals, true)
+	b.record(true, 150*time.Millisecond, bc, now)
+	c.Assert(b.current(bc, now), Equals, breakerOpen)
+
+	// the disabled breaker stays closed
+	bc.latency = 0
+	b = &breaker{url: "a:80"}
+	for i := 0; i < 10; i++ {
+		b.record(false, time.Second, bc, now)
+	}
+	c.Assert(b.current(bc, now), Equals, breakerClosed)
+}
+
+func (s *MySuite) TestBreakerStatus(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	saved, savedTrace := breakers, *traceEnabled
+	defer func() { breakers, *traceEnabled = saved, savedTrace }()
+	breakers, *traceEnabled = testBreakers, true
+
+	p := &pool{}
+	p.set(configOf([]string{strings.TrimPrefix(backend.URL, "http://")}).Backends)
+	p.backends()[0].setAlive(true)
+	h := new(http.ServeMux)
+	handleStatus(h, p, "secret")
+	h.Handle("/", balance(p, leastConnections{}, nil))
+	frontend := httptest.NewServer(h)
+	defer frontend.Close()
+
+	var froms []string
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(frontend.URL)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		froms = append(froms, resp.Header.Get("lb-from"))
+	}
+	c.Assert(strings.HasSuffix(froms[0], "; breaker=closed"), Equals, true, Commentf("lb-from %s", froms[0]))
+	c.Assert(strings.HasSuffix(froms[3], "; breaker=open"), Equals, true, Commentf("lb-from %s", froms[3]))
+	// the request isn't sent to the backend
+	c.Assert(froms[4], Equals, "")
+
+	resp, err := http.Get(frontend.URL + "/lb/status")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized)
+
+	req, err := http.NewRequest("GET", frontend.URL+"/lb/status", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("authorization", "Bearer secret")
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	var list []backendStatus
+	c.Assert(json.NewDecoder(resp.Body).Decode(&list), IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].Breaker, Equals, "open")
+}
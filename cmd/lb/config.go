@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/teramont/go2-lab-2/signal"
+)
+
+// How often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// Max weight of a backend, the hash ring has ringReplicas points per its unit
+const maxWeight = 1000
+
+// Backends used when neither a config file nor -backend flags are given
+var defaultBackends = []string{"server1:8080", "server2:8080", "server3:8080"}
+
+// Config of the balancer, e.g.
+//
+//	{"backends": [{"url": "server1:8080", "weight": 2, "metadata": {"zone": "a"},
+//		"healthPath": "/ready", "healthStatus": 204}]}
+type Config struct {
+	Backends []BackendConfig `json:"backends"`
+}
+
+type BackendConfig struct {
+	Url string `json:"url"`
+	// Share of the traffic relative to the other backends, 1 if not set, at
+	// most maxWeight
+	Weight   int               `json:"weight,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Path of the health checks, /health if not set
+	HealthPath string `json:"healthPath,omitempty"`
+	// Status of the healthy responses, 200 if not set
+	HealthStatus int `json:"healthStatus,omitempty"`
+}
+
+// Values of a repeated string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func loadConfig(path string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("bad config %s: %w", path, err)
+	}
+	return config, config.validate()
+}
+
+func (c Config) validate() error {
+	seen := make(map[string]bool)
+	for i, b := range c.Backends {
+		if b.Url == "" {
+			return fmt.Errorf("backend %d has no url", i)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("backend %s has negative weight", b.Url)
+		}
+		if b.Weight > maxWeight {
+			return fmt.Errorf("backend %s has weight over %d", b.Url, maxWeight)
+		}
+		if b.HealthPath != "" && !strings.HasPrefix(b.HealthPath, "/") {
+			return fmt.Errorf("health path of backend %s must start with /", b.Url)
+		}
+		if b.HealthStatus != 0 && (b.HealthStatus < 100 || b.HealthStatus > 599) {
+			return fmt.Errorf("backend %s has bad health status %d", b.Url, b.HealthStatus)
+		}
+		if seen[b.Url] {
+			return fmt.Errorf("backend %s is listed twice", b.Url)
+		}
+		seen[b.Url] = true
+	}
+	return nil
+}
+
+// Config of the backends given as the urls.
+func configOf(urls []string) Config {
+	var config Config
+	for _, url := range urls {
+		config.Backends = append(config.Backends, BackendConfig{Url: url})
+	}
+	return config
+}
+
+// Reloads the pool from the config file on SIGHUP or when the file changes,
+// which is checked every interval, until stop is closed. A broken config is
+// logged and the pool is kept.
+func watchConfig(path string, p *pool, interval time.Duration, stop <-chan struct{}) {
+	modTime, size := fileVersion(path)
+	hangups := signal.Hangups()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangups:
+			log.Printf("SIGHUP received, reloading %s", path)
+		case <-ticker.C:
+			newModTime, newSize := fileVersion(path)
+			if newModTime.Equal(modTime) && newSize == size {
+				continue
+			}
+			log.Printf("%s changed, reloading", path)
+		}
+		modTime, size = fileVersion(path)
+		config, err := loadConfig(path)
+		if err != nil {
+			log.Printf("Error reloading config, the pool is kept: %s", err)
+			continue
+		}
+		p.set(config.Backends)
+	}
+}
+
+func fileVersion(path string) (time.Time, int64) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return info.ModTime(), info.Size()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestConfig(c *C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lb.json")
+	write := func(data string) {
+		c.Assert(ioutil.WriteFile(path, []byte(data), 0644), IsNil)
+	}
+
+	write(`{"backends": [{"url": "a:80", "weight": 2, "metadata": {"zone": "x"}}, {"url": "b:80"}]}`)
+	config, err := loadConfig(path)
+	c.Assert(err, IsNil)
+	c.Assert(config.Backends, HasLen, 2)
+	c.Assert(config.Backends[0].Metadata["zone"], Equals, "x")
+
+	for _, bad := range []string{
+		`{"backends": [{"url": "a:80"}, {"url": "a:80"}]}`,
+		`{"backends": [{"weight": 1}]}`,
+		`{"backends": [{"url": "a:80", "weight": -1}]}`,
+		`{"backends": [{"url": "a:80", "weight": 1001}]}`,
+		`{"backends": `,
+	} {
+		write(bad)
+		_, err := loadConfig(path)
+		c.Assert(err, NotNil, Commentf("config %s", bad))
+	}
+}
+
+func (s *MySuite) TestPoolReload(c *C) {
+	p := &pool{}
+	p.set(configOf([]string{"a:80", "b:80"}).Backends)
+	a := p.backends()[0]
+	a.setAlive(true)
+	a.acquire()
+
+	// state of the kept backends survives the reload
+	p.set([]BackendConfig{{Url: "c:80"}, {Url: "a:80", Weight: 5}})
+	servers := p.snapshot()
+	c.Assert(servers, HasLen, 2)
+	c.Assert(servers[0].Url, Equals, "c:80")
+	c.Assert(servers[1].backend, Equals, a)
+	c.Assert(*servers[1], DeepEquals, Server{Url: "a:80", Alive: true, Connections: 1, Weight: 5, backend: a})
+}
+
+func (s *MySuite) TestWatchConfig(c *C) {
+	path := filepath.Join(c.MkDir(), "lb.json")
+	c.Assert(ioutil.WriteFile(path, []byte(`{"backends": [{"url": "a:80"}]}`), 0644), IsNil)
+	p := &pool{}
+	p.set(configOf([]string{"a:80"}).Backends)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchConfig(path, p, 10*time.Millisecond, stop)
+
+	// a broken config is ignored
+	c.Assert(ioutil.WriteFile(path, []byte(`{"backends": [`), 0644), IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(p.snapshot(), HasLen, 1)
+
+	c.Assert(ioutil.WriteFile(path, []byte(`{"backends": [{"url": "a:80"}, {"url": "b:80"}]}`), 0644), IsNil)
+	// the modification time may not change, but the size does
+	deadline := time.Now().Add(time.Second)
+	for len(p.snapshot()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(p.snapshot(), HasLen, 2)
+	os.Remove(path)
+}
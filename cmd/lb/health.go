@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the health checks of a backend
+const (
+	defaultHealthPath   = "/health"
+	defaultHealthStatus = http.StatusOK
+)
+
+// Settings of the active health checks: a backend becomes alive after
+// healthyThreshold successful probes in a row and dead after
+// unhealthyThreshold failed ones. The first probe of a backend decides at once.
+type healthConfig struct {
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// Settings of the passive outlier detection: a backend is ejected after
+// failures consecutive 5xx responses or connection errors. The first
+// ejection lasts backoff, every next one twice as long up to maxBackoff, until
+// the backend responds successfully again.
+type outlierConfig struct {
+	failures   int // 0 disables the detection
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+var (
+	healthChecks = healthConfig{
+		interval:           10 * time.Second,
+		timeout:            3 * time.Second,
+		healthyThreshold:   2,
+		unhealthyThreshold: 2,
+	}
+	outliers = outlierConfig{
+		failures:   5,
+		backoff:    10 * time.Second,
+		maxBackoff: 5 * time.Minute,
+	}
+)
+
+func (hc healthConfig) validate() error {
+	if hc.interval <= 0 || hc.timeout <= 0 {
+		return fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if hc.healthyThreshold < 1 || hc.unhealthyThreshold < 1 {
+		return fmt.Errorf("health check thresholds must be at least 1")
+	}
+	return nil
+}
+
+func (oc outlierConfig) validate() error {
+	if oc.failures < 0 {
+		return fmt.Errorf("ejection failures must not be negative")
+	}
+	if oc.failures > 0 && (oc.backoff <= 0 || oc.maxBackoff < oc.backoff) {
+		return fmt.Errorf("ejection backoff must be positive and not above the maximum")
+	}
+	return nil
+}
+
+// Health of a backend, shared by the probes and the forwarded requests.
+type healthState struct {
+	// unix nanoseconds until which the backend is ejected
+	ejectedUntil int64
+
+	mutex     sync.Mutex
+	probed    bool
+	successes int // probes in a row
+	failures  int
+	errors    int // forwarded requests failed in a row
+	ejections int // in a row, without successful responses between them
+}
+
+// Probes the backend once, reports whether it's healthy.
+func health(config BackendConfig, timeout time.Duration) bool {
+	path, status := config.HealthPath, config.HealthStatus
+	if path == "" {
+		path = defaultHealthPath
+	}
+	if status == 0 {
+		status = defaultHealthStatus
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET",
+		fmt.Sprintf("%s://%s%s", scheme(), config.Url, path), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := backendClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == status
+}
+
+// Probes the backend and updates its health.
+func probe(b *backend, hc healthConfig) {
+	b.recordProbe(health(b.config(), hc.timeout), hc)
+}
+
+// Checks all the servers of the pool.
+func checkHealth(p *pool) {
+	probeAll(p.backends(), healthChecks)
+}
+
+// Probes the backends at once and waits for the results.
+func probeAll(backends []*backend, hc healthConfig) {
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			probe(b, hc)
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (b *backend) recordProbe(ok bool, hc healthConfig) {
+	h := &b.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if ok {
+		h.successes++
+		h.failures = 0
+	} else {
+		h.failures++
+		h.successes = 0
+	}
+	alive := b.isAlive()
+	switch {
+	case !h.probed:
+		alive = ok
+	case h.successes >= hc.healthyThreshold:
+		alive = true
+	case h.failures >= hc.unhealthyThreshold:
+		alive = false
+	}
+	if h.probed && alive != b.isAlive() {
+		if alive {
+			log.Printf("Backend %s is healthy", b.url)
+		} else {
+			log.Printf("Backend %s is unhealthy", b.url)
+		}
+	}
+	h.probed = true
+	b.setAlive(alive)
+}
+
+// Records the result of a forwarded request, ejects the backend if it fails
+// too often.
+func (b *backend) observeResponse(ok bool, oc outlierConfig, now time.Time) {
+	if oc.failures <= 0 {
+		return
+	}
+	h := &b.health
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if ok {
+		h.errors = 0
+		if !b.ejected(now) {
+			h.ejections = 0
+		}
+		return
+	}
+	h.errors++
+	// the requests started before the ejection don't extend it
+	if h.errors < oc.failures || b.ejected(now) {
+		return
+	}
+	h.errors = 0
+	backoff := oc.backoff
+	for i := 0; i < h.ejections && backoff < oc.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > oc.maxBackoff {
+		backoff = oc.maxBackoff
+	}
+	h.ejections++
+	atomic.StoreInt64(&h.ejectedUntil, now.Add(backoff).UnixNano())
+	log.Printf("Backend %s ejected for %s after %d failures", b.url, backoff, oc.failures)
+}
+
+// Reports whether the backend is ejected by the outlier detection.
+func (b *backend) ejected(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&b.health.ejectedUntil)
+}
+
+// Keeps the backend out of the balancing until the time, as its Retry-After
+// header asks.
+func (b *backend) pause(until time.Time) {
+	for {
+		old := atomic.LoadInt64(&b.health.ejectedUntil)
+		if until.UnixNano() <= old {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&b.health.ejectedUntil, old, until.UnixNano()) {
+			log.Printf("Backend %s paused until %s", b.url, until.Format(time.RFC3339))
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestHealth(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ready" {
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer backend.Close()
+	url := strings.TrimPrefix(backend.URL, "http://")
+
+	c.Assert(health(BackendConfig{Url: url}, time.Second), Equals, true)
+	c.Assert(health(BackendConfig{Url: url, HealthPath: "/ready"}, time.Second), Equals, false)
+	c.Assert(health(BackendConfig{Url: url, HealthPath: "/ready", HealthStatus: 204}, time.Second), Equals, true)
+	backend.Close()
+	c.Assert(health(BackendConfig{Url: url}, time.Second), Equals, false)
+
+	for _, bad := range []BackendConfig{
+		{Url: "a:80", HealthPath: "ready"},
+		{Url: "a:80", HealthStatus: 42},
+	} {
+		c.Assert((Config{Backends: []BackendConfig{bad}}).validate(), NotNil)
+	}
+}
+
+func (s *MySuite) TestHealthThresholds(c *C) {
+	hc := healthConfig{interval: time.Second, timeout: time.Second, healthyThreshold: 2, unhealthyThreshold: 3}
+	b := newBackend(BackendConfig{Url: "a:80"})
+
+	// the first probe decides at once
+	b.recordProbe(true, hc)
+	c.Assert(b.isAlive(), Equals, true)
+
+	for i, expected := range []bool{true, true, false} {
+		b.recordProbe(false, hc)
+		c.Assert(b.isAlive(), Equals, expected, Commentf("failure %d", i+1))
+	}
+	// a success breaks the row of the failures
+	b.recordProbe(true, hc)
+	b.recordProbe(false, hc)
+	c.Assert(b.isAlive(), Equals, false)
+	b.recordProbe(true, hc)
+	c.Assert(b.isAlive(), Equals, false)
+	b.recordProbe(true, hc)
+	c.Assert(b.isAlive(), Equals, true)
+}
+
+func (s *MySuite) TestOutlierDetection(c *C) {
+	oc := outlierConfig{failures: 3, backoff: 10 * time.Second, maxBackoff: 30 * time.Second}
+	b := newBackend(BackendConfig{Url: "a:80"})
+	b.setAlive(true)
+	now := time.Now()
+
+	fail := func(n int) {
+		for i := 0; i < n; i++ {
+			b.observeResponse(false, oc, now)
+		}
+	}
+	fail(2)
+	b.observeResponse(true, oc, now)
+	fail(2)
+	c.Assert(b.ejected(now), Equals, false)
+	fail(1)
+	c.Assert(b.ejected(now), Equals, true)
+	c.Assert(b.snapshot().Alive, Equals, false)
+
+	// the backoff doubles while the backend keeps failing
+	for _, backoff := range []time.Duration{10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+		c.Assert(b.ejected(now.Add(backoff-time.Millisecond)), Equals, true, Commentf("backoff %s", backoff))
+		now = now.Add(backoff)
+		c.Assert(b.ejected(now), Equals, false, Commentf("backoff %s", backoff))
+		fail(3)
+	}
+
+	// and is reset by a successful response
+	now = now.Add(time.Minute)
+	b.observeResponse(true, oc, now)
+	fail(3)
+	c.Assert(b.ejected(now.Add(10*time.Second)), Equals, false)
+
+	b = newBackend(BackendConfig{Url: "b:80"})
+	for i := 0; i < 10; i++ {
+		b.observeResponse(false, outlierConfig{}, now)
+	}
+	c.Assert(b.ejected(now), Equals, false)
+}
+
+func (s *MySuite) TestPassiveHealth(c *C) {
+	failing := true
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if failing {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+
+	p := &pool{}
+	p.set(configOf([]string{strings.TrimPrefix(backend.URL, "http://")}).Backends)
+	p.backends()[0].setAlive(true)
+	frontend := httptest.NewServer(balance(p, leastConnections{}, nil))
+	defer frontend.Close()
+
+	get := func() int {
+		resp, err := http.Get(frontend.URL)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < outliers.failures; i++ {
+		c.Assert(get(), Equals, http.StatusInternalServerError)
+	}
+	// the backend is ejected though its health checks pass
+	failing = false
+	c.Assert(get(), Equals, http.StatusServiceUnavailable)
+	c.Assert(p.backends()[0].isAlive(), Equals, true)
+}
+
+func (s *MySuite) TestProbeNewBackends(c *C) {
+	var probes int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer healthy.Close()
+	sick := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer sick.Close()
+	urls := []string{strings.TrimPrefix(healthy.URL, "http://"), strings.TrimPrefix(sick.URL, "http://")}
+
+	// the backends take the traffic without waiting for the health checks
+	p := &pool{}
+	p.set(configOf(urls[:1]).Backends)
+	c.Assert(p.backends()[0].isAlive(), Equals, true)
+	p.set(configOf(urls).Backends)
+	c.Assert(p.backends()[0].isAlive(), Equals, true)
+	c.Assert(p.backends()[1].isAlive(), Equals, false)
+	// only the new ones are probed
+	c.Assert(atomic.LoadInt32(&probes), Equals, int32(1))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// Backends the requests are balanced between: the configured ones, from the
+// config file or flags, and the ones registered over the admin API. The set
+// of the backends may be changed at any time, the requests forwarded to the
+// removed ones finish normally.
+type pool struct {
+	mutex      sync.RWMutex
+	servers    []*backend
+	configured []BackendConfig
+	registered []BackendConfig
+}
+
+// Replaces the configured backends. State of the backends which stay in the
+// pool is kept, the new ones are probed before it returns, so they take the
+// traffic as soon as they are healthy.
+func (p *pool) set(configs []BackendConfig) {
+	p.mutex.Lock()
+	p.configured = configs
+	_, added := p.rebuild()
+	p.mutex.Unlock()
+	probeAll(added, healthChecks)
+}
+
+// Registers the backend, or updates it if it's in the pool already. Reports
+// whether the backend is new.
+func (p *pool) add(config BackendConfig) (*backend, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if replace(p.configured, config) || replace(p.registered, config) {
+		byUrl, _ := p.rebuild()
+		return byUrl[config.Url], false
+	}
+	p.registered = append(p.registered, config)
+	byUrl, _ := p.rebuild()
+	return byUrl[config.Url], true
+}
+
+// Removes the backend. The configured ones return with the next reload of
+// the config.
+func (p *pool) remove(url string) (*backend, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var removed *backend
+	for _, b := range p.servers {
+		if b.url == url {
+			removed = b
+		}
+	}
+	if removed == nil {
+		return nil, false
+	}
+	p.configured = without(p.configured, url)
+	p.registered = without(p.registered, url)
+	p.rebuild()
+	return removed, true
+}
+
+// Rebuilds the servers from the configs and returns them by url, with the
+// ones which were not in the pool. Called with the mutex locked.
+func (p *pool) rebuild() (byUrl map[string]*backend, added []*backend) {
+	old := make(map[string]*backend, len(p.servers))
+	for _, b := range p.servers {
+		old[b.url] = b
+	}
+	byUrl = make(map[string]*backend)
+	servers := make([]*backend, 0, len(p.configured)+len(p.registered))
+	for _, configs := range [][]BackendConfig{p.configured, p.registered} {
+		for _, c := range configs {
+			if byUrl[c.Url] != nil {
+				// registered over the admin API and then added to the config
+				continue
+			}
+			b, ok := old[c.Url]
+			if ok {
+				delete(old, c.Url)
+				b.setConfig(c)
+			} else {
+				b = newBackend(c)
+				added = append(added, b)
+				log.Printf("Backend %s added", c.Url)
+			}
+			servers = append(servers, b)
+			byUrl[c.Url] = b
+		}
+	}
+	for url := range old {
+		log.Printf("Backend %s removed", url)
+	}
+	p.servers = servers
+	return byUrl, added
+}
+
+// Returns the current backends, the slice is not changed by the pool.
+func (p *pool) backends() []*backend {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.servers
+}
+
+// Returns the snapshots of the current backends.
+func (p *pool) snapshot() []*Server {
+	backends := p.backends()
+	servers := make([]*Server, len(backends))
+	for i, b := range backends {
+		servers[i] = b.snapshot()
+	}
+	return servers
+}
+
+// Replaces the config with the same url, reports whether there is one.
+func replace(configs []BackendConfig, config BackendConfig) bool {
+	for i := range configs {
+		if configs[i].Url == config.Url {
+			configs[i] = config
+			return true
+		}
+	}
+	return false
+}
+
+func without(configs []BackendConfig, url string) []BackendConfig {
+	res := make([]BackendConfig, 0, len(configs))
+	for _, c := range configs {
+		if c.Url != url {
+			res = append(res, c)
+		}
+	}
+	return res
+}
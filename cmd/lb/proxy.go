@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the streamed responses are flushed to the clients. Responses of
+// unknown length and event streams are flushed at once.
+const flushInterval = 100 * time.Millisecond
+
+// Idle connections kept to every backend
+const maxIdleConnsPerBackend = 100
+
+// Transport of the requests to the backends, shared by the proxied requests
+// and the health checks, so the connections are reused.
+var transport = newTransport()
+
+var backendClient = &http.Client{Transport: transport}
+
+func newTransport() *http.Transport {
+	return &http.Transport{
+		// the backends are reached directly, not through the proxy of the
+		// environment
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout:   2 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10 * maxIdleConnsPerBackend,
+		MaxIdleConnsPerHost:   maxIdleConnsPerBackend,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+}
+
+// Buffers of the copied response bodies, for httputil.ReverseProxy.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+var buffers = &bufferPool{pool: sync.Pool{New: func() interface{} {
+	return make([]byte, 32<<10)
+}}}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
+
+// Reports whether the client asks to switch the protocol, e.g. to WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Scheme the client used to reach the balancer.
+func forwardedProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
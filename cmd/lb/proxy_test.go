@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Starts the balancer in front of the healthy backend with the handler.
+func proxyTo(handler http.HandlerFunc) (frontend *httptest.Server, stop func()) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == defaultHealthPath {
+			return
+		}
+		handler(rw, r)
+	}))
+	p := &pool{}
+	p.set(configOf([]string{strings.TrimPrefix(backend.URL, "http://")}).Backends)
+	p.backends()[0].setAlive(true)
+	frontend = httptest.NewServer(balance(p, leastConnections{}, nil))
+	return frontend, func() {
+		frontend.Close()
+		backend.Close()
+	}
+}
+
+func (s *MySuite) TestProxyHeaders(c *C) {
+	received := make(chan http.Header, 1)
+	frontend, stop := proxyTo(func(rw http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		rw.Header().Set("connection", "x-backend")
+		rw.Header().Set("x-backend", "hop")
+		rw.Header().Set("x-kept", "1")
+	})
+	defer stop()
+
+	req, err := http.NewRequest("GET", frontend.URL, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("connection", "x-client")
+	req.Header.Set("x-client", "hop")
+	req.Header.Set("keep-alive", "timeout=5")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+
+	header := <-received
+	c.Assert(header.Get("x-client"), Equals, "")
+	c.Assert(header.Get("keep-alive"), Equals, "")
+	c.Assert(header.Get("x-forwarded-for"), Equals, "127.0.0.1")
+	c.Assert(header.Get("x-forwarded-proto"), Equals, "http")
+	c.Assert(resp.Header.Get("x-backend"), Equals, "")
+	c.Assert(resp.Header.Get("x-kept"), Equals, "1")
+}
+
+func (s *MySuite) TestProxyStreaming(c *C) {
+	next := make(chan struct{})
+	frontend, stop := proxyTo(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("trailer", "x-checksum")
+		rw.Write([]byte("first\n"))
+		rw.(http.Flusher).Flush()
+		// the second part waits until the first one reaches the client
+		<-next
+		rw.Write([]byte("second\n"))
+		rw.Header().Set("x-checksum", "42")
+	})
+	defer stop()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "first\n")
+	close(next)
+	rest, err := ioutil.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "second\n")
+	c.Assert(resp.Trailer.Get("x-checksum"), Equals, "42")
+}
+
+func (s *MySuite) TestProxyBodyError(c *C) {
+	frontend, stop := proxyTo(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("partial"))
+		rw.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	})
+	defer stop()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	// the client sees the response is cut instead of a complete one
+	_, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, NotNil)
+}
+
+func (s *MySuite) TestProxyUpgrade(c *C) {
+	frontend, stop := proxyTo(func(rw http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) || r.Header.Get("upgrade") != "echo" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, buffered, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: upgrade\r\nUpgrade: echo\r\n\r\n")
+		buffered.Flush()
+		io.Copy(conn, buffered)
+	})
+	defer stop()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: lb\r\nConnection: upgrade\r\nUpgrade: echo\r\n\r\n"))
+	c.Assert(err, IsNil)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	c.Assert(err, IsNil)
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	// the connection is passed through both ways
+	for _, message := range []string{"ping\n", "pong\n"} {
+		_, err = conn.Write([]byte(message))
+		c.Assert(err, IsNil)
+		line, err := reader.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(line, Equals, message)
+	}
+}
+
+func (s *MySuite) TestProxyTimeout(c *C) {
+	saved := timeout
+	defer func() { timeout = saved }()
+	timeout = 100 * time.Millisecond
+
+	frontend, stop := proxyTo(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(3 * timeout)
+			return
+		}
+		// the body takes longer than the timeout
+		for i := 0; i < 3; i++ {
+			rw.Write([]byte("part\n"))
+			rw.(http.Flusher).Flush()
+			time.Sleep(timeout)
+		}
+	})
+	defer stop()
+
+	resp, err := http.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "part\npart\npart\n")
+
+	// the header still has to arrive in time
+	resp, err = http.Get(frontend.URL + "/slow")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+}
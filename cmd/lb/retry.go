@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Returned by ModifyResponse of the proxy for the responses to be retried
+var errRetry = errors.New("response is retried on another backend")
+
+// Retries the budget allows after a quiet period, and the most it keeps
+const retryReserve = 10
+
+// Longest pause of a backend asked by its Retry-After header
+const maxRetryAfter = time.Minute
+
+// Settings of the retries of the failed requests on other backends. Only the
+// idempotent requests with bodies up to maxBody bytes are retried.
+type retryConfig struct {
+	attempts   int           // retries of a request, 0 disables them
+	tryTimeout time.Duration // until the response header of a try, 0 if only the request timeout applies
+	maxBody    int64
+	budget     *retryBudget
+}
+
+var retries = retryConfig{
+	attempts: 2,
+	maxBody:  64 << 10,
+	budget:   newRetryBudget(0.2),
+}
+
+func (rc retryConfig) validate() error {
+	if rc.attempts < 0 || rc.tryTimeout < 0 || rc.maxBody < 0 {
+		return fmt.Errorf("retries, try timeout and replayed body size must not be negative")
+	}
+	if rc.budget.ratio < 0 {
+		return fmt.Errorf("retry budget must not be negative")
+	}
+	return nil
+}
+
+// Limits the retries to a share of the requests, so that they don't
+// overload the backends when many of them fail.
+type retryBudget struct {
+	ratio float64 // retries per request
+
+	mutex  sync.Mutex
+	tokens float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryReserve}
+}
+
+// Records a request, which earns a share of a retry.
+func (b *retryBudget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > retryReserve {
+		b.tokens = retryReserve
+	}
+}
+
+// Takes a retry from the budget, reports whether there was one.
+func (b *retryBudget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Returns the retry which wasn't used.
+func (b *retryBudget) refund() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens++
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Reports whether the response means the backend couldn't handle the request,
+// so another one may.
+func retryableStatus(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// Reads the body of the request into memory if it's not larger than max, so
+// the request can be sent again with the body from GetBody. Larger bodies are
+// streamed once.
+func bufferBody(r *http.Request, max int64) (replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > max {
+		return false, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(data)) > max {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return false, nil
+	}
+	r.ContentLength = int64(len(data))
+	if len(data) == 0 {
+		r.Body = http.NoBody
+		r.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true, nil
+	}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
+
+// Returns the time until which the backend asks not to send it requests, from
+// the Retry-After header of a 503 response. The header of a 429 response
+// limits the client, not the backend, so it's passed to the client only.
+func retryAfter(resp *http.Response, now time.Time) (time.Time, bool) {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return time.Time{}, false
+	}
+	value := resp.Header.Get("retry-after")
+	if value == "" {
+		return time.Time{}, false
+	}
+	var until time.Time
+	if seconds, err := strconv.Atoi(value); err == nil {
+		until = now.Add(time.Duration(seconds) * time.Second)
+	} else if date, err := http.ParseTime(value); err == nil {
+		until = date
+	} else {
+		return time.Time{}, false
+	}
+	if !until.After(now) {
+		return time.Time{}, false
+	}
+	if until.Sub(now) > maxRetryAfter {
+		until = now.Add(maxRetryAfter)
+	}
+	return until, true
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRetryBudget(c *C) {
+	budget := newRetryBudget(0.5)
+	for i := 0; i < retryReserve; i++ {
+		c.Assert(budget.withdraw(), Equals, true)
+	}
+	c.Assert(budget.withdraw(), Equals, false)
+	budget.deposit()
+	c.Assert(budget.withdraw(), Equals, false)
+	budget.deposit()
+	c.Assert(budget.withdraw(), Equals, true)
+	budget.refund()
+	c.Assert(budget.withdraw(), Equals, true)
+	c.Assert(budget.withdraw(), Equals, false)
+}
+
+func (s *MySuite) TestRetryAfter(c *C) {
+	now := time.Date(2021, 5, 1, 12, 0, 0, 0, time.UTC)
+	response := func(status int, header string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+		resp.Header.Set("retry-after", header)
+		return resp
+	}
+
+	until, ok := retryAfter(response(503, "5"), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(until, Equals, now.Add(5*time.Second))
+	until, ok = retryAfter(response(503, now.Add(time.Hour).Format(http.TimeFormat)), now)
+	c.Assert(ok, Equals, true)
+	c.Assert(until, Equals, now.Add(maxRetryAfter))
+
+	for _, resp := range []*http.Response{
+		response(500, "5"),
+		response(429, "5"),
+		response(503, ""),
+		response(503, "soon"),
+		response(503, now.Add(-time.Hour).Format(http.TimeFormat)),
+	} {
+		_, ok := retryAfter(resp, now)
+		c.Assert(ok, Equals, false)
+	}
+}
+
+func (s *MySuite) TestBufferBody(c *C) {
+	r := httptest.NewRequest("PUT", "/", strings.NewReader("hello"))
+	replayable, err := bufferBody(r, 5)
+	c.Assert(err, IsNil)
+	c.Assert(replayable, Equals, true)
+	for i := 0; i < 2; i++ {
+		body, err := r.GetBody()
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadAll(body)
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Equals, "hello")
+	}
+
+	// larger bodies are streamed unchanged
+	r = httptest.NewRequest("PUT", "/", strings.NewReader("hello, world"))
+	r.ContentLength = -1
+	replayable, err = bufferBody(r, 5)
+	c.Assert(err, IsNil)
+	c.Assert(replayable, Equals, false)
+	data, err := ioutil.ReadAll(r.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "hello, world")
+}
+
+func (s *MySuite) TestFailover(c *C) {
+	dead := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+	var unavailableHits int32
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != defaultHealthPath {
+			// the probes of the new backends don't count
+			atomic.AddInt32(&unavailableHits, 1)
+		}
+		rw.Header().Set("retry-after", "30")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	var limitedHits int32
+	limited := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != defaultHealthPath {
+			atomic.AddInt32(&limitedHits, 1)
+		}
+		rw.Header().Set("retry-after", "30")
+		rw.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	streaming := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			rw.Write([]byte("part\n"))
+			rw.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer streaming.Close()
+	echo := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		io.Copy(rw, r.Body)
+	}))
+	defer echo.Close()
+
+	saved := retries
+	defer func() { retries = saved }()
+	retries = retryConfig{attempts: 2, tryTimeout: 100 * time.Millisecond, maxBody: 1024, budget: newRetryBudget(1)}
+
+	// the first backend is always tried first
+	frontendOf := func(backends ...*httptest.Server) *httptest.Server {
+		var urls []string
+		for _, b := range backends {
+			urls = append(urls, strings.TrimPrefix(b.URL, "http://"))
+		}
+		p := &pool{}
+		p.set(configOf(urls).Backends)
+		for _, b := range p.backends() {
+			b.setAlive(true)
+		}
+		return httptest.NewServer(balance(p, leastConnections{}, nil))
+	}
+	do := func(frontend *httptest.Server, method, body string) (int, string) {
+		req, err := http.NewRequest(method, frontend.URL, strings.NewReader(body))
+		c.Assert(err, IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(data)
+	}
+
+	frontend := frontendOf(dead, unavailable, echo)
+	defer frontend.Close()
+	for i := 0; i < 3; i++ {
+		status, body := do(frontend, "PUT", "hello")
+		c.Assert(status, Equals, http.StatusOK)
+		c.Assert(body, Equals, "hello")
+	}
+	// the backend asked to wait is not chosen
+	c.Assert(atomic.LoadInt32(&unavailableHits), Equals, int32(1))
+	// the request is not idempotent
+	status, _ := do(frontend, "POST", "hello")
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+
+	// the client is limited, not the backend
+	frontend = frontendOf(limited)
+	defer frontend.Close()
+	for i := 0; i < 2; i++ {
+		status, _ = do(frontend, "GET", "")
+		c.Assert(status, Equals, http.StatusTooManyRequests)
+	}
+	c.Assert(atomic.LoadInt32(&limitedHits), Equals, int32(2))
+
+	// the slow backend is given up after the try timeout
+	frontend = frontendOf(slow, echo)
+	defer frontend.Close()
+	start := time.Now()
+	status, _ = do(frontend, "GET", "")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+
+	// the body may take longer than the try timeout
+	frontend = frontendOf(streaming, echo)
+	defer frontend.Close()
+	status, body := do(frontend, "GET", "")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "part\npart\npart\n")
+
+	// no retries are left in the budget
+	retries.budget = &retryBudget{}
+	frontend = frontendOf(dead, echo)
+	defer frontend.Close()
+	status, _ = do(frontend, "GET", "")
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the cookie issued by the balancer if not configured
+const defaultStickyCookie = "lb-session"
+
+// Backends of the sessions. Sessions expire after ttl without requests, the
+// least recently used ones are evicted when there are more than max.
+type sessions struct {
+	ttl time.Duration
+	max int
+	now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // of *session, the most recently used first
+}
+
+type session struct {
+	key     string
+	url     string
+	expires time.Time
+}
+
+func newSessions(ttl time.Duration, max int) *sessions {
+	return &sessions{
+		ttl:     ttl,
+		max:     max,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// Returns the backend of the session.
+func (s *sessions) get(key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return "", false
+	}
+	if !s.now().Before(e.Value.(*session).expires) {
+		s.order.Remove(e)
+		delete(s.entries, key)
+		return "", false
+	}
+	return e.Value.(*session).url, true
+}
+
+// Binds the session to the backend and extends it for ttl.
+func (s *sessions) set(key, url string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	if e, ok := s.entries[key]; ok {
+		e.Value = &session{key, url, now.Add(s.ttl)}
+		s.order.MoveToFront(e)
+	} else {
+		s.entries[key] = s.order.PushFront(&session{key, url, now.Add(s.ttl)})
+	}
+	// the expired and the evicted ones are at the back
+	for back := s.order.Back(); back != nil; back = s.order.Back() {
+		old := back.Value.(*session)
+		if s.order.Len() <= s.max && now.Before(old.expires) {
+			break
+		}
+		s.order.Remove(back)
+		delete(s.entries, old.key)
+	}
+}
+
+func (s *sessions) len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.order.Len()
+}
+
+// Routes the requests of a session to the same backend while it's alive. The
+// session is identified by the cookie issued by the balancer or by the
+// header set by the client.
+type affinity struct {
+	sessions *sessions
+	cookie   string
+	header   string
+}
+
+// Creates the affinity from the spec: "cookie", "cookie:<name>" or
+// "header:<name>".
+func newAffinity(spec string, ttl time.Duration, max int) (*affinity, error) {
+	a := &affinity{sessions: newSessions(ttl, max)}
+	kind, name := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, name = spec[:i], spec[i+1:]
+	}
+	switch {
+	case kind == "cookie":
+		a.cookie = name
+		if a.cookie == "" {
+			a.cookie = defaultStickyCookie
+		}
+	case kind == "header" && name != "":
+		a.header = name
+	default:
+		return nil, fmt.Errorf("bad sticky sessions %q, expected cookie, cookie:<name> or header:<name>", spec)
+	}
+	if max <= 0 {
+		return nil, fmt.Errorf("sessions limit must be positive")
+	}
+	return a, nil
+}
+
+// Returns the session of the request. A new session cookie is set on the
+// response if there is none.
+func (a *affinity) key(rw http.ResponseWriter, r *http.Request) (string, error) {
+	if a.header != "" {
+		return r.Header.Get(a.header), nil
+	}
+	if cookie, err := r.Cookie(a.cookie); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(id[:])
+	http.SetCookie(rw, &http.Cookie{
+		Name:     a.cookie,
+		Value:    key,
+		Path:     "/",
+		MaxAge:   int(a.sessions.ttl / time.Second),
+		HttpOnly: true,
+	})
+	return key, nil
+}
+
+// Returns the backend of the session of the request if it's alive, otherwise
+// the one chosen by the strategy, which the session is bound to.
+func (a *affinity) choose(servers []*Server, strategy Strategy, rw http.ResponseWriter, r *http.Request) (int, error) {
+	key, err := a.key(rw, r)
+	if err != nil || key == "" {
+		return strategy.Choose(servers, r), err
+	}
+	if url, ok := a.sessions.get(key); ok {
+		for i, s := range servers {
+			if s.Url == url && s.Alive {
+				a.sessions.set(key, url)
+				return i, nil
+			}
+		}
+	}
+	i := strategy.Choose(servers, r)
+	if i >= 0 {
+		a.sessions.set(key, servers[i].Url)
+	}
+	return i, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestSessions(c *C) {
+	now := time.Unix(0, 0)
+	sessions := newSessions(time.Minute, 2)
+	sessions.now = func() time.Time { return now }
+
+	sessions.set("a", "server0:8080")
+	sessions.set("b", "server1:8080")
+	url, ok := sessions.get("a")
+	c.Assert(ok, Equals, true)
+	c.Assert(url, Equals, "server0:8080")
+
+	// the least recently used session is evicted
+	sessions.set("a", "server0:8080")
+	sessions.set("c", "server2:8080")
+	c.Assert(sessions.len(), Equals, 2)
+	_, ok = sessions.get("b")
+	c.Assert(ok, Equals, false)
+
+	// requests extend the session
+	now = now.Add(40 * time.Second)
+	sessions.set("c", "server2:8080")
+	now = now.Add(40 * time.Second)
+	_, ok = sessions.get("a")
+	c.Assert(ok, Equals, false)
+	_, ok = sessions.get("c")
+	c.Assert(ok, Equals, true)
+	c.Assert(sessions.len(), Equals, 1)
+}
+
+func (s *MySuite) TestAffinity(c *C) {
+	for _, bad := range []string{"", "ip", "header", "header:"} {
+		_, err := newAffinity(bad, time.Minute, 10)
+		c.Assert(err, NotNil, Commentf("spec %q", bad))
+	}
+
+	sticky, err := newAffinity("cookie", time.Minute, 10)
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 1, 1)
+	strategy := &roundRobin{}
+
+	// the first request gets the session cookie
+	rw := httptest.NewRecorder()
+	first, err := sticky.choose(servers, strategy, rw, anyRequest(0))
+	c.Assert(err, IsNil)
+	cookies := rw.Result().Cookies()
+	c.Assert(cookies, HasLen, 1)
+	c.Assert(cookies[0].Name, Equals, defaultStickyCookie)
+
+	withCookie := func() *http.Request {
+		r := anyRequest(0)
+		r.AddCookie(cookies[0])
+		return r
+	}
+	for i := 0; i < 5; i++ {
+		rw := httptest.NewRecorder()
+		chosen, err := sticky.choose(servers, strategy, rw, withCookie())
+		c.Assert(err, IsNil)
+		c.Assert(chosen, Equals, first)
+		c.Assert(rw.Result().Cookies(), HasLen, 0)
+	}
+
+	// the session moves to another backend while its own is down
+	servers[first].Alive = false
+	moved, err := sticky.choose(servers, strategy, httptest.NewRecorder(), withCookie())
+	c.Assert(err, IsNil)
+	c.Assert(moved, Not(Equals), first)
+	servers[first].Alive = true
+	again, err := sticky.choose(servers, strategy, httptest.NewRecorder(), withCookie())
+	c.Assert(err, IsNil)
+	c.Assert(again, Equals, moved)
+}
+
+func (s *MySuite) TestAffinityHeader(c *C) {
+	sticky, err := newAffinity("header:x-session", time.Minute, 10)
+	c.Assert(err, IsNil)
+	servers := aliveServers(1, 1, 1)
+	strategy := &roundRobin{}
+
+	request := func(session string) *http.Request {
+		r := anyRequest(0)
+		if session != "" {
+			r.Header.Set("x-session", session)
+		}
+		return r
+	}
+	rw := httptest.NewRecorder()
+	first, _ := sticky.choose(servers, strategy, rw, request("s1"))
+	c.Assert(rw.Result().Cookies(), HasLen, 0)
+	second, _ := sticky.choose(servers, strategy, httptest.NewRecorder(), request("s2"))
+	c.Assert(second, Not(Equals), first)
+	for i := 0; i < 3; i++ {
+		chosen, _ := sticky.choose(servers, strategy, httptest.NewRecorder(), request("s1"))
+		c.Assert(chosen, Equals, first)
+	}
+
+	// requests without the header are balanced as usual
+	sticky.choose(servers, strategy, httptest.NewRecorder(), request(""))
+	c.Assert(sticky.sessions.len(), Equals, 2)
+}
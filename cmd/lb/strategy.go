@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Strategy chooses the backend for a request.
+type Strategy interface {
+	// Returns the index of the alive server chosen for the request, or -1 if
+	// there are none
+	Choose(servers []*Server, r *http.Request) int
+}
+
+// Names of the strategies accepted by newStrategy
+const (
+	strategyLeastConnections   = "least-connections"
+	strategyRoundRobin         = "round-robin"
+	strategyWeightedRoundRobin = "weighted-round-robin"
+	strategyRandomTwo          = "random-two"
+	strategyConsistentHash     = "consistent-hash"
+	strategyLeastLatency       = "least-latency"
+)
+
+// Creates the strategy by its name. hashKey is used by the consistent
+// hashing, see newHashKey.
+func newStrategy(name, hashKey string) (Strategy, error) {
+	switch name {
+	case strategyLeastConnections:
+		return leastConnections{}, nil
+	case strategyRoundRobin:
+		return &roundRobin{}, nil
+	case strategyWeightedRoundRobin:
+		return &weightedRoundRobin{current: make(map[string]int64)}, nil
+	case strategyRandomTwo:
+		return randomTwo{}, nil
+	case strategyConsistentHash:
+		key, err := newHashKey(hashKey)
+		if err != nil {
+			return nil, err
+		}
+		return &consistentHash{key: key}, nil
+	case strategyLeastLatency:
+		return leastLatency{}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q", name)
+	}
+}
+
+// Picks the server with the least connections per weight.
+type leastConnections struct{}
+
+func (leastConnections) Choose(servers []*Server, _ *http.Request) int {
+	return chooseServer(servers)
+}
+
+// Reports whether a has less connections per weight than b.
+func lessLoaded(a, b *Server) bool {
+	// c1 / w1 < c2 / w2 without the division
+	return a.Connections*b.weight() < b.Connections*a.weight()
+}
+
+// Picks the alive servers in turn.
+type roundRobin struct {
+	next uint64
+}
+
+func (rr *roundRobin) Choose(servers []*Server, _ *http.Request) int {
+	n := uint64(len(servers))
+	start := atomic.AddUint64(&rr.next, 1) - 1
+	for i := uint64(0); i < n; i++ {
+		idx := int((start + i) % n)
+		if servers[idx].Alive {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Smooth weighted round-robin: every server is picked weight times out of
+// the sum of the weights, without bursts of the same server.
+type weightedRoundRobin struct {
+	mutex   sync.Mutex
+	current map[string]int64 // by url
+}
+
+func (wrr *weightedRoundRobin) Choose(servers []*Server, _ *http.Request) int {
+	wrr.mutex.Lock()
+	defer wrr.mutex.Unlock()
+
+	res := -1
+	total := int64(0)
+	for i, s := range servers {
+		if !s.Alive {
+			continue
+		}
+		w := int64(s.weight())
+		wrr.current[s.Url] += w
+		total += w
+		if res < 0 || wrr.current[s.Url] > wrr.current[servers[res].Url] {
+			res = i
+		}
+	}
+	if res >= 0 {
+		wrr.current[servers[res].Url] -= total
+	}
+	// forget the removed servers
+	if len(wrr.current) > 2*len(servers) {
+		present := make(map[string]int64, len(servers))
+		for _, s := range servers {
+			if w, ok := wrr.current[s.Url]; ok {
+				present[s.Url] = w
+			}
+		}
+		wrr.current = present
+	}
+	return res
+}
+
+// Picks two random alive servers and takes the less loaded one.
+type randomTwo struct{}
+
+func (randomTwo) Choose(servers []*Server, _ *http.Request) int {
+	alive := make([]int, 0, len(servers))
+	for i, s := range servers {
+		if s.Alive {
+			alive = append(alive, i)
+		}
+	}
+	switch len(alive) {
+	case 0:
+		return -1
+	case 1:
+		return alive[0]
+	}
+	i := rand.Intn(len(alive))
+	j := rand.Intn(len(alive) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := alive[i], alive[j]
+	if lessLoaded(servers[b], servers[a]) {
+		return b
+	}
+	return a
+}
+
+// Points of a server on the hash ring per unit of its weight
+const ringReplicas = 100
+
+// Sends the requests with the same key to the same server while it's alive.
+// When a server is added or removed only its share of the keys moves.
+type consistentHash struct {
+	key func(r *http.Request) string
+
+	mutex   sync.Mutex
+	urls    []string // of the servers the ring is built for, with their weights
+	weights []uint64
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash   uint32
+	server int
+}
+
+// Returns the function which takes the hashing key from the request: "ip"
+// for the client address, "header:<name>" or "cookie:<name>". Requests
+// without the header or the cookie are hashed by the address.
+func newHashKey(spec string) (func(r *http.Request) string, error) {
+	kind := spec
+	name := ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, name = spec[:i], spec[i+1:]
+	}
+	switch {
+	case kind == "ip" && name == "":
+		return clientIP, nil
+	case kind == "header" && name != "":
+		return func(r *http.Request) string {
+			if value := r.Header.Get(name); value != "" {
+				return value
+			}
+			return clientIP(r)
+		}, nil
+	case kind == "cookie" && name != "":
+		return func(r *http.Request) string {
+			if cookie, err := r.Cookie(name); err == nil && cookie.Value != "" {
+				return cookie.Value
+			}
+			return clientIP(r)
+		}, nil
+	default:
+		return nil, fmt.Errorf("bad hash key %q, expected ip, header:<name> or cookie:<name>", spec)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func hashOf(s string) uint32 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV alone spreads similar strings, e.g. the ring points of a server,
+	// unevenly, so the bits are mixed as in MurmurHash3
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return uint32(x)
+}
+
+func (ch *consistentHash) Choose(servers []*Server, r *http.Request) int {
+	if len(servers) == 0 {
+		return -1
+	}
+	ring := ch.ringOf(servers)
+	hash := hashOf(ch.key(r))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	// the next alive server clockwise
+	for i := 0; i < len(ring); i++ {
+		p := ring[(start+i)%len(ring)]
+		if servers[p.server].Alive {
+			return p.server
+		}
+	}
+	return -1
+}
+
+// Returns the ring of the servers, it's rebuilt when the pool changes.
+func (ch *consistentHash) ringOf(servers []*Server) []ringPoint {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.builtFor(servers) {
+		return ch.ring
+	}
+	ring := make([]ringPoint, 0, len(servers)*ringReplicas)
+	weights := make([]uint64, len(servers))
+	for i, s := range servers {
+		weights[i] = s.weight()
+		for j := 0; j < int(weights[i])*ringReplicas; j++ {
+			ring = append(ring, ringPoint{hashOf(s.Url + "#" + strconv.Itoa(j)), i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	urls := make([]string, len(servers))
+	for i, s := range servers {
+		urls[i] = s.Url
+	}
+	ch.urls, ch.weights, ch.ring = urls, weights, ring
+	return ring
+}
+
+// Reports whether the ring is built for the servers. Called with the mutex
+// locked.
+func (ch *consistentHash) builtFor(servers []*Server) bool {
+	if len(ch.urls) != len(servers) {
+		return false
+	}
+	for i, s := range servers {
+		if ch.urls[i] != s.Url || ch.weights[i] != s.weight() {
+			return false
+		}
+	}
+	return true
+}
+
+// Picks the server with the lowest moving average of the response time,
+// multiplied by its connections, so a fast server doesn't get all the
+// requests at once. Servers without responses yet are tried first.
+type leastLatency struct{}
+
+func (leastLatency) Choose(servers []*Server, _ *http.Request) int {
+	res := -1
+	best := math.Inf(1)
+	for i, s := range servers {
+		if !s.Alive {
+			continue
+		}
+		cost := float64(s.Latency) * float64(s.Connections+1) / float64(s.weight())
+		if cost < best {
+			res, best = i, cost
+		}
+	}
+	return res
+}
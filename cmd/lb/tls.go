@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teramont/go2-lab-2/signal"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Certificates with their keys loaded from files, which may be reloaded. The
+// one for a TLS connection is chosen by the server name the client asks for,
+// the first one is used if none matches.
+type certificates struct {
+	certFiles []string
+	keyFiles  []string
+
+	mutex   sync.RWMutex
+	certs   []*tls.Certificate
+	byName  map[string]*tls.Certificate
+	version string // of the loaded files
+}
+
+// Loads the certificates from the PEM files, keyFiles[i] is the key of
+// certFiles[i].
+func loadCertificates(certFiles, keyFiles []string) (*certificates, error) {
+	if len(certFiles) == 0 || len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("every certificate needs a key")
+	}
+	c := &certificates{certFiles: certFiles, keyFiles: keyFiles}
+	return c, c.reload()
+}
+
+// Loads the files again. The certificates are kept if any of the files is
+// broken.
+func (c *certificates) reload() error {
+	version := c.filesVersion()
+	certs := make([]*tls.Certificate, len(c.certFiles))
+	byName := make(map[string]*tls.Certificate)
+	for i := range c.certFiles {
+		cert, err := tls.LoadX509KeyPair(c.certFiles[i], c.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("bad certificate %s: %w", c.certFiles[i], err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("bad certificate %s: %w", c.certFiles[i], err)
+		}
+		certs[i] = &cert
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// the first certificate for a name wins
+			if byName[name] == nil {
+				byName[name] = &cert
+			}
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.certs, c.byName, c.version = certs, byName, version
+	return nil
+}
+
+// Chooses the certificate by SNI, for tls.Config.
+func (c *certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert := c.byName[name]; cert != nil {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert := c.byName["*"+name[i:]]; cert != nil {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
+
+// Returns the first certificate, for tls.Config of the connections to the
+// backends.
+func (c *certificates) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.certs[0], nil
+}
+
+// Reloads the certificates on SIGHUP or when their files change, which is
+// checked every interval, until stop is closed.
+func watchCertificates(c *certificates, interval time.Duration, stop <-chan struct{}) {
+	c.mutex.RLock()
+	version := c.version
+	c.mutex.RUnlock()
+	hangups := signal.Hangups()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangups:
+		case <-ticker.C:
+			if c.filesVersion() == version {
+				continue
+			}
+		}
+		version = c.filesVersion()
+		if err := c.reload(); err != nil {
+			log.Printf("Error reloading certificates, the old ones are kept: %s", err)
+			continue
+		}
+		log.Printf("Certificates %s reloaded", strings.Join(c.certFiles, ", "))
+	}
+}
+
+func (c *certificates) filesVersion() string {
+	var version strings.Builder
+	for _, path := range append(append([]string{}, c.certFiles...), c.keyFiles...) {
+		modTime, size := fileVersion(path)
+		fmt.Fprintf(&version, "%d:%d;", modTime.UnixNano(), size)
+	}
+	return version.String()
+}
+
+// Config of the TLS frontend. HTTP/2 is negotiated by the server.
+func frontendTLS(c *certificates) *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// Serves HTTP/2 without TLS (h2c) to the clients which ask for it, with prior
+// knowledge or an upgrade, and HTTP/1.1 to the rest.
+func cleartextHTTP2(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// Config of the TLS connections to the backends: their certificates are
+// verified with the CAs from caFile, or the system ones if it's empty, and
+// the client certificate is presented if given.
+func backendTLS(caFile string, client *certificates) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if client != nil {
+		config.GetClientCertificate = client.GetClientCertificate
+	}
+	return config, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	. "gopkg.in/check.v1"
+)
+
+// Authority which issues the certificates of a test.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+	pool *x509.CertPool
+}
+
+func newTestCA(c *C, dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(dir, "ca.pem"), pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	c.Assert(ioutil.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	return ca
+}
+
+// Issues the certificate for the names, which may be IP addresses, and writes
+// it with its key to the files.
+func (ca *testCA) issue(c *C, certFile, keyFile string, serial int64, names ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	c.Assert(err, IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	c.Assert(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600), IsNil)
+}
+
+// Returns the serial number of the certificate the server presents for the
+// name.
+func servedSerial(c *C, addr, name string, ca *testCA) int64 {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: name, RootCAs: ca.pool})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func (s *MySuite) TestCertificates(c *C) {
+	dir := c.MkDir()
+	ca := newTestCA(c, dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	ca.issue(c, path("a.pem"), path("a.key"), 10, "a.test")
+	ca.issue(c, path("b.pem"), path("b.key"), 20, "*.b.test", "b.test")
+
+	_, err := loadCertificates([]string{path("a.pem")}, nil)
+	c.Assert(err, NotNil)
+	_, err = loadCertificates([]string{path("a.pem")}, []string{path("b.key")})
+	c.Assert(err, NotNil)
+
+	certs, err := loadCertificates([]string{path("a.pem"), path("b.pem")}, []string{path("a.key"), path("b.key")})
+	c.Assert(err, IsNil)
+	for name, serial := range map[string]int64{
+		"a.test":     10,
+		"B.test.":    20,
+		"x.b.test":   20,
+		"x.y.b.test": 10,
+		"":           10,
+	} {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		c.Assert(err, IsNil)
+		c.Assert(cert.Leaf.SerialNumber.Int64(), Equals, serial, Commentf("name %q", name))
+	}
+}
+
+func (s *MySuite) TestTLSFrontend(c *C) {
+	dir := c.MkDir()
+	ca := newTestCA(c, dir)
+	certFile, keyFile := filepath.Join(dir, "a.pem"), filepath.Join(dir, "a.key")
+	ca.issue(c, certFile, keyFile, 10, "a.test")
+	certs, err := loadCertificates([]string{certFile}, []string{keyFile})
+	c.Assert(err, IsNil)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("x-forwarded-proto")))
+	}))
+	defer backend.Close()
+	p := &pool{}
+	p.set(configOf([]string{strings.TrimPrefix(backend.URL, "http://")}).Backends)
+	p.backends()[0].setAlive(true)
+	frontend := httptest.NewUnstartedServer(balance(p, leastConnections{}, nil))
+	frontend.TLS = frontendTLS(certs)
+	frontend.EnableHTTP2 = true
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{ServerName: "a.test", RootCAs: ca.pool},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get(frontend.URL)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(resp.ProtoMajor, Equals, 2)
+	c.Assert(string(body), Equals, "https")
+
+	// the certificate is replaced without a restart
+	addr := strings.TrimPrefix(frontend.URL, "https://")
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchCertificates(certs, 10*time.Millisecond, stop)
+	ca.issue(c, certFile, keyFile, 11, "a.test")
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(c, addr, "a.test", ca) != 11 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(servedSerial(c, addr, "a.test", ca), Equals, int64(11))
+
+	// a broken file doesn't replace it
+	c.Assert(ioutil.WriteFile(keyFile, []byte("broken"), 0600), IsNil)
+	c.Assert(certs.reload(), NotNil)
+	c.Assert(servedSerial(c, addr, "a.test", ca), Equals, int64(11))
+}
+
+func (s *MySuite) TestCleartextHTTP2(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("x-forwarded-proto")))
+	}))
+	defer backend.Close()
+	p := &pool{}
+	p.set(configOf([]string{strings.TrimPrefix(backend.URL, "http://")}).Backends)
+	p.backends()[0].setAlive(true)
+	frontend := httptest.NewServer(cleartextHTTP2(balance(p, leastConnections{}, nil)))
+	defer frontend.Close()
+
+	get := func(client *http.Client) (proto int, body string) {
+		resp, err := client.Get(frontend.URL)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.ProtoMajor, string(data)
+	}
+	// HTTP/2 with prior knowledge
+	proto, body := get(&http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}})
+	c.Assert(proto, Equals, 2)
+	c.Assert(body, Equals, "http")
+	proto, body = get(http.DefaultClient)
+	c.Assert(proto, Equals, 1)
+	c.Assert(body, Equals, "http")
+}
+
+func (s *MySuite) TestBackendMutualTLS(c *C) {
+	dir := c.MkDir()
+	ca := newTestCA(c, dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	ca.issue(c, path("backend.pem"), path("backend.key"), 10, "127.0.0.1")
+	ca.issue(c, path("lb.pem"), path("lb.key"), 20, "lb")
+	backendCert, err := tls.LoadX509KeyPair(path("backend.pem"), path("backend.key"))
+	c.Assert(err, IsNil)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{backendCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+	url := strings.TrimPrefix(backend.URL, "https://")
+
+	savedHttps, savedConfig := *https, transport.TLSClientConfig
+	defer func() {
+		*https, transport.TLSClientConfig = savedHttps, savedConfig
+		transport.CloseIdleConnections()
+	}()
+	*https = true
+
+	// the backend requires the client certificate
+	transport.TLSClientConfig, err = backendTLS(ca.file, nil)
+	c.Assert(err, IsNil)
+	c.Assert(health(BackendConfig{Url: url}, time.Second), Equals, false)
+
+	client, err := loadCertificates([]string{path("lb.pem")}, []string{path("lb.key")})
+	c.Assert(err, IsNil)
+	transport.TLSClientConfig, err = backendTLS(ca.file, client)
+	c.Assert(err, IsNil)
+	c.Assert(health(BackendConfig{Url: url}, time.Second), Equals, true)
+
+	// the certificate of the backend is verified with the CA
+	transport.TLSClientConfig, err = backendTLS("", client)
+	c.Assert(err, IsNil)
+	transport.CloseIdleConnections()
+	c.Assert(health(BackendConfig{Url: url}, time.Second), Equals, false)
+
+	_, err = backendTLS(path("lb.key"), nil)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Attempts to register in the balancer, which may start after the server
+const registerAttempts = 10
+const registerBackoff = time.Second
+
+// Client of the admin API of the balancer.
+type balancer struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+func newBalancer(addr, token string) *balancer {
+	return &balancer{addr: addr, token: token, http: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Adds the backend to the pool of the balancer, retrying until it succeeds or
+// ctx is done.
+func (b *balancer) register(ctx context.Context, backend string) error {
+	body, err := json.Marshal(struct {
+		Url string `json:"url"`
+	}{backend})
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = b.do(ctx, "POST", "/lb/backends", body)
+		if err == nil || attempt == registerAttempts {
+			return err
+		}
+		log.Printf("Failed to register in the balancer, retrying: %s", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(registerBackoff):
+		}
+	}
+}
+
+// Removes the backend from the pool of the balancer, which responds when the
+// requests forwarded to it are finished.
+func (b *balancer) deregister(ctx context.Context, backend string) error {
+	return b.do(ctx, "DELETE", "/lb/backends/"+url.PathEscape(backend), nil)
+}
+
+func (b *balancer) do(ctx context.Context, method, path string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, b.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("authorization", "Bearer "+b.token)
+	req.Header.Set("content-type", "application/json")
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("balancer responded with %s", resp.Status)
+	}
+	return nil
+}
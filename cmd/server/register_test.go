@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBalancer_Register(t *testing.T) {
+	var requests []string
+	lb := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	defer lb.Close()
+
+	ctx := context.Background()
+	if err := newBalancer(lb.URL, "secret").register(ctx, "server4:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBalancer(lb.URL, "secret").deregister(ctx, "server4:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newBalancer(lb.URL, "wrong").deregister(ctx, "server4:8080"); err == nil {
+		t.Errorf("Expected an error for the wrong token")
+	}
+
+	expected := []string{
+		`POST /lb/backends {"url":"server4:8080"}`,
+		`DELETE /lb/backends/server4:8080 `,
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("Unexpected requests %q", requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], requests[i])
+		}
+	}
+}
@@ -1,41 +1,39 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/teramont/go2-lab-2/dbclient"
 	"github.com/teramont/go2-lab-2/httptools"
 	"github.com/teramont/go2-lab-2/signal"
 )
 
 var port = flag.Int("port", 8080, "server port")
 var dbPort = flag.Int("db", 8070, "db port")
+var lbAddr = flag.String("lb", "", "address of the balancer to register in, e.g. http://balancer:8090")
+var lbToken = flag.String("lb-token", os.Getenv("LB_ADMIN_TOKEN"), "token of the admin API of the balancer")
+var advertise = flag.String("advertise", "", "address the balancer forwards to, hostname:port by default")
+
+// How long the running requests may take at shutdown
+const shutdownTimeout = 10 * time.Second
 
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
 func main() {
-	dbAddr := fmt.Sprintf("http://db:%d", *dbPort)
+	flag.Parse()
+
+	db := dbclient.New(fmt.Sprintf("http://db:%d", *dbPort), dbclient.DefaultOptions)
 	today := time.Now().Format("02-01-2006")
-	url := fmt.Sprintf("%s/db/%s", dbAddr, "zbs-team")
-	body, _ := json.Marshal(struct {
-		Value string `json:"value"`
-	}{
-		Value: today,
-	})
-	req, err := http.Post(url, "application/json", bytes.NewReader(body))
-	if err != nil {
-		log.Fatal(err)
-	}
-	if req.StatusCode != http.StatusOK {
-		log.Fatalf("Database error: status code = %s", req.Status)
+	if err := db.Put(context.Background(), "zbs-team", today); err != nil {
+		log.Fatalf("Database error: %s", err)
 	}
 
 	r := mux.NewRouter()
@@ -59,26 +57,24 @@ func main() {
 			rw.WriteHeader(http.StatusNotFound)
 			return
 		}
-		url := fmt.Sprintf("%s/db/%s", dbAddr, key)
-		resp, err := http.Get(url)
-
-		if err != nil {
-			log.Printf("Failed to get response from: %s", err)
+		value, err := db.Get(r.Context(), key)
+		if err == dbclient.ErrNotFound {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to get %s from db: %s", key, err)
 			rw.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
 
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
-			}
-		}
-		_, err = io.Copy(rw, resp.Body)
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(rw).Encode(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}{key, value})
 		if err != nil {
 			log.Printf("Failed to write response: %s", err)
-			rw.WriteHeader(http.StatusInternalServerError)
-		} else {
-			rw.WriteHeader(resp.StatusCode)
 		}
 	})
 
@@ -88,7 +84,40 @@ func main() {
 
 	h.Handle("/", r)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, h, httptools.DefaultTimeouts)
 	server.Start()
+
+	var lb *balancer
+	backend := *advertise
+	if *lbAddr != "" {
+		lb = newBalancer(*lbAddr, *lbToken)
+		if backend == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.Fatalf("Error getting hostname: %s", err)
+			}
+			backend = fmt.Sprintf("%s:%d", hostname, *port)
+		}
+		go func() {
+			if err := lb.register(context.Background(), backend); err != nil {
+				log.Printf("Failed to register in the balancer: %s", err)
+			} else {
+				log.Printf("Registered in the balancer as %s", backend)
+			}
+		}()
+	}
 	signal.WaitForTerminationSignal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// the balancer stops sending requests before the server stops accepting
+	// them
+	if lb != nil {
+		if err := lb.deregister(ctx, backend); err != nil {
+			log.Printf("Failed to deregister from the balancer: %s", err)
+		}
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping the server: %s", err)
+	}
 }
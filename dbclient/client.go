@@ -0,0 +1,274 @@
+// Package dbclient is a client of the HTTP API of the db service.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Errors of the db, returned for the responses with their status codes.
+var (
+	// 404 Not Found
+	ErrNotFound = fmt.Errorf("record does not exist")
+	// 409 Conflict
+	ErrConflict = fmt.Errorf("keys read by the transaction were changed")
+	// 413 Request Entity Too Large, the key, the value or the batch is too large
+	ErrTooLarge = fmt.Errorf("request is too large")
+	// 507 Insufficient Storage
+	ErrDiskFull = fmt.Errorf("data directory size limit is reached")
+)
+
+// Write of a batch, deletes the key if Delete is set.
+type Write struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty"`
+}
+
+// StatusError is returned for the other unsuccessful responses.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("db responded with %d %s", e.Code, http.StatusText(e.Code))
+	}
+	return fmt.Sprintf("db responded with %d: %s", e.Code, e.Message)
+}
+
+type Options struct {
+	// Namespace of the keys, the default one if empty
+	Namespace string
+	// Timeout of a single attempt
+	Timeout time.Duration
+	// Attempts after the first one, made on network errors and 5xx responses,
+	// negative for none
+	Retries int
+	// Delay before the first retry, doubled for every next one
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Idle connections kept open to the db
+	MaxIdleConns int
+}
+
+var DefaultOptions = Options{
+	Timeout:      3 * time.Second,
+	Retries:      3,
+	Backoff:      50 * time.Millisecond,
+	MaxBackoff:   time.Second,
+	MaxIdleConns: 16,
+}
+
+// Client of the db service, safe for concurrent use.
+type Client struct {
+	base string
+	opts Options
+	http *http.Client
+}
+
+// Creates a client of the db at addr, e.g. http://db:8070. Zero fields of
+// opts are taken from DefaultOptions.
+func New(addr string, opts Options) *Client {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultOptions.Timeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultOptions.Retries
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = DefaultOptions.Backoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+	if opts.MaxIdleConns == 0 {
+		opts.MaxIdleConns = DefaultOptions.MaxIdleConns
+	}
+
+	base := addr + "/db"
+	if opts.Namespace != "" {
+		base += "/" + url.PathEscape(opts.Namespace)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+	return &Client{
+		base: base,
+		opts: opts,
+		http: &http.Client{Transport: transport, Timeout: opts.Timeout},
+	}
+}
+
+// Closes the idle connections.
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
+
+type record struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := c.GetVersion(ctx, key)
+	return value, err
+}
+
+// Returns the value with its version, the sequence number of the write.
+func (c *Client) GetVersion(ctx context.Context, key string) (string, uint64, error) {
+	var res record
+	header, err := c.do(ctx, "GET", "/"+url.PathEscape(key), nil, true, &res)
+	if err != nil {
+		return "", 0, err
+	}
+	version, err := strconv.ParseUint(header.Get("x-version"), 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad version of %s: %w", key, err)
+	}
+	return res.Value, version, nil
+}
+
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	body, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "POST", "/"+url.PathEscape(key), body, true, nil)
+	return err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DELETE", "/"+url.PathEscape(key), nil, true, nil)
+	return err
+}
+
+// Applies the writes at once, if the keys from reads still have the given
+// versions (0 for absent keys). Otherwise returns ErrConflict. Batches with
+// reads are not retried, as a lost response of the applied one would turn
+// into a conflict.
+func (c *Client) Batch(ctx context.Context, reads map[string]uint64, writes []Write) error {
+	body, err := json.Marshal(struct {
+		Reads  map[string]uint64 `json:"reads"`
+		Writes []Write           `json:"writes"`
+	}{reads, writes})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "POST", "/_txn", body, len(reads) == 0, nil)
+	return err
+}
+
+// Returns up to limit keys greater than after in ascending order, all of
+// them if limit is 0.
+func (c *Client) Scan(ctx context.Context, after string, limit int) ([]string, error) {
+	query := url.Values{}
+	query.Set("after", after)
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var keys []string
+	_, err := c.do(ctx, "GET", "/_keys?"+query.Encode(), nil, true, &keys)
+	return keys, err
+}
+
+// Sends the request, retrying it if retry is set, and decodes the JSON
+// response to res unless it's nil.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, retry bool, res interface{}) (http.Header, error) {
+	attempts := 1
+	if retry && c.opts.Retries > 0 {
+		attempts += c.opts.Retries
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := c.sleep(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+		var header http.Header
+		var temporary bool
+		header, temporary, err = c.attempt(ctx, method, path, body, res)
+		if err == nil || !temporary {
+			return header, err
+		}
+	}
+	return nil, err
+}
+
+// Waits before the retry, the delay is randomized so the clients which
+// failed together don't retry together.
+func (c *Client) sleep(ctx context.Context, attempt int) error {
+	delay := c.opts.Backoff << (attempt - 1)
+	if delay > c.opts.MaxBackoff || delay <= 0 {
+		delay = c.opts.MaxBackoff
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+var statusErrors = map[int]error{
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusInsufficientStorage:   ErrDiskFull,
+}
+
+// Makes a single attempt of the request. Reports whether its error is
+// temporary, so the request may be retried.
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, res interface{}) (http.Header, bool, error) {
+	var in io.Reader
+	if body != nil {
+		in = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, in)
+	if err != nil {
+		return nil, false, err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+
+	if err, ok := statusErrors[resp.StatusCode]; ok {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, false, err
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := &StatusError{resp.StatusCode, string(bytes.TrimSpace(data))}
+		temporary := resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented
+		return nil, temporary, err
+	}
+
+	if res != nil {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return nil, true, err
+		}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Header, false, nil
+}
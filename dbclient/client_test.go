@@ -0,0 +1,165 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Fake db which fails the first requests with 503.
+type fakeDb struct {
+	mutex    sync.Mutex
+	values   map[string]string
+	failures int
+	requests int
+}
+
+func (db *fakeDb) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.requests++
+	if db.failures > 0 {
+		db.failures--
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// keys are escaped, so a slash stays in the key
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	switch {
+	case key == "_txn":
+		var req struct {
+			Reads  map[string]uint64 `json:"reads"`
+			Writes []Write           `json:"writes"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Reads) > 0 {
+			rw.WriteHeader(http.StatusConflict)
+			return
+		}
+		for _, w := range req.Writes {
+			db.values[w.Key] = w.Value
+		}
+	case key == "_keys":
+		json.NewEncoder(rw).Encode([]string{r.URL.Query().Get("after") + "1"})
+	case r.Method == "GET":
+		value, ok := db.values[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("x-version", "7")
+		json.NewEncoder(rw).Encode(record{key, value})
+	case r.Method == "POST":
+		var body record
+		json.NewDecoder(r.Body).Decode(&body)
+		if len(body.Value) > 10 {
+			http.Error(rw, "value is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		db.values[key] = body.Value
+	case r.Method == "DELETE":
+		delete(db.values, key)
+	}
+}
+
+func TestClient(t *testing.T) {
+	db := &fakeDb{values: make(map[string]string)}
+	server := httptest.NewServer(db)
+	defer server.Close()
+	client := New(server.URL, Options{Backoff: time.Millisecond})
+	defer client.Close()
+	ctx := context.Background()
+
+	if err := client.Put(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	value, version, err := client.GetVersion(ctx, "a")
+	if err != nil || value != "1" || version != 7 {
+		t.Errorf("Got %q, version %d, error %v", value, version, err)
+	}
+	if err := client.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if err := client.Put(ctx, "a", "too large value"); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+
+	if err := client.Batch(ctx, nil, []Write{{Key: "b", Value: "2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get(ctx, "b"); err != nil || value != "2" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+	err = client.Batch(ctx, map[string]uint64{"b": 1}, []Write{{Key: "b", Delete: true}})
+	if err != ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	if err := client.Put(ctx, "c/d", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := client.Get(ctx, "c/d"); err != nil || value != "3" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+
+	keys, err := client.Scan(ctx, "key", 10)
+	if err != nil || !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("Got keys %v, error %v", keys, err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	db := &fakeDb{values: map[string]string{"a": "1"}}
+	server := httptest.NewServer(db)
+	defer server.Close()
+	client := New(server.URL, Options{Retries: 2, Backoff: time.Millisecond})
+	defer client.Close()
+	ctx := context.Background()
+
+	db.failures = 2
+	if value, err := client.Get(ctx, "a"); err != nil || value != "1" {
+		t.Errorf("Got %q, error %v", value, err)
+	}
+
+	db.failures, db.requests = 3, 0
+	_, err := client.Get(ctx, "a")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 error, got %v", err)
+	}
+	if db.requests != 3 {
+		t.Errorf("Expected 3 attempts, got %d", db.requests)
+	}
+
+	// conditional batches are not retried
+	db.failures, db.requests = 1, 0
+	client.Batch(ctx, map[string]uint64{"a": 1}, nil)
+	if db.requests != 1 {
+		t.Errorf("Expected 1 attempt, got %d", db.requests)
+	}
+
+	// retries stop with the context
+	db.failures = 100
+	client = New(server.URL, Options{Retries: 100, Backoff: 50 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.Get(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline error, got %v", err)
+	}
+}
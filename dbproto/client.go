@@ -0,0 +1,171 @@
+package dbproto
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+var ErrClosed = fmt.Errorf("connection is closed")
+var ErrServer = fmt.Errorf("server error")
+
+// Client of the binary protocol. It is safe for concurrent use: requests of
+// all the goroutines are pipelined over the single connection.
+type Client struct {
+	conn net.Conn
+
+	writeMutex sync.Mutex
+	out        *bufio.Writer
+
+	mutex   sync.Mutex
+	nextId  uint32
+	pending map[uint32]chan frame
+	err     error // why the connection is broken
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		out:     bufio.NewWriterSize(conn, bufSize),
+		pending: make(map[uint32]chan frame),
+	}
+	go c.readResponses()
+	return c
+}
+
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return c.conn.Close()
+}
+
+func (c *Client) readResponses() {
+	in := bufio.NewReaderSize(c.conn, bufSize)
+	for {
+		res, err := readFrame(in)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mutex.Lock()
+		callback, ok := c.pending[res.id]
+		delete(c.pending, res.id)
+		c.mutex.Unlock()
+		if ok {
+			callback <- res
+		}
+	}
+}
+
+// Fails all the pending requests with err, unless the client failed already.
+func (c *Client) fail(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, callback := range c.pending {
+		delete(c.pending, id)
+		close(callback)
+	}
+}
+
+func (c *Client) do(op byte, payload []byte) (frame, error) {
+	callback := make(chan frame, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mutex.Unlock()
+		return frame{}, err
+	}
+	id := c.nextId
+	c.nextId++
+	c.pending[id] = callback
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	err := writeFrame(c.out, frame{id: id, code: op, payload: payload})
+	if err == nil {
+		err = c.out.Flush()
+	}
+	c.writeMutex.Unlock()
+	if err != nil {
+		c.fail(err)
+	}
+
+	res, ok := <-callback
+	if !ok {
+		c.mutex.Lock()
+		err := c.err
+		c.mutex.Unlock()
+		return frame{}, err
+	}
+	return res, errorOf(res)
+}
+
+// Returns the error of the response, datastore errors are restored.
+func errorOf(res frame) error {
+	if res.code == StatusOK {
+		return nil
+	}
+	msg := string(res.payload)
+	for _, err := range []error{
+		datastore.ErrNotFound,
+		datastore.ErrKeyTooLarge,
+		datastore.ErrValueTooLarge,
+		datastore.ErrDiskFull,
+		ErrEmptyKey,
+	} {
+		if statusOf(err) == res.code && err.Error() == msg {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrServer, msg)
+}
+
+func (c *Client) Get(key string) (string, error) {
+	value, _, err := c.GetVersion(key)
+	return value, err
+}
+
+// Returns the value with its version, the sequence number of the write.
+func (c *Client) GetVersion(key string) (string, uint64, error) {
+	res, err := c.do(OpGet, appendString(nil, key))
+	if err != nil {
+		return "", 0, err
+	}
+	d := decoder{buf: res.payload}
+	version := d.uint64()
+	value := d.string()
+	if err := d.finish(); err != nil {
+		return "", 0, err
+	}
+	return value, version, nil
+}
+
+func (c *Client) Put(key, value string) error {
+	_, err := c.do(OpPut, appendString(appendString(nil, key), value))
+	return err
+}
+
+func (c *Client) Delete(key string) error {
+	_, err := c.do(OpDelete, appendString(nil, key))
+	return err
+}
+
+// Applies the writes at once.
+func (c *Client) Batch(writes []datastore.Write) error {
+	_, err := c.do(OpBatch, encodeBatch(writes))
+	return err
+}
@@ -0,0 +1,232 @@
+// Package dbproto implements a compact binary protocol of the db service and
+// its client.
+//
+// Every message is a frame:
+//
+//	| 4 bytes | 4 bytes    | 1 byte      | ...     |
+//	| length  | request id | op / status | payload |
+//
+// where length counts the bytes after it. Strings in the payload are
+// prefixed with their 4 byte length, numbers are little endian. Requests:
+//
+//	GET    key
+//	PUT    key value
+//	DELETE key
+//	BATCH  count, then count times: flags (1 byte, 1 for delete), key, value
+//
+// Responses carry the id of the request and a status. Successful GET has the
+// 8 byte version and the value in the payload, errors have the message.
+// Requests of a connection are handled in order, so the client may send the
+// next ones without waiting for the responses.
+package dbproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+const (
+	OpGet    byte = 1
+	OpPut    byte = 2
+	OpDelete byte = 3
+	OpBatch  byte = 4
+)
+
+const (
+	StatusOK         byte = 0
+	StatusNotFound   byte = 1
+	StatusTooLarge   byte = 2
+	StatusDiskFull   byte = 3
+	StatusBadRequest byte = 4
+	StatusError      byte = 5
+)
+
+// Frames over this size break the connection
+const MaxFrameSize = 64 << 20
+
+const frameHeaderLen = 9
+
+var ErrFrameTooLarge = fmt.Errorf("frame is too large")
+var ErrBadFrame = fmt.Errorf("malformed frame")
+var ErrEmptyKey = fmt.Errorf("empty key")
+
+type frame struct {
+	id      uint32
+	code    byte // op of the request or status of the response
+	payload []byte
+}
+
+func readFrame(in *bufio.Reader) (frame, error) {
+	var header [frameHeaderLen]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return frame{}, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if length < frameHeaderLen-4 {
+		return frame{}, ErrBadFrame
+	}
+	if length > MaxFrameSize {
+		return frame{}, ErrFrameTooLarge
+	}
+	f := frame{
+		id:      binary.LittleEndian.Uint32(header[4:8]),
+		code:    header[8],
+		payload: make([]byte, length-(frameHeaderLen-4)),
+	}
+	if _, err := io.ReadFull(in, f.payload); err != nil {
+		return frame{}, err
+	}
+	return f, nil
+}
+
+func writeFrame(out *bufio.Writer, f frame) error {
+	var header [frameHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(f.payload)+frameHeaderLen-4))
+	binary.LittleEndian.PutUint32(header[4:8], f.id)
+	header[8] = f.code
+	if _, err := out.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := out.Write(f.payload)
+	return err
+}
+
+func appendString(buf []byte, s string) []byte {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(s)))
+	buf = append(buf, size[:]...)
+	return append(buf, s...)
+}
+
+// Decodes the fields of the payload one by one. The first error is kept and
+// returned by err, the fields after it are zero.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 1 {
+		d.err = ErrBadFrame
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 4 {
+		d.err = ErrBadFrame
+		return 0
+	}
+	n := binary.LittleEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return n
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 8 {
+		d.err = ErrBadFrame
+		return 0
+	}
+	n := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return n
+}
+
+func (d *decoder) string() string {
+	size := d.uint32()
+	if d.err != nil {
+		return ""
+	}
+	if uint32(len(d.buf)) < size {
+		d.err = ErrBadFrame
+		return ""
+	}
+	s := string(d.buf[:size])
+	d.buf = d.buf[size:]
+	return s
+}
+
+func (d *decoder) key() string {
+	key := d.string()
+	if d.err == nil && key == "" {
+		d.err = ErrEmptyKey
+	}
+	return key
+}
+
+// Returns the first error, or ErrBadFrame if not all the payload was decoded.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = ErrBadFrame
+	}
+	return d.err
+}
+
+func encodeBatch(writes []datastore.Write) []byte {
+	var count [4]byte
+	binary.LittleEndian.PutUint32(count[:], uint32(len(writes)))
+	buf := append([]byte(nil), count[:]...)
+	for _, w := range writes {
+		if w.Delete {
+			buf = append(buf, 1)
+			buf = appendString(buf, w.Key)
+		} else {
+			buf = append(buf, 0)
+			buf = appendString(buf, w.Key)
+			buf = appendString(buf, w.Value)
+		}
+	}
+	return buf
+}
+
+func decodeBatch(d *decoder) []datastore.Write {
+	count := d.uint32()
+	// every write takes at least 5 bytes, so a broken count fails early
+	if d.err != nil || uint64(count)*5 > uint64(len(d.buf)) {
+		d.err = ErrBadFrame
+		return nil
+	}
+	writes := make([]datastore.Write, count)
+	for i := range writes {
+		writes[i].Delete = d.byte() == 1
+		writes[i].Key = d.key()
+		if !writes[i].Delete {
+			writes[i].Value = d.string()
+		}
+	}
+	return writes
+}
+
+// Status of the response to a request which failed with err.
+func statusOf(err error) byte {
+	switch err {
+	case nil:
+		return StatusOK
+	case datastore.ErrNotFound:
+		return StatusNotFound
+	case datastore.ErrKeyTooLarge, datastore.ErrValueTooLarge:
+		return StatusTooLarge
+	case datastore.ErrDiskFull:
+		return StatusDiskFull
+	case ErrBadFrame, ErrEmptyKey:
+		return StatusBadRequest
+	default:
+		return StatusError
+	}
+}
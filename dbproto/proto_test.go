@@ -0,0 +1,182 @@
+package dbproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+func startServer(t *testing.T) (*Client, string, func()) {
+	dir, err := ioutil.TempDir("", "test-dbproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDbWithOptions(dir, datastore.Options{
+		Limits: datastore.Limits{MaxValueSize: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(db)
+	go server.Serve(listener)
+
+	client, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, listener.Addr().String(), func() {
+		client.Close()
+		server.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClient(t *testing.T) {
+	client, _, stop := startServer(t)
+	defer stop()
+
+	t.Run("put/get", func(t *testing.T) {
+		if err := client.Put("key", "value"); err != nil {
+			t.Fatal(err)
+		}
+		value, version, err := client.GetVersion("key")
+		if err != nil || value != "value" || version == 0 {
+			t.Errorf("Got %q, version %d, error %v", value, version, err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := client.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Get("key"); err != datastore.ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		err := client.Batch([]datastore.Write{
+			{Key: "a", Value: "1"},
+			{Key: "b", Value: "2"},
+			{Key: "a", Delete: true},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Get("a"); err != datastore.ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+		if value, err := client.Get("b"); err != nil || value != "2" {
+			t.Errorf("Got %q, error %v", value, err)
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		err := client.Put("large", strings.Repeat("x", 2048))
+		if err != datastore.ErrValueTooLarge {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+	})
+
+	t.Run("empty key", func(t *testing.T) {
+		if err := client.Put("", "value"); err != ErrEmptyKey {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+		if _, err := client.Get(""); err != ErrEmptyKey {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+		if err := client.Delete(""); err != ErrEmptyKey {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+		err := client.Batch([]datastore.Write{{Key: "c", Value: "3"}, {Key: "", Value: "4"}})
+		if err != ErrEmptyKey {
+			t.Errorf("Expected ErrEmptyKey, got %v", err)
+		}
+		if _, err := client.Get("c"); err != datastore.ErrNotFound {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("pipelining", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 50)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+				if err := client.Put(key, value); err != nil {
+					errs <- err
+					return
+				}
+				got, err := client.Get(key)
+				if err == nil && got != value {
+					err = fmt.Errorf("bad value %q of %s", got, key)
+				}
+				if err != nil {
+					errs <- err
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+}
+
+func TestServer_BadFrames(t *testing.T) {
+	_, addr, stop := startServer(t)
+	defer stop()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	in := bufio.NewReader(conn)
+	out := bufio.NewWriter(conn)
+
+	// unknown op and a truncated payload are answered
+	for i, req := range []frame{
+		{id: 1, code: 42},
+		{id: 2, code: OpPut, payload: appendString(nil, "key")},
+	} {
+		if err := writeFrame(out, req); err != nil {
+			t.Fatal(err)
+		}
+		out.Flush()
+		res, err := readFrame(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.id != req.id || res.code != StatusBadRequest {
+			t.Errorf("Request %d: got id %d, status %d", i, res.id, res.code)
+		}
+	}
+
+	// a frame over the limit breaks the connection
+	var header [frameHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[:], MaxFrameSize+1)
+	out.Write(header[:])
+	out.Flush()
+	if _, err := readFrame(in); err == nil {
+		t.Errorf("Expected the connection to be closed")
+	}
+}
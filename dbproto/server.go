@@ -0,0 +1,157 @@
+package dbproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+const bufSize = 64 << 10
+
+// Server serves the store over the binary protocol.
+type Server struct {
+	store datastore.Store
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewServer(store datastore.Store) *Server {
+	return &Server{
+		store: store,
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Accepts connections until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	s.listener = listener
+	s.mutex.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Stops accepting connections, closes the open ones and waits for their
+// requests to finish.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReaderSize(conn, bufSize)
+	out := bufio.NewWriterSize(conn, bufSize)
+	for {
+		req, err := readFrame(in)
+		if err == ErrBadFrame || err == ErrFrameTooLarge {
+			// the stream can't be followed anymore
+			log.Printf("Binary protocol error from %s: %s", conn.RemoteAddr(), err)
+			return
+		} else if err != nil {
+			return
+		}
+		if err := writeFrame(out, s.handle(req)); err != nil {
+			return
+		}
+		// responses of the pipelined requests are sent together
+		if in.Buffered() == 0 {
+			if err := out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handle(req frame) frame {
+	res := frame{id: req.id}
+	d := decoder{buf: req.payload}
+	var err error
+	switch req.code {
+	case OpGet:
+		key := d.key()
+		if err = d.finish(); err != nil {
+			break
+		}
+		var value string
+		var version uint64
+		value, version, err = s.store.GetVersion(key)
+		if err == nil {
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], version)
+			res.payload = appendString(buf[:], value)
+		}
+	case OpPut:
+		key, value := d.key(), d.string()
+		if err = d.finish(); err == nil {
+			err = s.store.Put(key, value)
+		}
+	case OpDelete:
+		key := d.key()
+		if err = d.finish(); err == nil {
+			err = s.store.Delete(key)
+		}
+	case OpBatch:
+		writes := decodeBatch(&d)
+		if err = d.finish(); err == nil {
+			err = s.store.Apply(nil, writes)
+		}
+	default:
+		err = ErrBadFrame
+	}
+
+	res.code = statusOf(err)
+	if res.code == StatusError {
+		log.Printf("Error handling binary request: %s", err)
+	}
+	if err != nil {
+		res.payload = []byte(err.Error())
+	}
+	return res
+}
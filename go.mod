@@ -4,5 +4,6 @@ go 1.15
 
 require (
 	github.com/gorilla/mux v1.8.0
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
@@ -1,14 +1,20 @@
 package httptools
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
 
 type Server interface {
 	Start()
+	// Stops accepting connections and waits for the active requests
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -17,20 +23,135 @@ type server struct {
 
 func (s server) Start() {
 	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			log.Println("Staring the HTTPS server...")
+			// the certificates are given by the config
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Staring the HTTP server...")
+			err = s.httpServer.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// Timeouts of a server, zero means there is none.
+type Timeouts struct {
+	ReadHeader time.Duration // of the request header
+	Read       time.Duration // of the whole request with the body
+	Write      time.Duration // from the end of the request header until the response is written
+	Idle       time.Duration // between the requests of a connection
+}
+
+// Timeouts of the servers with short requests and responses, the handlers of
+// the long ones move the deadlines with SetReadDeadline and SetWriteDeadline
+var DefaultTimeouts = Timeouts{
+	Read:  10 * time.Second,
+	Write: 10 * time.Second,
+}
+
+func CreateServer(port int, handler http.Handler, timeouts Timeouts) Server {
+	return server{httpServer: newHttpServer(port, handler, timeouts)}
+}
+
+// Creates the server which terminates TLS with the certificates of the config
+// and serves HTTP/2 to the clients which support it.
+func CreateTLSServer(port int, handler http.Handler, config *tls.Config, timeouts Timeouts) Server {
+	httpServer := newHttpServer(port, handler, timeouts)
+	httpServer.TLSConfig = config
+	return server{httpServer: httpServer}
+}
+
+func newHttpServer(port int, handler http.Handler, timeouts Timeouts) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: timeouts.ReadHeader,
+		ReadTimeout:       timeouts.Read,
+		WriteTimeout:      timeouts.Write,
+		IdleTimeout:       timeouts.Idle,
+		MaxHeaderBytes:    1 << 20,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, conn)
 		},
 	}
 }
+
+type connKey struct{}
+
+// Moves the read deadline of the connection of the request, the zero time
+// removes it. Only the HTTP/1 requests to the servers of the package are
+// supported, as an HTTP/2 connection is shared by several requests.
+func SetReadDeadline(r *http.Request, deadline time.Time) error {
+	conn, err := connOf(r)
+	if err != nil {
+		return err
+	}
+	return conn.SetReadDeadline(deadline)
+}
+
+// Moves the write deadline of the connection of the request, like
+// SetReadDeadline.
+func SetWriteDeadline(r *http.Request, deadline time.Time) error {
+	conn, err := connOf(r)
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(deadline)
+}
+
+func connOf(r *http.Request) (net.Conn, error) {
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok || r.ProtoMajor != 1 {
+		return nil, http.ErrNotSupported
+	}
+	return conn, nil
+}
+
+// Returns the body of the request which moves the read deadline of the
+// connection before every read, so the body is limited by the pace of the
+// client rather than by its size.
+func ProgressBody(r *http.Request, timeout time.Duration) io.ReadCloser {
+	return progressBody{r.Body, r, timeout}
+}
+
+type progressBody struct {
+	io.ReadCloser
+	r       *http.Request
+	timeout time.Duration
+}
+
+func (b progressBody) Read(p []byte) (int, error) {
+	SetReadDeadline(b.r, time.Now().Add(b.timeout))
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		// the server goes on reading the connection for the next request
+		SetReadDeadline(b.r, time.Time{})
+	}
+	return n, err
+}
+
+// Returns the writer of the response which moves the write deadline of the
+// connection before every write, like ProgressBody.
+func ProgressWriter(rw http.ResponseWriter, r *http.Request, timeout time.Duration) io.Writer {
+	return progressWriter{rw, r, timeout}
+}
+
+type progressWriter struct {
+	rw      http.ResponseWriter
+	r       *http.Request
+	timeout time.Duration
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	SetWriteDeadline(w.r, time.Now().Add(w.timeout))
+	return w.rw.Write(p)
+}
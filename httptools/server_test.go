@@ -0,0 +1,90 @@
+package httptools
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			// the response takes longer than the server's write timeout
+			time.Sleep(timeout / 2)
+			ProgressWriter(rw, r, timeout).Write([]byte("chunk\n"))
+			rw.(http.Flusher).Flush()
+		}
+	})
+	server := newHttpServer(0, handler, Timeouts{Read: timeout, Write: timeout})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	resp, err := http.Get("http://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Repeat("chunk\n", 5); string(body) != expected {
+		t.Errorf("Expected %q, got %q", expected, body)
+	}
+
+	// the connection is unknown
+	if err := SetWriteDeadline(httptest.NewRequest("GET", "/", nil), time.Time{}); err != http.ErrNotSupported {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestProgressBody(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(ProgressBody(r, timeout))
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Write(body)
+	})
+	server := newHttpServer(0, handler, Timeouts{Read: timeout, Write: time.Second})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	in, out := io.Pipe()
+	go func() {
+		for i := 0; i < 5; i++ {
+			// the body takes longer than the server's read timeout
+			time.Sleep(timeout / 2)
+			out.Write([]byte("chunk\n"))
+		}
+		out.Close()
+	}()
+	resp, err := http.Post("http://"+listener.Addr().String(), "text/plain", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Repeat("chunk\n", 5); string(body) != expected {
+		t.Errorf("Expected %q, got %q", expected, body)
+	}
+}
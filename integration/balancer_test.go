@@ -1,15 +1,18 @@
 package integration
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"testing"
 	"time"
 
+	"github.com/teramont/go2-lab-2/dbclient"
 	. "gopkg.in/check.v1"
 )
 
 const baseAddress = "http://balancer:8090"
+const dbAddress = "http://db:8070"
 
 var client = http.Client{
 	Timeout: 3 * time.Second,
@@ -40,6 +43,35 @@ func (s *IntegrationSuite) TestBalancer(c *C) {
 	}
 }
 
+func (s *IntegrationSuite) TestDb(c *C) {
+	db := dbclient.New(dbAddress, dbclient.Options{Namespace: "integration"})
+	defer db.Close()
+	ctx := context.Background()
+
+	value, err := dbclient.New(dbAddress, dbclient.DefaultOptions).Get(ctx, "zbs-team")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, time.Now().Format("02-01-2006"))
+
+	c.Assert(db.Put(ctx, "a", "1"), IsNil)
+	err = db.Batch(ctx, nil, []dbclient.Write{{Key: "b", Value: "2"}, {Key: "c", Value: "3"}})
+	c.Assert(err, IsNil)
+	value, version, err := db.GetVersion(ctx, "b")
+	c.Assert(err, IsNil)
+	c.Assert(value, Equals, "2")
+
+	keys, err := db.Scan(ctx, "a", 0)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"b", "c"})
+
+	c.Assert(db.Delete(ctx, "a"), IsNil)
+	_, err = db.Get(ctx, "a")
+	c.Assert(err, Equals, dbclient.ErrNotFound)
+
+	reads := map[string]uint64{"b": version}
+	c.Assert(db.Batch(ctx, reads, []dbclient.Write{{Key: "b", Value: "changed"}}), IsNil)
+	c.Assert(db.Batch(ctx, reads, []dbclient.Write{{Key: "b", Delete: true}}), Equals, dbclient.ErrConflict)
+}
+
 func (s *IntegrationSuite) BenchmarkBalancer(c *C) {
 	for i := 0; i < c.N; i++ {
 		resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data?key=zbs-team", baseAddress))
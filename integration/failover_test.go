@@ -0,0 +1,94 @@
+package integration
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Starts a server in the test container, which joins the balancer over its
+// admin API. Returns its address and the function which kills it.
+func startBackend(c *C, token string) (string, func()) {
+	listener, err := net.Listen("tcp", ":0")
+	c.Assert(err, IsNil)
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("ok"))
+	})}
+	go server.Serve(listener)
+
+	hostname, err := os.Hostname()
+	c.Assert(err, IsNil)
+	addr := fmt.Sprintf("%s:%d", hostname, listener.Addr().(*net.TCPAddr).Port)
+	resp := adminRequest(c, token, "POST", "/lb/backends", `{"url": "`+addr+`"}`)
+	c.Assert(resp.StatusCode, Equals, http.StatusCreated)
+	return addr, func() { server.Close() }
+}
+
+func adminRequest(c *C, token, method, path, body string) *http.Response {
+	req, err := http.NewRequest(method, baseAddress+path, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	req.Header.Set("authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	c.Assert(err, IsNil)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func (s *IntegrationSuite) TestFailover(c *C) {
+	token := os.Getenv("LB_ADMIN_TOKEN")
+	if token == "" {
+		c.Skip("LB_ADMIN_TOKEN is not set")
+	}
+	victim, kill := startBackend(c, token)
+	survivor, stop := startBackend(c, token)
+	defer stop()
+	defer func() {
+		for _, addr := range []string{victim, survivor} {
+			adminRequest(c, token, "DELETE", "/lb/backends/"+url.PathEscape(addr), "")
+		}
+	}()
+
+	var sent, failed, fromVictim int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 30; j++ {
+				resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data?key=zbs-team", baseAddress))
+				if atomic.AddInt32(&sent, 1) == 100 {
+					kill()
+				}
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					continue
+				}
+				if resp.StatusCode != http.StatusOK {
+					atomic.AddInt32(&failed, 1)
+				}
+				// the balancer adds the state of the breaker of the backend
+				if strings.Split(resp.Header.Get("lb-from"), ";")[0] == victim {
+					atomic.AddInt32(&fromVictim, 1)
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.Assert(atomic.LoadInt32(&fromVictim) > 0, Equals, true)
+	c.Assert(atomic.LoadInt32(&failed), Equals, int32(0))
+}
@@ -0,0 +1,111 @@
+// Package resp serves the db service over RESP2, the protocol of Redis, so
+// the stock Redis clients can use the store.
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Bulk strings over this size break the connection
+const MaxBulkSize = 64 << 20
+
+// Commands with more arguments break the connection
+const maxArgs = 1 << 20
+
+// Inline commands longer than this break the connection
+const maxInlineSize = 64 << 10
+
+var ErrProtocol = fmt.Errorf("protocol error")
+
+// Reads a command, either an array of bulk strings or an inline one, e.g.
+// "GET key\r\n". Empty inline commands are returned as nil.
+func readCommand(in *bufio.Reader) ([]string, error) {
+	line, err := readLine(in)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, fmt.Errorf("%w: bad array length %q", ErrProtocol, line[1:])
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(in)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected bulk string, got %q", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > MaxBulkSize {
+			return nil, fmt.Errorf("%w: bad bulk length %q", ErrProtocol, line[1:])
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(in, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", ErrProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// Reads a line without the trailing CRLF.
+func readLine(in *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		part, isPrefix, err := in.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, part...)
+		if len(line) > maxInlineSize {
+			return "", fmt.Errorf("%w: line is too long", ErrProtocol)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// Writes the replies.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
@@ -0,0 +1,619 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+const bufSize = 64 << 10
+
+// How often the expired keys are deleted
+const sweepInterval = time.Second
+
+// Keys returned by SCAN without COUNT
+const defaultScanCount = 10
+
+// SCAN cursors remembered for a connection, the older ones are forgotten
+const maxScanCursors = 1024
+
+// Server serves the store over RESP2. Supported commands are GET, SET, DEL,
+// EXISTS, MGET, MSET, SCAN, EXPIRE and PING.
+//
+// Expirations are kept in memory, so they are lost at restart. An expiration
+// belongs to the version of the key it was set on: any later write of the key,
+// including the ones over HTTP, drops it.
+type Server struct {
+	store datastore.Store
+	now   func() time.Time
+
+	expireMutex sync.Mutex
+	expirations map[string]expiration
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// State of a connection, used by its goroutine only.
+type session struct {
+	cursors    map[uint64]string // the last key returned with the cursor
+	lastCursor uint64
+}
+
+type expiration struct {
+	version  uint64
+	deadline time.Time
+}
+
+func NewServer(store datastore.Store) *Server {
+	return &Server{
+		store:       store,
+		now:         time.Now,
+		expirations: make(map[string]expiration),
+		conns:       make(map[net.Conn]struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Accepts connections until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	s.listener = listener
+	s.wg.Add(1)
+	s.mutex.Unlock()
+	go func() {
+		defer s.wg.Done()
+		s.sweep()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mutex.Lock()
+			delete(s.conns, conn)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// Stops accepting connections, closes the open ones and waits for their
+// commands to finish.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	in := bufio.NewReaderSize(conn, bufSize)
+	out := writer{bufio.NewWriterSize(conn, bufSize)}
+	sess := &session{cursors: make(map[uint64]string)}
+	for {
+		args, err := readCommand(in)
+		if errors.Is(err, ErrProtocol) {
+			// the stream can't be followed anymore
+			log.Printf("RESP protocol error from %s: %s", conn.RemoteAddr(), err)
+			out.error("ERR " + err.Error())
+			out.Flush()
+			return
+		} else if err != nil {
+			return
+		}
+		if len(args) > 0 {
+			s.handle(sess, out, args)
+		}
+		// replies of the pipelined commands are sent together
+		if in.Buffered() == 0 {
+			if err := out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type command struct {
+	// bounds of the number of the arguments after the name, -1 for no max
+	minArgs, maxArgs int
+	run              func(s *Server, sess *session, out writer, args []string) error
+}
+
+var commands = map[string]command{
+	"PING":   {0, 1, (*Server).ping},
+	"GET":    {1, 1, (*Server).get},
+	"SET":    {2, 4, (*Server).set},
+	"DEL":    {1, -1, (*Server).del},
+	"EXISTS": {1, -1, (*Server).exists},
+	"MGET":   {1, -1, (*Server).mget},
+	"MSET":   {2, -1, (*Server).mset},
+	"SCAN":   {1, -1, (*Server).scan},
+	"EXPIRE": {2, 2, (*Server).expire},
+}
+
+// Error caused by the command itself, it's not logged.
+type commandError string
+
+func (e commandError) Error() string {
+	return string(e)
+}
+
+const (
+	errSyntax        = commandError("syntax error")
+	errNotInteger    = commandError("value is not an integer or out of range")
+	errExpireTime    = commandError("invalid expire time")
+	errCursor        = commandError("invalid cursor")
+	errNotSupported  = commandError("SCAN is not supported by the storage engine")
+	errMsetArguments = commandError("wrong number of arguments for 'mset' command")
+)
+
+func (s *Server) handle(sess *session, out writer, args []string) {
+	name := strings.ToUpper(args[0])
+	cmd, ok := commands[name]
+	if !ok {
+		out.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	args = args[1:]
+	if len(args) < cmd.minArgs || (cmd.maxArgs >= 0 && len(args) > cmd.maxArgs) {
+		out.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return
+	}
+	if err := cmd.run(s, sess, out, args); err != nil {
+		_, byCommand := err.(commandError)
+		limited := err == datastore.ErrKeyTooLarge || err == datastore.ErrValueTooLarge || err == datastore.ErrDiskFull
+		if !byCommand && !limited {
+			log.Printf("Error handling %s: %s", name, err)
+		}
+		out.error("ERR " + err.Error())
+	}
+}
+
+func (s *Server) ping(_ *session, out writer, args []string) error {
+	if len(args) == 0 {
+		out.simple("PONG")
+	} else {
+		out.bulk(args[0])
+	}
+	return nil
+}
+
+func (s *Server) get(_ *session, out writer, args []string) error {
+	value, ok, err := s.lookup(args[0])
+	if err != nil {
+		return err
+	}
+	if ok {
+		out.bulk(value)
+	} else {
+		out.null()
+	}
+	return nil
+}
+
+// SET key value [EX seconds | PX milliseconds]
+func (s *Server) set(_ *session, out writer, args []string) error {
+	var ttl time.Duration
+	if len(args) == 4 {
+		n, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return errNotInteger
+		}
+		switch strings.ToUpper(args[2]) {
+		case "EX":
+			ttl, err = durationOf(n, time.Second)
+		case "PX":
+			ttl, err = durationOf(n, time.Millisecond)
+		default:
+			return errSyntax
+		}
+		if err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return errExpireTime
+		}
+	} else if len(args) != 2 {
+		return errSyntax
+	}
+
+	if err := s.store.Put(args[0], args[1]); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		if _, err := s.setExpiration(args[0], ttl); err != nil {
+			return err
+		}
+	}
+	out.simple("OK")
+	return nil
+}
+
+func (s *Server) del(_ *session, out writer, args []string) error {
+	var writes []datastore.Write
+	seen := make(map[string]bool)
+	for _, key := range args {
+		_, ok, err := s.lookup(key)
+		if err != nil {
+			return err
+		}
+		if ok && !seen[key] {
+			writes = append(writes, datastore.Write{Key: key, Delete: true})
+			seen[key] = true
+		}
+	}
+	if len(writes) > 0 {
+		if err := s.store.Apply(nil, writes); err != nil {
+			return err
+		}
+	}
+	out.integer(int64(len(writes)))
+	return nil
+}
+
+func (s *Server) exists(_ *session, out writer, args []string) error {
+	count := int64(0)
+	for _, key := range args {
+		_, ok, err := s.lookup(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			count++
+		}
+	}
+	out.integer(count)
+	return nil
+}
+
+func (s *Server) mget(_ *session, out writer, args []string) error {
+	values := make([]*string, len(args))
+	for i, key := range args {
+		value, ok, err := s.lookup(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			values[i] = &value
+		}
+	}
+	out.array(len(values))
+	for _, value := range values {
+		if value == nil {
+			out.null()
+		} else {
+			out.bulk(*value)
+		}
+	}
+	return nil
+}
+
+func (s *Server) mset(_ *session, out writer, args []string) error {
+	if len(args)%2 != 0 {
+		return errMsetArguments
+	}
+	writes := make([]datastore.Write, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		writes = append(writes, datastore.Write{Key: args[i], Value: args[i+1]})
+	}
+	if err := s.store.Apply(nil, writes); err != nil {
+		return err
+	}
+	out.simple("OK")
+	return nil
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+//
+// The connection remembers the last key returned with every cursor and goes
+// on after it, so the keys which exist during the whole iteration are returned
+// once, while the ones added or deleted meanwhile may be missed, as in Redis.
+// The cursors are valid on their connection only and are forgotten after
+// maxScanCursors newer ones.
+func (s *Server) scan(sess *session, out writer, args []string) error {
+	scanner, ok := s.store.(datastore.Scanner)
+	if !ok {
+		return errNotSupported
+	}
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return errCursor
+	}
+	after := ""
+	if cursor != 0 {
+		if after, ok = sess.cursorKey(cursor); !ok {
+			return errCursor
+		}
+	}
+	count := defaultScanCount
+	var match *regexp.Regexp
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = globRegexp(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil {
+				return errNotInteger
+			}
+			if count < 1 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	// one more key tells whether the iteration is over
+	keys, err := scanner.Scan(after, count+1)
+	if err != nil {
+		return err
+	}
+	var next uint64
+	if len(keys) > count {
+		keys = keys[:count]
+		next = sess.newCursor(keys[count-1])
+	}
+
+	found := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if match != nil && !match.MatchString(key) {
+			continue
+		}
+		if s.hasExpiration(key) {
+			if _, ok, err := s.lookup(key); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+		}
+		found = append(found, key)
+	}
+	out.array(2)
+	out.bulk(strconv.FormatUint(next, 10))
+	out.array(len(found))
+	for _, key := range found {
+		out.bulk(key)
+	}
+	return nil
+}
+
+// Remembers the key, returns the cursor which goes on after it.
+func (sess *session) newCursor(key string) uint64 {
+	sess.lastCursor++
+	sess.cursors[sess.lastCursor] = key
+	delete(sess.cursors, sess.lastCursor-maxScanCursors)
+	return sess.lastCursor
+}
+
+func (sess *session) cursorKey(cursor uint64) (string, bool) {
+	key, ok := sess.cursors[cursor]
+	return key, ok
+}
+
+func (s *Server) expire(_ *session, out writer, args []string) error {
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	ttl, err := durationOf(n, time.Second)
+	if err != nil {
+		return err
+	}
+	ok, err := s.setExpiration(args[0], ttl)
+	if err != nil {
+		return err
+	}
+	if ok {
+		out.integer(1)
+	} else {
+		out.integer(0)
+	}
+	return nil
+}
+
+func durationOf(n int64, unit time.Duration) (time.Duration, error) {
+	if n > int64(1<<63-1)/int64(unit) || n < -int64(1<<63-1)/int64(unit) {
+		return 0, errExpireTime
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Converts a Redis glob pattern to a regexp.
+func globRegexp(pattern string) *regexp.Regexp {
+	var re strings.Builder
+	re.WriteString("^")
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+			if c == '\\' || c == '[' {
+				re.WriteByte('\\')
+			}
+			re.WriteByte(c)
+		case c == '*':
+			re.WriteString(".*")
+		case c == '?':
+			re.WriteString(".")
+		case c == '[' && strings.IndexByte(pattern[i+1:], ']') >= 0:
+			inClass = true
+			re.WriteByte(c)
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile("(?s)" + re.String())
+	if err != nil {
+		// a malformed class matches itself literally
+		return regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + "$")
+	}
+	return compiled
+}
+
+// Returns the value of the key unless it's absent or expired.
+func (s *Server) lookup(key string) (string, bool, error) {
+	value, version, err := s.store.GetVersion(key)
+	if err == datastore.ErrNotFound {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	if s.expired(key, version) {
+		if err := s.deleteVersion(key, version); err != nil {
+			return "", false, err
+		}
+		return "", false, nil
+	}
+	return value, true, nil
+}
+
+// Sets the expiration of the current version of the key, if it exists. A
+// non-positive ttl deletes the key at once.
+func (s *Server) setExpiration(key string, ttl time.Duration) (bool, error) {
+	_, version, err := s.store.GetVersion(key)
+	if err == datastore.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if s.expired(key, version) {
+		return false, s.deleteVersion(key, version)
+	}
+	if ttl <= 0 {
+		return true, s.deleteVersion(key, version)
+	}
+	s.expireMutex.Lock()
+	s.expirations[key] = expiration{version, s.now().Add(ttl)}
+	s.expireMutex.Unlock()
+	return true, nil
+}
+
+func (s *Server) hasExpiration(key string) bool {
+	s.expireMutex.Lock()
+	defer s.expireMutex.Unlock()
+	_, ok := s.expirations[key]
+	return ok
+}
+
+// Reports whether the version of the key is expired. Expirations of the
+// previous versions are dropped.
+func (s *Server) expired(key string, version uint64) bool {
+	s.expireMutex.Lock()
+	defer s.expireMutex.Unlock()
+	e, ok := s.expirations[key]
+	if !ok {
+		return false
+	}
+	if e.version != version {
+		delete(s.expirations, key)
+		return false
+	}
+	return !s.now().Before(e.deadline)
+}
+
+// Deletes the key unless it was written after the version.
+func (s *Server) deleteVersion(key string, version uint64) error {
+	err := s.store.Apply(map[string]uint64{key: version}, []datastore.Write{{Key: key, Delete: true}})
+	if err == datastore.ErrConflict {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	s.expireMutex.Lock()
+	if e, ok := s.expirations[key]; ok && e.version == version {
+		delete(s.expirations, key)
+	}
+	s.expireMutex.Unlock()
+	return nil
+}
+
+// Deletes the expired keys until the server is closed.
+func (s *Server) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.expireMutex.Lock()
+		now := s.now()
+		var expired []string
+		versions := make(map[string]uint64)
+		for key, e := range s.expirations {
+			if !now.Before(e.deadline) {
+				expired = append(expired, key)
+				versions[key] = e.version
+			}
+		}
+		s.expireMutex.Unlock()
+
+		for _, key := range expired {
+			if err := s.deleteVersion(key, versions[key]); err != nil {
+				log.Printf("Error deleting expired %s: %s", key, err)
+			}
+		}
+	}
+}
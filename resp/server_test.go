@@ -0,0 +1,291 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/teramont/go2-lab-2/cmd/datastore"
+)
+
+// Minimal RESP client, replies are decoded to string, int64, nil, []interface{}
+// or replyError.
+type testClient struct {
+	conn net.Conn
+	in   *bufio.Reader
+}
+
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+func (c *testClient) send(args ...string) {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	io.WriteString(c.conn, buf.String())
+}
+
+func (c *testClient) do(args ...string) (interface{}, error) {
+	c.send(args...)
+	return c.reply()
+}
+
+func (c *testClient) reply() (interface{}, error) {
+	line, err := c.in.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, replyError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, _ := strconv.Atoi(line[1:])
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.in, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+type clock struct {
+	sync.Mutex
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.Lock()
+	c.t = c.t.Add(d)
+	c.Unlock()
+}
+
+func startServer(t *testing.T) (*testClient, *Server, *clock, func()) {
+	dir, err := ioutil.TempDir("", "test-resp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.NewDbWithOptions(dir, datastore.Options{
+		Limits: datastore.Limits{MaxValueSize: 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Start()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &clock{t: time.Now()}
+	server := NewServer(db)
+	server.now = c.now
+	go server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{conn, bufio.NewReader(conn)}, server, c, func() {
+		conn.Close()
+		server.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServer(t *testing.T) {
+	client, _, _, stop := startServer(t)
+	defer stop()
+
+	for _, tc := range []struct {
+		args  []string
+		reply interface{}
+		err   string
+	}{
+		{[]string{"PING"}, "PONG", ""},
+		{[]string{"ping", "hello"}, "hello", ""},
+		{[]string{"GET", "a"}, nil, ""},
+		{[]string{"SET", "a", "1"}, "OK", ""},
+		{[]string{"GET", "a"}, "1", ""},
+		{[]string{"MSET", "b", "2", "c", "3"}, "OK", ""},
+		{[]string{"MGET", "a", "x", "c"}, []interface{}{"1", nil, "3"}, ""},
+		{[]string{"EXISTS", "a", "b", "x", "a"}, int64(3), ""},
+		{[]string{"DEL", "a", "x", "a"}, int64(1), ""},
+		{[]string{"EXISTS", "a"}, int64(0), ""},
+		{[]string{"SCAN", "0", "COUNT", "1"}, []interface{}{"1", []interface{}{"b"}}, ""},
+		{[]string{"SCAN", "1", "COUNT", "1"}, []interface{}{"0", []interface{}{"c"}}, ""},
+		{[]string{"SCAN", "0", "MATCH", "[c-z]*"}, []interface{}{"0", []interface{}{"c"}}, ""},
+		{[]string{"SCAN", "99"}, nil, "ERR invalid cursor"},
+		{[]string{"EXPIRE", "x", "10"}, int64(0), ""},
+		{[]string{"SET", "big", strings.Repeat("x", 2048)}, nil, "ERR value is too large"},
+		{[]string{"GET"}, nil, "ERR wrong number of arguments for 'get' command"},
+		{[]string{"MSET", "a"}, nil, "ERR wrong number of arguments for 'mset' command"},
+		{[]string{"EXPIRE", "b", "soon"}, nil, "ERR value is not an integer or out of range"},
+		{[]string{"FLUSHALL"}, nil, "ERR unknown command 'FLUSHALL'"},
+	} {
+		reply, err := client.do(tc.args...)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%v: expected error %q, got %v", tc.args, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %s", tc.args, err)
+		}
+		if !reflect.DeepEqual(reply, tc.reply) {
+			t.Errorf("%v: expected %#v, got %#v", tc.args, tc.reply, reply)
+		}
+	}
+}
+
+func TestServer_Scan(t *testing.T) {
+	client, _, _, stop := startServer(t)
+	defer stop()
+	conn, err := net.Dial("tcp", client.conn.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	other := &testClient{conn, bufio.NewReader(conn)}
+
+	client.do("MSET", "a", "1", "b", "2", "c", "3", "d", "4", "e", "5")
+	var keys []interface{}
+	cursor := "0"
+	for i := 0; ; i++ {
+		reply, err := client.do("SCAN", cursor, "COUNT", "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor = reply.([]interface{})[0].(string)
+		keys = append(keys, reply.([]interface{})[1].([]interface{})...)
+		if i == 0 {
+			// the keys before the cursor don't shift it
+			client.do("DEL", "a", "b")
+			// the cursors of the other connections don't evict it
+			if _, err := other.do("SCAN", cursor); err == nil || err.Error() != "ERR invalid cursor" {
+				t.Errorf("Expected invalid cursor on the other connection, got %v", err)
+			}
+			for j := 0; j <= maxScanCursors; j++ {
+				other.do("SCAN", "0", "COUNT", "1")
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if expected := []interface{}{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected %v, got %v", expected, keys)
+	}
+}
+
+func TestServer_Expire(t *testing.T) {
+	client, server, clock, stop := startServer(t)
+	defer stop()
+
+	client.do("MSET", "a", "1", "b", "2", "c", "3")
+	if reply, _ := client.do("EXPIRE", "a", "10"); reply != int64(1) {
+		t.Errorf("Expected 1, got %v", reply)
+	}
+	client.do("EXPIRE", "b", "10")
+	client.do("SET", "c", "3", "EX", "10")
+	// a write drops the expiration
+	client.do("SET", "b", "changed")
+
+	clock.advance(5 * time.Second)
+	if reply, _ := client.do("GET", "a"); reply != "1" {
+		t.Errorf("Key expired too early")
+	}
+	clock.advance(5 * time.Second)
+	for key, expected := range map[string]interface{}{"a": nil, "b": "changed", "c": nil} {
+		if reply, _ := client.do("GET", key); reply != expected {
+			t.Errorf("Expected %v of %s, got %v", expected, key, reply)
+		}
+	}
+
+	client.do("SET", "d", "4", "PX", "100")
+	clock.advance(time.Second)
+	// the sweeper deletes the keys which are never read
+	deadline := time.Now().Add(5 * sweepInterval)
+	for time.Now().Before(deadline) {
+		if _, err := server.store.Get("d"); err == datastore.ErrNotFound {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("Expired keys were not deleted")
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	client, _, _, stop := startServer(t)
+	defer stop()
+
+	// inline commands are accepted too
+	io.WriteString(client.conn, "SET a 1\r\n\r\nGET a\r\n")
+	client.send("PING")
+	for _, expected := range []interface{}{"OK", "1", "PONG"} {
+		if reply, err := client.reply(); err != nil || reply != expected {
+			t.Errorf("Expected %v, got %v, error %v", expected, reply, err)
+		}
+	}
+
+	io.WriteString(client.conn, "*1\r\n$-5\r\n")
+	if _, err := client.reply(); err == nil || !strings.HasPrefix(err.Error(), "ERR protocol error") {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+	if _, err := client.reply(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestServer_NegativeLength(t *testing.T) {
+	for _, command := range []string{"*-1\r\n", "*-3\r\n", "*1\r\n$-1\r\n"} {
+		client, _, _, stop := startServer(t)
+		io.WriteString(client.conn, command)
+		if _, err := client.reply(); err == nil || !strings.HasPrefix(err.Error(), "ERR protocol error") {
+			t.Errorf("%q: expected protocol error, got %v", command, err)
+		}
+		if _, err := client.reply(); err != io.EOF {
+			t.Errorf("%q: expected the connection to be closed, got %v", command, err)
+		}
+		stop()
+	}
+}
@@ -8,8 +8,16 @@ import (
 )
 
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
+	intChannel := make(chan os.Signal, 1)
 	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-intChannel
 	log.Println("Shutting down...")
 }
+
+// Returns the channel which receives SIGHUP, usually a request to reload the
+// configuration.
+func Hangups() <-chan os.Signal {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+	return hupChannel
+}